@@ -1,9 +1,26 @@
+// clawgress-admin-api: management API and embedded admin UI.
+//
+// Settings come from the JSON file named by --config (default
+// $CLAWGRESS_CONFIG or /etc/clawgress/config.json; a missing file means
+// defaults), with CLAWGRESS_* environment variables layered on top. The
+// admin API uses the admin_api, files, tls, rpz and ops_mode sections; see
+// internal/config for the schema and environment names. Changes take effect
+// on restart.
+//
+// Agent, policy and quota changes are pushed to the gateway through its
+// control socket (gateway.control_socket); CRUD responses carry the result
+// as "gateway_reload".
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"embed"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
@@ -11,13 +28,17 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
-	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/config"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/control"
 	cladns "github.com/bufordtjustice2918/crispy-garbanzo/internal/dns"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/egress"
 	"github.com/bufordtjustice2918/crispy-garbanzo/internal/enforcer"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
 	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
 	"github.com/bufordtjustice2918/crispy-garbanzo/internal/opmode"
 	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
@@ -28,14 +49,27 @@ import (
 var uiFS embed.FS
 
 func main() {
-	stateDir := getenv("CLAWGRESS_STATE_DIR", "state")
-	listenAddr := getenv("CLAWGRESS_ADMIN_LISTEN", ":8080")
-	nftApply := getenvBool("CLAWGRESS_NFT_APPLY", true)
-	defaultOpsMode := getenv("CLAWGRESS_OPS_MODE", enforcer.OpsModeDryRun)
-	agentsFile := getenv("CLAWGRESS_AGENTS_FILE", "/etc/clawgress/agents.json")
-	policyFile := getenv("CLAWGRESS_POLICY_FILE", "/etc/clawgress/policy.json")
-	quotaFile := getenv("CLAWGRESS_QUOTA_FILE", "/etc/clawgress/quotas.json")
-	auditFile := getenv("CLAWGRESS_AUDIT_FILE", "/var/log/clawgress/audit.jsonl")
+	configPath := flag.String("config", getenv("CLAWGRESS_CONFIG", "/etc/clawgress/config.json"),
+		"config file; CLAWGRESS_* environment variables override it")
+	flag.Parse()
+
+	cfg, err := config.LoadWithEnv(*configPath, os.LookupEnv)
+	if err != nil {
+		log.Fatalf("load config: %v", err)
+	}
+	stateDir := cfg.AdminAPI.StateDir
+	listenAddr := cfg.AdminAPI.Listen
+	nftApply := cfg.OpsMode.NftApply
+	defaultOpsMode := cfg.OpsMode.Default
+	agentsFile := cfg.Files.Agents
+	policyFile := cfg.Files.Policy
+	quotaFile := cfg.Files.Quotas
+	auditFile := cfg.Files.Audit
+	signSecret := cfg.AdminAPI.PolicySignSecret
+	if signSecret == "" {
+		signSecret = "clawgress-default-sign-key"
+	}
+	rpzPath, rpzZone := cfg.RPZ.ZonePath, cfg.RPZ.ZoneName
 
 	store, err := opmode.NewStore(stateDir)
 	if err != nil {
@@ -57,6 +91,10 @@ func main() {
 		log.Fatalf("load quota limiter: %v", err)
 	}
 
+	// Agent, policy and quota changes are saved to disk and then loaded by
+	// the gateway through its control socket.
+	gw := control.NewClient(cfg.Gateway.ControlSocket)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
@@ -201,6 +239,18 @@ func main() {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "agent_id and api_key are required"})
 				return
 			}
+			if err := identity.ValidateSourceIPs(a.SourceIPs); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := identity.ValidateCertNames(a.CertNames); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := egress.Validate(a.Source); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
 			if a.Status == "" {
 				a.Status = "active"
 			}
@@ -209,8 +259,7 @@ func main() {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			signalGateway()
-			writeJSON(w, http.StatusCreated, a)
+			writeJSON(w, http.StatusCreated, withReload(a, reloadGateway(r.Context(), gw)))
 		default:
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 		}
@@ -222,6 +271,10 @@ func main() {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "agent_id required in path"})
 			return
 		}
+		if agentID, ok := strings.CutSuffix(id, "/flows"); ok && agentID != "" {
+			serveAgentFlows(w, r, gw, agentID)
+			return
+		}
 		switch r.Method {
 		case http.MethodGet:
 			a := reg.LookupByID(id)
@@ -239,8 +292,7 @@ func main() {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			signalGateway()
-			writeJSON(w, http.StatusOK, map[string]string{"deleted": id})
+			writeJSON(w, http.StatusOK, withReload(map[string]string{"deleted": id}, reloadGateway(r.Context(), gw)))
 		default:
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 		}
@@ -268,6 +320,10 @@ func main() {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "action must be 'allow' or 'deny'"})
 				return
 			}
+			if err := policy.ValidateRule(rule); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
 			if rule.AgentID == "" {
 				rule.AgentID = "*"
 			}
@@ -276,8 +332,7 @@ func main() {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			signalGateway()
-			writeJSON(w, http.StatusCreated, rule)
+			writeJSON(w, http.StatusCreated, withReload(rule, reloadGateway(r.Context(), gw)))
 		default:
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 		}
@@ -306,8 +361,7 @@ func main() {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			signalGateway()
-			writeJSON(w, http.StatusOK, map[string]string{"deleted": id})
+			writeJSON(w, http.StatusOK, withReload(map[string]string{"deleted": id}, reloadGateway(r.Context(), gw)))
 		default:
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 		}
@@ -327,16 +381,8 @@ func main() {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
 				return
 			}
-			if lim.AgentID == "" {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "agent_id is required"})
-				return
-			}
-			if lim.RPS <= 0 && lim.RPM <= 0 {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "at least one of rps or rpm must be > 0"})
-				return
-			}
-			if lim.Mode != "" && lim.Mode != "hard_stop" && lim.Mode != "alert_only" {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "mode must be 'hard_stop' or 'alert_only'"})
+			if err := lim.Validate(); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 				return
 			}
 			qlim.Set(lim)
@@ -344,8 +390,7 @@ func main() {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			signalGateway()
-			writeJSON(w, http.StatusCreated, lim)
+			writeJSON(w, http.StatusCreated, withReload(lim, reloadGateway(r.Context(), gw)))
 		default:
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 		}
@@ -354,7 +399,7 @@ func main() {
 	mux.HandleFunc("/v1/quotas/", func(w http.ResponseWriter, r *http.Request) {
 		id := strings.TrimPrefix(r.URL.Path, "/v1/quotas/")
 		if id == "" {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "agent_id required in path"})
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "agent_id or team:<team_id> required in path"})
 			return
 		}
 		switch r.Method {
@@ -374,8 +419,7 @@ func main() {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
 			}
-			signalGateway()
-			writeJSON(w, http.StatusOK, map[string]string{"deleted": id})
+			writeJSON(w, http.StatusOK, withReload(map[string]string{"deleted": id}, reloadGateway(r.Context(), gw)))
 		default:
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 		}
@@ -424,11 +468,7 @@ func main() {
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 			return
 		}
-		secret := os.Getenv("CLAWGRESS_POLICY_SIGN_SECRET")
-		if secret == "" {
-			secret = "clawgress-default-sign-key"
-		}
-		bundle := policy.SignBundle(eng.Rules(), []byte(secret))
+		bundle := policy.SignBundle(eng.Rules(), []byte(signSecret))
 		writeJSON(w, http.StatusOK, bundle)
 	})
 
@@ -443,11 +483,7 @@ func main() {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
 			return
 		}
-		secret := os.Getenv("CLAWGRESS_POLICY_SIGN_SECRET")
-		if secret == "" {
-			secret = "clawgress-default-sign-key"
-		}
-		if err := policy.VerifyBundle(bundle, []byte(secret)); err != nil {
+		if err := policy.VerifyBundle(bundle, []byte(signSecret)); err != nil {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error(), "valid": "false"})
 			return
 		}
@@ -501,9 +537,6 @@ func main() {
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 			return
 		}
-		rpzPath := getenv("CLAWGRESS_RPZ_ZONE_PATH", "/etc/bind/db.rpz.clawgress")
-		rpzZone := getenv("CLAWGRESS_RPZ_ZONE_NAME", "rpz.clawgress.local")
-
 		result, err := cladns.WriteRPZFile(rpzPath, eng.Rules(), cladns.RPZConfig{
 			ZoneName: rpzZone,
 		})
@@ -526,7 +559,6 @@ func main() {
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 			return
 		}
-		rpzZone := getenv("CLAWGRESS_RPZ_ZONE_NAME", "rpz.clawgress.local")
 		content := cladns.GenerateRPZ(eng.Rules(), cladns.RPZConfig{ZoneName: rpzZone})
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write([]byte(content))
@@ -538,8 +570,6 @@ func main() {
 			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 			return
 		}
-		rpzZone := getenv("CLAWGRESS_RPZ_ZONE_NAME", "rpz.clawgress.local")
-		rpzPath := getenv("CLAWGRESS_RPZ_ZONE_PATH", "/etc/bind/db.rpz.clawgress")
 		content := cladns.GenerateNamedConf(rpzZone, rpzPath)
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write([]byte(content))
@@ -552,12 +582,13 @@ func main() {
 			return
 		}
 		writeJSON(w, http.StatusOK, map[string]any{
-			"valid":      true,
-			"agents":     len(reg.All()),
-			"policies":   len(eng.Rules()),
-			"quotas":     len(qlim.All()),
-			"state_dir":  stateDir,
-			"audit_file": auditFile,
+			"valid":       true,
+			"agents":      len(reg.All()),
+			"policies":    len(eng.Rules()),
+			"quotas":      len(qlim.All()),
+			"state_dir":   stateDir,
+			"audit_file":  auditFile,
+			"config_file": *configPath,
 		})
 	})
 
@@ -576,38 +607,115 @@ func main() {
 
 	log.Printf("clawgress-admin-api listening on %s (state=%s agents=%s policy=%s quotas=%s audit=%s)",
 		listenAddr, stateDir, agentsFile, policyFile, quotaFile, auditFile)
-	if err := http.ListenAndServe(listenAddr, mux); err != nil {
+	srv := &http.Server{Addr: listenAddr, Handler: mux}
+	if cfg.TLS.Cert == "" {
+		err = srv.ListenAndServe()
+	} else {
+		if srv.TLSConfig, err = serverTLS(cfg.TLS); err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+		log.Printf("clawgress-admin-api serving HTTPS (client certificates required: %t)", cfg.TLS.ClientCA != "")
+		err = srv.ListenAndServeTLS(cfg.TLS.Cert, cfg.TLS.Key)
+	}
+	if err != nil {
 		log.Fatalf("http server failed: %v", err)
 	}
 }
 
-// signalGateway sends SIGHUP to the gateway process so it reloads identity and policy.
-func signalGateway() {
-	out, err := exec.Command("pidof", "clawgress-gateway").Output()
+// serverTLS builds the listener's TLS config. With a client CA, every client
+// must present a certificate it signed (mTLS).
+func serverTLS(c config.TLSConfig) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.ClientCA == "" {
+		return tc, nil
+	}
+	pem, err := os.ReadFile(c.ClientCA)
 	if err != nil {
-		log.Printf("signalGateway: gateway not running (pidof: %v)", err)
-		return
+		return nil, err
 	}
-	pidStr := strings.TrimSpace(string(out))
-	if pidStr == "" {
-		return
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", c.ClientCA)
 	}
-	// pidof may return multiple PIDs; signal all of them.
-	for _, s := range strings.Fields(pidStr) {
-		pid, err := strconv.Atoi(s)
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
+	return tc, nil
+}
+
+// reloadReport is the "gateway_reload" field of CRUD responses: whether
+// the gateway loaded the change, and its per-component result if it answered.
+type reloadReport struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	*control.ReloadResult
+}
+
+// reloadGateway asks the gateway to reload over its control socket. The
+// change is already saved, so a gateway that is down or fails to reload
+// picks it up on its next start or reload; the report says which.
+func reloadGateway(ctx context.Context, gw *control.Client) reloadReport {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	res, err := gw.Reload(ctx)
+	if err != nil {
+		log.Printf("reload gateway: %v", err)
+		return reloadReport{Error: err.Error()}
+	}
+	rep := reloadReport{OK: true, ReloadResult: &res}
+	if err := res.Err(); err != nil {
+		log.Printf("reload gateway: %v", err)
+		rep.OK, rep.Error = false, err.Error()
+	}
+	return rep
+}
+
+// serveAgentFlows lists (GET) or kills (DELETE) the agent's open flows on
+// the gateway. JWT-authenticated agents need not be in the registry, so the
+// agent is not looked up.
+func serveAgentFlows(w http.ResponseWriter, r *http.Request, gw *control.Client, agentID string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		all, err := gw.Flows(ctx)
 		if err != nil {
-			continue
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
 		}
-		if p, err := os.FindProcess(pid); err == nil {
-			if err := p.Signal(syscall.SIGHUP); err != nil {
-				log.Printf("signalGateway: SIGHUP pid %d: %v", pid, err)
-			} else {
-				log.Printf("signalGateway: sent SIGHUP to gateway pid %d", pid)
+		flows := []flow.Flow{}
+		for _, f := range all {
+			if f.AgentID == agentID {
+				flows = append(flows, f)
 			}
 		}
+		writeJSON(w, http.StatusOK, flows)
+	case http.MethodDelete:
+		res, err := gw.Kill(ctx, agentID)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("killed %d flows of agent=%s", len(res.Killed), agentID)
+		writeJSON(w, http.StatusOK, res)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 	}
 }
 
+// withReload adds rep to v's JSON object as "gateway_reload".
+func withReload(v any, rep reloadReport) any {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return v
+	}
+	m["gateway_reload"] = rep
+	return m
+}
+
 func writeJSON(w http.ResponseWriter, status int, payload any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -622,15 +730,3 @@ func getenv(key, fallback string) string {
 	}
 	return fallback
 }
-
-func getenvBool(key string, fallback bool) bool {
-	v := os.Getenv(key)
-	if v == "" {
-		return fallback
-	}
-	b, err := strconv.ParseBool(v)
-	if err != nil {
-		return fallback
-	}
-	return b
-}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	cgmetrics "github.com/bufordtjustice2918/crispy-garbanzo/internal/metrics"
+)
+
+// Audit sink failure modes (gateway.audit_failure).
+const (
+	auditFailureAlert  = "alert_only"  // log and count failed writes, keep forwarding
+	auditFailureClosed = "fail_closed" // refuse allowed traffic until the sink recovers
+)
+
+// auditPolicyID is the audit policy_id of traffic refused because the audit
+// sink is failing.
+const auditPolicyID = "audit-unavailable"
+
+// checkAuditSink refuses allowed traffic while the last audit write failed
+// and gateway.audit_failure is fail_closed, auditing the refusal. Writing
+// that event also retries the sink, so traffic resumes once it recovers.
+// It reports whether the request may proceed.
+func (h *proxyHandler) checkAuditSink(ag *identity.Agent, client peer, dest, method, reqID string, start time.Time) bool {
+	if !h.settings().auditFailClosed || h.alog.Err() == nil {
+		return true
+	}
+	h.writeAudit(audit.Event{
+		RequestID:       reqID,
+		AgentID:         ag.AgentID,
+		TeamID:          ag.TeamID,
+		ProjectID:       ag.ProjectID,
+		Environment:     ag.Environment,
+		Destination:     dest,
+		Method:          method,
+		Decision:        "deny",
+		PolicyID:        auditPolicyID,
+		LatencyMs:       time.Since(start).Milliseconds(),
+		ClientIP:        client.ip,
+		CertFingerprint: client.cert,
+	})
+	return false
+}
+
+// denyAuditUnavailable answers a request checkAuditSink refused.
+func (h *proxyHandler) denyAuditUnavailable(w http.ResponseWriter, r *http.Request, reqID string) {
+	h.deny(w, r, http.StatusServiceUnavailable, denyPage{
+		RequestID: reqID, PolicyID: auditPolicyID,
+		Reason: reasonAudit, Message: "audit log unavailable",
+		RetryAfter: retrySeconds(audit.ReopenInterval),
+	})
+}
+
+// noteAuditWrite records the outcome of an audit write, logging when the
+// sink starts failing and when it recovers rather than once per event.
+func (h *proxyHandler) noteAuditWrite(err error) {
+	if err == nil {
+		if h.auditFailing.Swap(false) {
+			cgmetrics.AuditSinkUp.Set(1)
+			log.Printf("audit sink recovered")
+		}
+		return
+	}
+	cgmetrics.AuditWriteErrors.Inc()
+	if !h.auditFailing.Swap(true) {
+		cgmetrics.AuditSinkUp.Set(0)
+		effect := "traffic continues unaudited"
+		if h.settings().auditFailClosed {
+			effect = "refusing allowed traffic"
+		}
+		log.Printf("audit sink failing: %v; %s until it recovers", err, effect)
+	}
+}
+
+// healthStatus is the body of GET /healthz on the metrics listener.
+type healthStatus struct {
+	Status       string `json:"status"`     // ok | degraded | unavailable
+	AuditSink    string `json:"audit_sink"` // ok | failing, as of the last write
+	AuditError   string `json:"audit_error,omitempty"`
+	AuditFailure string `json:"audit_failure"` // alert_only | fail_closed
+}
+
+// serveHealth reports gateway health: 503 while allowed traffic is being
+// refused, 200 otherwise. A failing sink under alert_only is "degraded".
+func (h *proxyHandler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	hs := healthStatus{Status: "ok", AuditSink: "ok", AuditFailure: auditFailureAlert}
+	failClosed := h.settings().auditFailClosed
+	if failClosed {
+		hs.AuditFailure = auditFailureClosed
+	}
+	code := http.StatusOK
+	if err := h.alog.Err(); err != nil {
+		hs.AuditSink, hs.AuditError, hs.Status = "failing", err.Error(), "degraded"
+		if failClosed {
+			hs.Status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(hs)
+}
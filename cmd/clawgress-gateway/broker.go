@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+)
+
+// credentialPolicyID is the audit policy_id of a request refused because a
+// credential its rule brokers is missing from the secret store.
+const credentialPolicyID = "credential-unavailable"
+
+// brokerCredentials applies the matched rule's header rewrites to hdr, the
+// headers about to be forwarded, swapping the agent's placeholders for real
+// credentials. If a secret is missing the request is denied with a 502 and
+// false is returned. ev is the request's audit event; secret values never
+// reach it, the log or metrics.
+func (h *proxyHandler) brokerCredentials(w http.ResponseWriter, r *http.Request,
+	hdr http.Header, dec policy.Decision, ev audit.Event, start time.Time) bool {
+
+	if len(dec.Headers) == 0 {
+		return true
+	}
+	err := h.secrets.Apply(hdr, dec.Headers)
+	if err == nil {
+		return true
+	}
+	log.Printf("agent=%s policy=%s: broker credentials: %v", ev.AgentID, dec.PolicyID, err)
+	ev.Decision, ev.PolicyID = "deny", credentialPolicyID
+	ev.LatencyMs = time.Since(start).Milliseconds()
+	h.writeAudit(ev)
+	h.deny(w, r, http.StatusBadGateway, denyPage{
+		RequestID: ev.RequestID, PolicyID: credentialPolicyID,
+		Reason: reasonCredential, Message: "upstream credential unavailable",
+	})
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/config"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/control"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/security"
+)
+
+// gatewayControl serves the control socket and SIGHUP: it reloads the
+// gateway's state, reports status and starts drains.
+type gatewayControl struct {
+	h          *proxyHandler
+	configPath string
+	started    config.Config // the config the process began with
+	crl        *security.CRL // nil without gateway.tls.crl
+	startTime  time.Time
+
+	mu         sync.Mutex // serializes reloads
+	current    config.Config
+	lastReload time.Time
+	lastErr    error
+
+	// drainReq hands a drain timeout to the shutdown goroutine in main.
+	drainReq chan time.Duration
+	draining atomic.Bool
+}
+
+func newGatewayControl(h *proxyHandler, configPath string, cfg config.Config, crl *security.CRL) *gatewayControl {
+	return &gatewayControl{
+		h: h, configPath: configPath, started: cfg, current: cfg, crl: crl,
+		startTime: time.Now(),
+		drainReq:  make(chan time.Duration, 1),
+	}
+}
+
+// Reload re-reads the config, reopens the audit log and reloads identity,
+// policy, quotas, secrets and the CRL. A component that fails to load keeps
+// its previous state; the failure is logged and reported. Open flows that
+// the resulting identity and policy no longer permit are then closed.
+func (c *gatewayControl) Reload() control.ReloadResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var res control.ReloadResult
+	step := func(name string, err error) {
+		comp := control.Component{Name: name}
+		if err != nil {
+			log.Printf("reload %s: %v; keeping current state", name, err)
+			comp.Error = err.Error()
+		}
+		res.Components = append(res.Components, comp)
+	}
+	cfg, restart, err := c.h.reloadConfig(c.configPath, c.started, c.current)
+	c.current, res.RestartRequired = cfg, restart
+	step("config", err)
+	step("audit", c.h.alog.Reopen())
+	step("identity", c.h.reg.Load())
+	step("policy", c.h.eng.Load())
+	step("quotas", c.h.lim.Load())
+	step("secrets", c.h.secrets.Load())
+	if c.crl != nil {
+		step("crl", c.crl.Load())
+		warnStaleCRL(c.crl)
+	}
+	res.Revoked = c.h.revokeFlows()
+	c.lastReload, c.lastErr = time.Now(), res.Err()
+	return res
+}
+
+// Status reports the gateway's state.
+func (c *gatewayControl) Status() control.Status {
+	st := control.Status{
+		PID:       os.Getpid(),
+		Started:   c.startTime,
+		Flows:     c.h.flows.Len(),
+		Draining:  c.draining.Load(),
+		AuditSink: "ok",
+		Agents:    len(c.h.reg.All()),
+		Rules:     len(c.h.eng.Rules()),
+		Quotas:    len(c.h.lim.All()),
+	}
+	if c.h.alog.Err() != nil {
+		st.AuditSink = "failing"
+	}
+	c.mu.Lock()
+	if !c.lastReload.IsZero() {
+		t := c.lastReload
+		st.LastReload = &t
+		if c.lastErr != nil {
+			st.LastReloadError = c.lastErr.Error()
+		}
+	}
+	c.mu.Unlock()
+	return st
+}
+
+// Flows lists the open tunnels and hijacked connections.
+func (c *gatewayControl) Flows() []flow.Flow { return c.h.flows.All() }
+
+// Kill closes every open flow of agentID.
+func (c *gatewayControl) Kill(agentID string) control.KillResult {
+	killed := c.h.killFlows(agentID)
+	if killed == nil {
+		killed = []flow.Flow{}
+	}
+	return control.KillResult{Killed: killed}
+}
+
+// Drain asks main to shut down as on SIGTERM, with the given drain timeout
+// (0 = timeouts.drain_s).
+func (c *gatewayControl) Drain(timeout time.Duration) (control.DrainResult, error) {
+	if !c.draining.CompareAndSwap(false, true) {
+		return control.DrainResult{}, control.ErrDraining
+	}
+	if timeout == 0 {
+		timeout = c.h.settings().drainTimeout
+	}
+	c.drainReq <- timeout
+	return control.DrainResult{Flows: c.h.flows.Len(), Timeout: timeout.String()}, nil
+}
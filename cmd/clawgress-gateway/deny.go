@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/config"
+)
+
+// Response headers identifying the request and the deciding policy. They are
+// set on every response the gateway writes or relays, including the CONNECT
+// 200 and 101 Switching Protocols.
+const (
+	headerRequestID = "X-Clawgress-Request-Id"
+	headerPolicy    = "X-Clawgress-Policy"
+)
+
+// Machine-readable deny reasons, the "reason" of a JSON deny body.
+const (
+	reasonNoIdentity  = "no_identity"
+	reasonQuota       = "quota_exceeded"
+	reasonPolicy      = "policy_denied"
+	reasonDestination = "destination_denied" // SSRF guard
+	reasonUpstream    = "upstream_unreachable"
+	reasonCredential  = "credential_unavailable" // brokered secret missing
+	reasonAudit       = "audit_unavailable"      // audit sink failing, gateway.audit_failure fail_closed
+
+	reasonRequestTooLarge  = "request_too_large"
+	reasonResponseTooLarge = "response_too_large"
+	reasonContentType      = "content_type_denied"
+)
+
+// denyPage describes a refused request. It is the JSON deny body and the
+// data passed to deny templates.
+type denyPage struct {
+	Status     int    `json:"-"`
+	StatusText string `json:"-"`
+	RequestID  string `json:"request_id"`
+	PolicyID   string `json:"policy_id,omitempty"`
+	Reason     string `json:"reason"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds; quota denials only
+}
+
+var (
+	defaultDenyText = texttemplate.Must(texttemplate.New("deny").Parse(
+		"{{.Status}} {{.StatusText}} — {{.Message}}\n"))
+	defaultDenyHTML = htmltemplate.Must(htmltemplate.New("deny").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p>Request ID: <code>{{.RequestID}}</code>{{if .PolicyID}}, policy <code>{{.PolicyID}}</code>{{end}}</p>
+</body></html>
+`))
+)
+
+// denyTemplates are the operator's deny page templates. Nil fields use the
+// built-in pages.
+type denyTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// loadDenyTemplates parses the templates named in c.
+func loadDenyTemplates(c config.DenyTemplatesConfig) (denyTemplates, error) {
+	var t denyTemplates
+	if c.Text != "" {
+		b, err := os.ReadFile(c.Text)
+		if err != nil {
+			return t, err
+		}
+		if t.text, err = texttemplate.New("deny").Parse(string(b)); err != nil {
+			return t, fmt.Errorf("%s: %w", c.Text, err)
+		}
+	}
+	if c.HTML != "" {
+		b, err := os.ReadFile(c.HTML)
+		if err != nil {
+			return t, err
+		}
+		if t.html, err = htmltemplate.New("deny").Parse(string(b)); err != nil {
+			return t, fmt.Errorf("%s: %w", c.HTML, err)
+		}
+	}
+	return t, nil
+}
+
+// deny writes a refusal in the form the client asked for: JSON when it
+// accepts application/json, the HTML page for browsers, text otherwise.
+func (h *proxyHandler) deny(w http.ResponseWriter, r *http.Request, status int, page denyPage) {
+	page.Status, page.StatusText = status, http.StatusText(status)
+	hdr := w.Header()
+	setClawgressHeaders(hdr, page.RequestID, page.PolicyID)
+	if page.RetryAfter > 0 {
+		hdr.Set("Retry-After", strconv.Itoa(page.RetryAfter))
+	}
+
+	tmpl := h.settings().deny
+	var body bytes.Buffer
+	var err error
+	contentType := "text/plain; charset=utf-8"
+	switch acceptedFormat(r.Header.Get("Accept")) {
+	case "json":
+		contentType = "application/json"
+		err = json.NewEncoder(&body).Encode(page)
+	case "html":
+		contentType = "text/html; charset=utf-8"
+		if tmpl.html != nil {
+			err = tmpl.html.Execute(&body, page)
+		} else {
+			err = defaultDenyHTML.Execute(&body, page)
+		}
+	default:
+		if tmpl.text != nil {
+			err = tmpl.text.Execute(&body, page)
+		} else {
+			err = defaultDenyText.Execute(&body, page)
+		}
+	}
+	if err != nil {
+		log.Printf("deny template: %v", err)
+		body.Reset()
+		contentType = "text/plain; charset=utf-8"
+		defaultDenyText.Execute(&body, page)
+	}
+
+	hdr.Del("Content-Length")
+	hdr.Set("Content-Type", contentType)
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// acceptedFormat picks "json", "html" or "text" from an Accept header by
+// quality value; on a tie the earlier media range wins. Wildcards are
+// ignored, so a client that accepts anything gets text.
+func acceptedFormat(accept string) string {
+	best, bestQ := "text", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		var format string
+		switch {
+		case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+			format = "json"
+		case mt == "text/html":
+			format = "html"
+		case mt == "text/plain":
+			format = "text"
+		default:
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// setClawgressHeaders sets the request and policy headers on hdr, replacing
+// any an upstream sent.
+func setClawgressHeaders(hdr http.Header, reqID, policyID string) {
+	hdr.Set(headerRequestID, reqID)
+	if policyID != "" {
+		hdr.Set(headerPolicy, policyID)
+	} else {
+		hdr.Del(headerPolicy)
+	}
+}
+
+// isClawgressHeader reports whether an upstream response header would spoof
+// one the gateway sets.
+func isClawgressHeader(key string) bool {
+	return strings.HasPrefix(http.CanonicalHeaderKey(key), "X-Clawgress-")
+}
+
+// retrySeconds rounds a quota wait up to the whole seconds Retry-After takes.
+func retrySeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
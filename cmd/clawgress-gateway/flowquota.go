@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	cgmetrics "github.com/bufordtjustice2918/crispy-garbanzo/internal/metrics"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/quota"
+)
+
+// acquireFlow takes a slot for a new request or tunnel under the agent's and
+// its team's max_concurrent, tracking it in the concurrency gauge. An
+// allowed flow must call release when it ends; release is idempotent.
+func (h *proxyHandler) acquireFlow(ag *identity.Agent) (quota.Decision, func()) {
+	d, release := h.lim.Acquire(ag.AgentID, ag.TeamID)
+	if !d.Allowed {
+		return d, release
+	}
+	gauge := cgmetrics.ConcurrentFlows.WithLabelValues(ag.AgentID)
+	gauge.Inc()
+	return d, sync.OnceFunc(func() {
+		release()
+		gauge.Dec()
+	})
+}
+
+// flowMeters returns the outbound and inbound meters for one of ag's flows.
+// Both directions share one shaper, so the agent's and team's bytes_per_sec
+// limit the two combined. Shaping waits end when ctx, the flow's lifetime,
+// does.
+func (h *proxyHandler) flowMeters(ctx context.Context, ag *identity.Agent) (out, in *byteMeter) {
+	shape := h.lim.Shaper(ag.AgentID, ag.TeamID)
+	delay := cgmetrics.ShapingDelay.WithLabelValues(ag.AgentID)
+	out = newByteMeter(cgmetrics.BytesOut.WithLabelValues(ag.AgentID))
+	in = newByteMeter(cgmetrics.BytesIn.WithLabelValues(ag.AgentID))
+	out.ctx, out.shape, out.delay = ctx, shape, delay
+	in.ctx, in.shape, in.delay = ctx, shape, delay
+	return out, in
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP/2 from agents: the proxy listeners speak h2 (ALPN on the TLS
+// listener, prior-knowledge h2c on the plaintext one) next to HTTP/1.1.
+// Every stream is its own request to ServeHTTP, so a connection
+// multiplexing many CONNECTs gets a policy decision, quota check and audit
+// record per stream. A CONNECT stream cannot be hijacked; it is answered
+// with 200 and carried as a streamConn instead.
+
+// connTLSKey carries the *tls.Conn of a TLS-listener connection. The HTTP/2
+// server only fills in Request.TLS for :scheme https, so a CONNECT stream
+// would otherwise lose its client certificate.
+type connTLSKey struct{}
+
+// withConnTLS is the proxy server's ConnContext.
+func withConnTLS(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		return context.WithValue(ctx, connTLSKey{}, tc)
+	}
+	return ctx
+}
+
+// requestTLS returns the TLS state of the connection r arrived on, or nil.
+func requestTLS(r *http.Request) *tls.ConnectionState {
+	if r.TLS != nil {
+		return r.TLS
+	}
+	if tc, ok := r.Context().Value(connTLSKey{}).(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		return &cs
+	}
+	return nil
+}
+
+// extendedConnectEnabled reports whether the HTTP/2 server advertises
+// extended CONNECT. net/http enables it only when GODEBUG, as read from the
+// environment at startup, holds http2xconnect=1; it is not a //go:debug
+// setting.
+func extendedConnectEnabled() bool {
+	return strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1")
+}
+
+// tunnelBodyKey carries the stream of an extended CONNECT, whose request
+// body is the tunnel rather than something to forward; see normalizeH2.
+type tunnelBodyKey struct{}
+
+// normalizeH2 turns an HTTP/2 request into the form the HTTP/1.1 paths
+// expect. A plain request gets an absolute URL: https if it arrived with
+// :scheme https on the TLS listener, http otherwise. An extended CONNECT
+// (RFC 8441, e.g. :protocol websocket) becomes the equivalent HTTP/1.1
+// Upgrade GET, so policy sees the same method, path and upgrade as for an
+// HTTP/1.1 client; its stream is kept for the tunnel. Extended CONNECT is
+// only offered to clients if extendedConnectEnabled.
+func normalizeH2(r *http.Request) *http.Request {
+	if r.ProtoMajor != 2 {
+		return r
+	}
+	proto := r.Header.Get(":protocol")
+	if r.Method == http.MethodConnect && proto == "" {
+		return r
+	}
+	r.URL.Scheme, r.URL.Host = "http", r.Host
+	if r.TLS != nil {
+		r.URL.Scheme = "https"
+	}
+	if proto == "" {
+		return r
+	}
+	r.Header.Del(":protocol")
+	r.Method = http.MethodGet
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", proto)
+	if strings.EqualFold(proto, "websocket") && r.Header.Get("Sec-WebSocket-Key") == "" {
+		key := make([]byte, 16)
+		rand.Read(key)
+		r.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	}
+	body := r.Body
+	r = r.WithContext(context.WithValue(r.Context(), tunnelBodyKey{}, body))
+	r.Body, r.ContentLength = http.NoBody, 0
+	return r
+}
+
+// tunnelConn answers a CONNECT the gateway accepted and returns the agent's
+// end of the tunnel. An HTTP/1.1 conn is hijacked and gets "200 Connection
+// Established"; an HTTP/2 stream gets a 200 response and is wrapped. The
+// headers already set on w are sent either way.
+func tunnelConn(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.ProtoMajor == 2 {
+		return openStream(w, r)
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "500 Internal Server Error — hijack unsupported", http.StatusInternalServerError)
+		return nil, errors.New("hijack unsupported")
+	}
+	c, _, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEstablished(c, w.Header()); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// openStream answers an HTTP/2 CONNECT (or extended CONNECT) stream with 200
+// and returns it as a conn. The server's per-stream read and write timeouts
+// are lifted: like hijacked tunnels, streams are bounded by the tunnel idle
+// and lifetime limits instead.
+func openStream(w http.ResponseWriter, r *http.Request) (*streamConn, error) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+	body, ok := r.Context().Value(tunnelBodyKey{}).(io.ReadCloser)
+	if !ok {
+		body = r.Body
+	}
+	c := &streamConn{
+		body: body, w: w, rc: rc, peer: requestPeer(r),
+		local: &net.TCPAddr{}, remote: &net.TCPAddr{},
+	}
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = la
+	}
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		c.remote = net.TCPAddrFromAddrPort(ap)
+	}
+	return c, nil
+}
+
+// streamConn is an HTTP/2 stream seen as a conn: reads come from the
+// request body, writes go to the response and are flushed at once. It must
+// be closed before the handler returns.
+type streamConn struct {
+	body          io.ReadCloser
+	w             http.ResponseWriter
+	rc            *http.ResponseController
+	peer          peer
+	local, remote net.Addr
+
+	mu      sync.Mutex
+	closed  bool
+	writing bool // a Write may be blocked on flow control
+}
+
+func (c *streamConn) Read(p []byte) (int, error) { return c.body.Read(p) }
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.writing = true
+	c.mu.Unlock()
+
+	n, err := c.w.Write(p)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+
+	c.mu.Lock()
+	c.writing = false
+	c.mu.Unlock()
+	return n, err
+}
+
+// Close ends reads and, if a Write is stuck because the agent stopped
+// reading, resets the stream to release it. The stream itself ends cleanly
+// when the handler returns.
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.writing {
+		c.rc.SetWriteDeadline(time.Now())
+	}
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error { return c.rc.SetReadDeadline(t) }
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.rc.SetWriteDeadline(t)
+}
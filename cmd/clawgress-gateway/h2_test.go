@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+)
+
+// wsEcho answers WebSocket upgrades with 101 and echoes the raw stream.
+func wsEcho(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(c, brw)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestH2ExtendedConnect(t *testing.T) {
+	if !extendedConnectEnabled() {
+		// net/http reads the setting once at startup, so run this test in
+		// a child process that has it.
+		if testing.Short() {
+			t.Skip("needs a child process")
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestH2ExtendedConnect$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("child: %v\n%s", err, out)
+		}
+		return
+	}
+
+	upstream := wsEcho(t)
+	dest := upstream.Listener.Addr().String()
+	h, auditPath := newTestHandler(t, []policy.Rule{
+		{PolicyID: "deny-blocked", Domains: []string{"127.0.0.1"}, PathPrefixes: []string{"/blocked"}, Action: "deny"},
+		{PolicyID: "allow-local", Domains: []string{"127.0.0.1"}, Action: "allow"},
+	}, nil)
+	px := httptest.NewUnstartedServer(h)
+	px.Config.ConnContext = withConnTLS
+	px.Config.Protocols = new(http.Protocols)
+	px.Config.Protocols.SetHTTP1(true)
+	px.Config.Protocols.SetUnencryptedHTTP2(true)
+	px.Start()
+	defer px.Close()
+
+	// net/http's client refuses to send :protocol, so speak h2c by hand.
+	c, err := net.Dial("tcp", px.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	io.WriteString(c, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	writeFrame(c, frameSettings, 0, 0, nil)
+	for {
+		typ, flags, _, payload := readFrame(t, br)
+		if typ != frameSettings || flags&flagAck != 0 {
+			continue
+		}
+		if !settingEnabled(payload, settingEnableConnectProtocol) {
+			t.Fatal("server does not offer extended CONNECT")
+		}
+		writeFrame(c, frameSettings, flagAck, 0, nil)
+		break
+	}
+	open := func(stream uint32, path string) {
+		var block []byte
+		for _, f := range [][2]string{
+			{":method", "CONNECT"}, {":protocol", "websocket"}, {":scheme", "http"},
+			{":path", path}, {":authority", dest}, {"proxy-authorization", proxyAuth},
+		} {
+			block = hpackLiteral(block, f[0], f[1])
+		}
+		writeFrame(c, frameHeaders, flagEndHeaders, stream, block)
+	}
+	// status reads stream's response headers; a block starting with the
+	// static-table entry for ":status 200" is a 200.
+	status := func(stream uint32) bool {
+		for {
+			typ, _, id, payload := readFrame(t, br)
+			if typ == frameHeaders && id == stream {
+				return len(payload) > 0 && payload[0] == 0x88
+			}
+		}
+	}
+
+	// A denied path is refused by policy like an HTTP/1.1 upgrade.
+	open(1, "/blocked")
+	if status(1) {
+		t.Fatal("denied stream answered 200")
+	}
+
+	// An allowed one becomes a tunnel to the upstream WebSocket.
+	open(3, "/ws")
+	if !status(3) {
+		t.Fatal("allowed stream not answered 200")
+	}
+	writeFrame(c, frameData, 0, 3, []byte("ping"))
+	for {
+		typ, _, id, payload := readFrame(t, br)
+		if typ == frameData && id == 3 {
+			if string(payload) != "ping" {
+				t.Fatalf("echo through the stream: %q", payload)
+			}
+			break
+		}
+	}
+
+	// The path rule matched, so policy saw the stream as GET /blocked.
+	events := readAudit(t, auditPath)
+	if len(events) == 0 || events[0].PolicyID != "deny-blocked" || events[0].Decision != "deny" ||
+		events[0].Method != http.MethodGet || events[0].Destination != dest {
+		t.Fatalf("want a GET deny event for the denied stream, got %+v", events)
+	}
+}
+
+// HTTP/2 frame types, flags and settings used by TestH2ExtendedConnect.
+const (
+	frameData     = 0x0
+	frameHeaders  = 0x1
+	frameSettings = 0x4
+
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+
+	settingEnableConnectProtocol = 0x8 // RFC 8441
+)
+
+func writeFrame(w io.Writer, typ, flags byte, stream uint32, payload []byte) {
+	hdr := make([]byte, 9, 9+len(payload))
+	hdr[0], hdr[1], hdr[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	hdr[3], hdr[4] = typ, flags
+	binary.BigEndian.PutUint32(hdr[5:], stream)
+	w.Write(append(hdr, payload...))
+}
+
+func readFrame(t *testing.T, r *bufio.Reader) (typ, flags byte, stream uint32, payload []byte) {
+	t.Helper()
+	var hdr [9]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	payload = make([]byte, int(hdr[0])<<16|int(hdr[1])<<8|int(hdr[2]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return hdr[3], hdr[4], binary.BigEndian.Uint32(hdr[5:]) & 0x7fffffff, payload
+}
+
+// settingEnabled reports whether a SETTINGS payload sets id to 1.
+func settingEnabled(payload []byte, id uint16) bool {
+	for ; len(payload) >= 6; payload = payload[6:] {
+		if binary.BigEndian.Uint16(payload) == id {
+			return binary.BigEndian.Uint32(payload[2:]) == 1
+		}
+	}
+	return false
+}
+
+// hpackLiteral appends a literal header field without indexing (RFC 7541
+// 6.2.2). Names and values must be shorter than 127 bytes.
+func hpackLiteral(b []byte, name, value string) []byte {
+	b = append(b, 0x00, byte(len(name)))
+	b = append(b, name...)
+	b = append(b, byte(len(value)))
+	return append(b, value...)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/sniff"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/upstream"
+)
+
+// shouldInspect reports whether a CONNECT must be TLS-intercepted: inspection
+// is configured, the destination is not on the bypass list (pinned clients),
+// and a policy rule asks for inspection of this host.
+func (h *proxyHandler) shouldInspect(pctx policy.RequestContext) bool {
+	if h.ca == nil {
+		return false
+	}
+	if policy.MatchesDomain(pctx.Destination, h.settings().inspectBypass) {
+		return false
+	}
+	return h.eng.InspectRequired(pctx)
+}
+
+// handleInspect accepts an inspected CONNECT and hands the stream to inspectConn.
+func (h *proxyHandler) handleInspect(w http.ResponseWriter, r *http.Request,
+	ag *identity.Agent, reqID string, start time.Time) {
+
+	clientConn, err := tunnelConn(w, r)
+	if err != nil {
+		return
+	}
+	defer clientConn.Close()
+	fl := h.flows.Add(flow.Flow{
+		ID: reqID, AgentID: ag.AgentID, Destination: r.Host, Started: start,
+		Check: h.flowCheck(ag, nil),
+	}, clientConn)
+	defer fl.Done()
+
+	h.inspectConn(clientConn, fl, ag, r.Host, r.Method, reqID, start)
+}
+
+// inspectConn terminates the agent's TLS session with a leaf minted by the
+// local CA, then serves the inner HTTP/1.1 requests one by one. Each inner
+// request is policy-evaluated with its real method and path and re-originated
+// over TLS to authority (host:port). fl tracks the session.
+func (h *proxyHandler) inspectConn(clientConn net.Conn, fl *flow.Handle, ag *identity.Agent,
+	authority, method, reqID string, start time.Time) {
+
+	client := connPeer(clientConn)
+	tlsConn := tls.Server(clientConn, h.ca.ServerConfig(authority))
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		// Typically a client that pins its upstream certificate; operators
+		// should add the destination to the inspection bypass list.
+		log.Printf("inspect: TLS handshake with agent=%s for %s failed: %v", ag.AgentID, authority, err)
+		h.writeAudit(audit.Event{
+			RequestID: reqID, AgentID: ag.AgentID, TeamID: ag.TeamID,
+			ProjectID: ag.ProjectID, Environment: ag.Environment,
+			Destination: authority, Method: method,
+			Decision: "deny", PolicyID: "inspect-handshake-failed",
+			LatencyMs: time.Since(start).Milliseconds(),
+			Inspected: true, ClientIP: client.ip, CertFingerprint: client.cert,
+		})
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	inner := &http.Server{
+		Handler: http.HandlerFunc(func(iw http.ResponseWriter, ir *http.Request) {
+			h.serveInspected(iw, ir, ag, authority, client)
+		}),
+		ReadHeaderTimeout: 60 * time.Second,
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+	inner.Serve(newOneConnListener(tlsConn))
+	h.auditForcedClose(fl, audit.Event{
+		RequestID: reqID, AgentID: ag.AgentID, TeamID: ag.TeamID,
+		ProjectID: ag.ProjectID, Environment: ag.Environment,
+		Destination: authority, Method: method,
+		Inspected: true, ClientIP: client.ip, CertFingerprint: client.cert,
+	}, start)
+}
+
+// hostMismatchPolicyID marks inspected requests whose Host header names a
+// different host than the CONNECT they arrived in.
+const hostMismatchPolicyID = "inspect-host-mismatch"
+
+// hostOf returns the host of a host[:port] authority, lower-cased and without
+// brackets or a trailing dot.
+func hostOf(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		hostport = host
+	}
+	hostport = strings.Trim(hostport, "[]")
+	return strings.TrimSuffix(strings.ToLower(hostport), ".")
+}
+
+// serveInspected evaluates and forwards one decrypted request. client is the
+// end of the outer connection.
+func (h *proxyHandler) serveInspected(w http.ResponseWriter, r *http.Request,
+	ag *identity.Agent, authority string, client peer) {
+
+	start := time.Now()
+	reqID := newRequestID()
+
+	if r.Host != "" && hostOf(r.Host) != hostOf(authority) {
+		// Policy only saw the CONNECT authority; a different inner Host
+		// would front another site through the inspected session.
+		h.writeAudit(audit.Event{
+			RequestID: reqID, AgentID: ag.AgentID, TeamID: ag.TeamID,
+			ProjectID: ag.ProjectID, Environment: ag.Environment,
+			Destination: authority, Method: r.Method, Path: r.URL.Path,
+			Decision: "deny", PolicyID: hostMismatchPolicyID,
+			LatencyMs: time.Since(start).Milliseconds(),
+			Inspected: true, ClientIP: client.ip, CertFingerprint: client.cert,
+		})
+		h.deny(w, r, http.StatusForbidden, denyPage{
+			RequestID: reqID, PolicyID: hostMismatchPolicyID, Reason: reasonPolicy,
+			Message: "Host " + r.Host + " does not match the tunnel destination " + authority,
+		})
+		return
+	}
+
+	if qd := h.checkRate(ag, client, authority, r.Method, reqID, start); !qd.Allowed {
+		h.deny(w, r, http.StatusTooManyRequests, denyPage{
+			RequestID: reqID, PolicyID: "quota-exceeded",
+			Reason: reasonQuota, Message: qd.Reason,
+			RetryAfter: retrySeconds(qd.RetryAfter),
+		})
+		return
+	}
+
+	dec := h.eng.EvaluateRich(policy.RequestContext{
+		AgentID:     ag.AgentID,
+		Destination: authority,
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Environment: ag.Environment,
+		TeamID:      ag.TeamID,
+		ProjectID:   ag.ProjectID,
+		Protocol:    sniff.ProtoTLS,
+	})
+	ev := audit.Event{
+		RequestID: reqID, AgentID: ag.AgentID, TeamID: ag.TeamID,
+		ProjectID: ag.ProjectID, Environment: ag.Environment,
+		Destination: authority, Method: r.Method, Path: r.URL.Path,
+		PolicyID: dec.PolicyID, Inspected: true, ClientIP: client.ip, CertFingerprint: client.cert,
+	}
+	if dec.Action != "allow" {
+		ev.Decision = "deny"
+		ev.LatencyMs = time.Since(start).Milliseconds()
+		h.writeAudit(ev)
+		h.deny(w, r, http.StatusForbidden, denyPage{
+			RequestID: reqID, PolicyID: dec.PolicyID,
+			Reason: reasonPolicy, Message: dec.Reason,
+		})
+		return
+	}
+	if !h.checkAuditSink(ag, client, authority, r.Method, reqID, start) {
+		h.denyAuditUnavailable(w, r, reqID)
+		return
+	}
+	setClawgressHeaders(w.Header(), reqID, dec.PolicyID)
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.URL.Scheme = "https"
+	out.URL.Host = authority
+	out.Header.Del("Proxy-Authorization")
+	out.Header.Del("Proxy-Connection")
+	h.propagateTrace(out.Header, &ev)
+	if !h.brokerCredentials(w, r, out.Header, dec, ev, start) {
+		return
+	}
+	if limit := requestLimit(out, dec.Limits); limit != "" {
+		h.limitExceeded(w, r, ev, dec.Limits, limit, "", start)
+		return
+	}
+	sent, recv := h.flowMeters(r.Context(), ag)
+	body := capRequestBody(out, dec.Limits)
+	meterRequestBody(out, sent)
+
+	src := egressSource(ag, dec)
+	resp, how, err := h.router.RoundTrip(h.upstream.Transport(src), src, out, dec.Upstreams)
+	ev.Route, ev.ResolvedIP, ev.EgressIP = how.Route.String(), how.ResolvedIP, how.EgressIP
+	if body != nil && body.exceeded.Load() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		ev.BytesOut = sent.load()
+		h.limitExceeded(w, r, ev, dec.Limits, limitRequestBody, "", start)
+		return
+	}
+	if err != nil {
+		ev.LatencyMs = time.Since(start).Milliseconds()
+		if upstream.Denied(err) {
+			ev.Decision, ev.PolicyID = "deny", ssrfPolicyID
+			h.writeAudit(ev)
+			h.deny(w, r, http.StatusForbidden, denyPage{
+				RequestID: reqID, PolicyID: ssrfPolicyID,
+				Reason: reasonDestination, Message: "destination resolves to a denied address",
+			})
+			return
+		}
+		ev.Decision = "allow-upstream-error"
+		h.writeAudit(ev)
+		h.deny(w, r, http.StatusBadGateway, denyPage{
+			RequestID: reqID, PolicyID: dec.PolicyID,
+			Reason: reasonUpstream, Message: "upstream unreachable",
+		})
+		return
+	}
+	defer resp.Body.Close()
+	if limit := responseLimit(resp, dec.Limits); limit != "" {
+		ev.BytesOut = sent.load()
+		h.limitExceeded(w, r, ev, dec.Limits, limit, resp.Header.Get("Content-Type"), start)
+		return
+	}
+
+	copyResponseHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	exceeded := copyResponseBody(meteredWriter{w, recv}, resp.Body, dec.Limits)
+
+	ev.LatencyMs = time.Since(start).Milliseconds()
+	ev.BytesOut, ev.BytesIn = sent.load(), recv.load()
+	if exceeded {
+		h.abortResponse(ev)
+	}
+	ev.Decision = "allow"
+	h.writeAudit(ev)
+}
+
+// oneConnListener is a net.Listener that yields a single connection and then
+// blocks until that connection is closed, letting http.Server drive one
+// already-accepted conn with full keep-alive handling.
+type oneConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	served bool
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+func newOneConnListener(c net.Conn) *oneConnListener {
+	l := &oneConnListener{closed: make(chan struct{})}
+	l.conn = &notifyCloseConn{Conn: c, onClose: l.signal}
+	return l
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.served {
+		l.served = true
+		l.mu.Unlock()
+		return l.conn, nil
+	}
+	l.mu.Unlock()
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) Close() error {
+	l.signal()
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+func (l *oneConnListener) signal() { l.once.Do(func() { close(l.closed) }) }
+
+// notifyCloseConn invokes onClose after the wrapped conn is closed.
+type notifyCloseConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
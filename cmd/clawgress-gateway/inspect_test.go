@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/quota"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/tlsinspect"
+)
+
+// newInspectingHandler returns a handler that inspects CONNECTs to localhost
+// and the pool trusting its CA.
+func newInspectingHandler(t *testing.T, rules []policy.Rule, quotas []quota.Limit) (*proxyHandler, string, *x509.CertPool) {
+	t.Helper()
+	h, auditPath := newTestHandler(t, rules, quotas)
+	dir := t.TempDir()
+	ca, err := tlsinspect.LoadOrCreateCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ca = ca
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	return h, auditPath, roots
+}
+
+// inspectedSession opens an inspected tunnel to target and returns a
+// function sending GET / with the given Host over it.
+func inspectedSession(t *testing.T, proxyAddr, target string, roots *x509.CertPool) func(host string) *http.Response {
+	t.Helper()
+	c, _ := connectThrough(t, proxyAddr, target)
+	tc := tls.Client(c, &tls.Config{ServerName: "localhost", RootCAs: roots})
+	br := bufio.NewReader(tc)
+	return func(host string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "https://"+target+"/", nil)
+		req.Host = host
+		if err := req.Write(tc); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+}
+
+// inspectedGet sends GET / with the given Host inside a new inspected tunnel
+// to target.
+func inspectedGet(t *testing.T, proxyAddr, target, host string, roots *x509.CertPool) *http.Response {
+	t.Helper()
+	return inspectedSession(t, proxyAddr, target, roots)(host)
+}
+
+func TestInspectDeniesHostMismatch(t *testing.T) {
+	h, auditPath, roots := newInspectingHandler(t, []policy.Rule{
+		{PolicyID: "inspect-local", Domains: []string{"localhost"}, Action: "allow", Inspect: true},
+	}, nil)
+	px := httptest.NewServer(h)
+	defer px.Close()
+
+	// Port 1 is closed, so an allowed request ends as a 502.
+	resp := inspectedGet(t, px.Listener.Addr().String(), "localhost:1", "evil.example", roots)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("fronted Host: want 403, got %s", resp.Status)
+	}
+	if got := resp.Header.Get("X-Clawgress-Policy"); got != hostMismatchPolicyID {
+		t.Fatalf("fronted Host: policy %q", got)
+	}
+	for _, host := range []string{"localhost", "LOCALHOST:1", "localhost.:8443"} {
+		if resp := inspectedGet(t, px.Listener.Addr().String(), "localhost:1", host, roots); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("Host %s: want 502 from the closed port, got %s", host, resp.Status)
+		}
+	}
+
+	var mismatches int
+	for _, e := range readAudit(t, auditPath) {
+		if e.PolicyID == hostMismatchPolicyID {
+			mismatches++
+			if e.Decision != "deny" || e.Destination != "localhost:1" || !e.Inspected {
+				t.Fatalf("mismatch event: %+v", e)
+			}
+		}
+	}
+	if mismatches != 1 {
+		t.Fatalf("want 1 host mismatch event, got %d", mismatches)
+	}
+}
+
+func TestInspectHonorsConnectDeny(t *testing.T) {
+	h, auditPath, _ := newInspectingHandler(t, []policy.Rule{
+		{PolicyID: "no-tunnels", Domains: []string{"localhost"}, Methods: []string{"CONNECT"}, Action: "deny"},
+		{PolicyID: "inspect-local", Domains: []string{"localhost"}, Methods: []string{"GET"}, Action: "allow", Inspect: true},
+	}, nil)
+	px := httptest.NewServer(h)
+	defer px.Close()
+
+	c, err := net.Dial("tcp", px.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT localhost:1 HTTP/1.1\r\nHost: localhost:1\r\nProxy-Authorization: %s\r\n\r\n", proxyAuth)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-Clawgress-Policy") != "no-tunnels" {
+		t.Fatalf("CONNECT: %s policy %q", resp.Status, resp.Header.Get("X-Clawgress-Policy"))
+	}
+	events := readAudit(t, auditPath)
+	if len(events) != 1 || events[0].PolicyID != "no-tunnels" || events[0].Method != "CONNECT" {
+		t.Fatalf("audit: %+v", events)
+	}
+}
+
+func TestInspectChargesQuotaPerRequest(t *testing.T) {
+	// The CONNECT takes one of three requests a minute and the session's
+	// single concurrency slot; inner requests take only rate tokens.
+	h, auditPath, roots := newInspectingHandler(t, []policy.Rule{
+		{PolicyID: "inspect-local", Domains: []string{"localhost"}, Action: "allow", Inspect: true},
+	}, []quota.Limit{{AgentID: testAgent.AgentID, RPM: 3, MaxConcurrent: 1}})
+	px := httptest.NewServer(h)
+	defer px.Close()
+
+	get := inspectedSession(t, px.Listener.Addr().String(), "localhost:1", roots)
+	for i, want := range []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusTooManyRequests} {
+		if resp := get("localhost"); resp.StatusCode != want {
+			t.Fatalf("request %d: want %d, got %s", i+1, want, resp.Status)
+		}
+	}
+	var denied int
+	for _, e := range readAudit(t, auditPath) {
+		if e.PolicyID == "quota-exceeded" && e.Method == "GET" && e.Destination == "localhost:1" {
+			denied++
+		}
+	}
+	if denied != 1 {
+		t.Fatalf("want 1 quota denial for the inner request, got %d", denied)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+)
+
+// Body limits, the "limit" of a "limit-exceeded" audit event.
+const (
+	limitRequestBody  = "request_body"
+	limitResponseBody = "response_body"
+	limitContentType  = "content_type"
+)
+
+var errRequestTooLarge = errors.New("request body exceeds policy limit")
+
+// limitedBody fails a request body read once more than max bytes arrive, so
+// the upstream sees a truncated, failed request. It records that it fired:
+// the transport's error does not reliably carry errRequestTooLarge back.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  atomic.Bool // read by the handler while the transport may still be writing
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		b.exceeded.Store(true)
+		n, b.remaining = int(b.remaining), 0
+		return n, errRequestTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// capRequestBody caps r's body at l.MaxRequestBytes. It returns nil when
+// there is nothing to cap.
+func capRequestBody(r *http.Request, l policy.BodyLimits) *limitedBody {
+	if l.MaxRequestBytes <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	b := &limitedBody{ReadCloser: r.Body, remaining: l.MaxRequestBytes}
+	r.Body = b
+	return b
+}
+
+// requestLimit returns the limit a request breaks before any of it is sent:
+// a declared Content-Length over the cap.
+func requestLimit(r *http.Request, l policy.BodyLimits) string {
+	if l.MaxRequestBytes > 0 && r.ContentLength > l.MaxRequestBytes {
+		return limitRequestBody
+	}
+	return ""
+}
+
+// responseLimit returns the limit an upstream response breaks before its
+// body is relayed: a refused content type or a declared length over the cap.
+func responseLimit(resp *http.Response, l policy.BodyLimits) string {
+	if !l.ContentTypeAllowed(resp.Header.Get("Content-Type")) {
+		return limitContentType
+	}
+	if l.MaxResponseBytes > 0 && resp.ContentLength > l.MaxResponseBytes {
+		return limitResponseBody
+	}
+	return ""
+}
+
+// copyResponseBody relays body to w, at most l.MaxResponseBytes of it. It
+// reports whether the upstream had more to send.
+func copyResponseBody(w io.Writer, body io.Reader, l policy.BodyLimits) (exceeded bool) {
+	if l.MaxResponseBytes <= 0 {
+		io.Copy(w, body)
+		return false
+	}
+	if _, err := io.Copy(w, io.LimitReader(body, l.MaxResponseBytes)); err != nil {
+		return false
+	}
+	var probe [1]byte
+	_, err := io.ReadFull(body, probe[:])
+	return err == nil
+}
+
+// limitExceeded audits an exchange refused by a body limit of the matched
+// rule and answers it. A response limit found mid-body, after the status
+// was sent, must instead abort the connection; see abortResponse.
+func (h *proxyHandler) limitExceeded(w http.ResponseWriter, r *http.Request,
+	ev audit.Event, l policy.BodyLimits, limit, contentType string, start time.Time) {
+
+	ev.Decision, ev.Limit = "limit-exceeded", limit
+	if limit == limitContentType {
+		ev.ContentType = mediaType(contentType)
+	}
+	ev.LatencyMs = time.Since(start).Milliseconds()
+	h.writeAudit(ev)
+
+	page := denyPage{RequestID: ev.RequestID, PolicyID: ev.PolicyID}
+	status := http.StatusBadGateway
+	switch limit {
+	case limitRequestBody:
+		status = http.StatusRequestEntityTooLarge
+		page.Reason = reasonRequestTooLarge
+		page.Message = fmt.Sprintf("request body exceeds %d bytes", l.MaxRequestBytes)
+	case limitResponseBody:
+		page.Reason = reasonResponseTooLarge
+		page.Message = fmt.Sprintf("response body exceeds %d bytes", l.MaxResponseBytes)
+	case limitContentType:
+		status = http.StatusForbidden
+		page.Reason = reasonContentType
+		page.Message = "response content type " + ev.ContentType + " is not allowed"
+		if ev.ContentType == "" {
+			page.Message = "response has no allowed content type"
+		}
+	}
+	h.deny(w, r, status, page)
+}
+
+// abortResponse audits a response that outgrew its limit after the status
+// line was relayed, and aborts the connection so the client sees a truncated
+// body rather than a complete one.
+func (h *proxyHandler) abortResponse(ev audit.Event) {
+	ev.Decision, ev.Limit = "limit-exceeded", limitResponseBody
+	h.writeAudit(ev)
+	log.Printf("agent=%s %s: response body over limit of policy %s; aborted", ev.AgentID, ev.Destination, ev.PolicyID)
+	panic(http.ErrAbortHandler)
+}
+
+// mediaType returns the bare, lowercased media type of a Content-Type value.
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/quota"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/upstream"
+)
+
+// testAgent is the agent newTestHandler registers; proxyAuth authenticates as it.
+var testAgent = identity.Agent{AgentID: "agent-a", APIKey: "key-a", Status: "active"}
+
+const proxyAuth = "Basic YWdlbnQtYTprZXktYQ==" // agent-a:key-a
+
+// newTestHandler builds a gateway handler over temp-file registry, policy,
+// quota and audit stores. It returns the handler and the audit log path.
+func newTestHandler(t *testing.T, rules []policy.Rule, quotas []quota.Limit) (*proxyHandler, string) {
+	t.Helper()
+	dir := t.TempDir()
+	writeJSON(t, filepath.Join(dir, "agents.json"), []identity.Agent{testAgent})
+	writeJSON(t, filepath.Join(dir, "policy.json"), rules)
+	writeJSON(t, filepath.Join(dir, "quotas.json"), quotas)
+
+	reg, err := identity.NewRegistry(filepath.Join(dir, "agents.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng, err := policy.NewEngine(filepath.Join(dir, "policy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim, err := quota.NewLimiter(filepath.Join(dir, "quotas.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	alog, err := audit.NewLog(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { alog.Close() })
+
+	h := &proxyHandler{
+		reg: reg, eng: eng, lim: lim, alog: alog,
+		upstream: upstream.NewPool(upstream.Config{}),
+		router:   upstream.NewRouter(time.Second, nil),
+		flows:    flow.NewTracker(),
+	}
+	h.live.Store(&liveSettings{sniMismatch: sniMismatchDeny})
+	return h, auditPath
+}
+
+func writeJSON(t *testing.T, path string, v any) {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAudit returns the events written to the audit log so far.
+func readAudit(t *testing.T, path string) []audit.Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []audit.Event
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e audit.Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("audit line %q: %v", sc.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// waitAudit waits for the audit log to hold at least n events, for flows
+// whose event is written after the client sees them end.
+func waitAudit(t *testing.T, path string, n int) []audit.Event {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events := readAudit(t, path)
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// connectThrough opens a CONNECT tunnel to target through the proxy at
+// proxyAddr and fails the test unless it is established.
+func connectThrough(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: " + proxyAuth + "\r\n\r\n"
+	if _, err := c.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: %s", target, resp.Status)
+	}
+	return c, br
+}
+
+func TestPortRulesFollowScheme(t *testing.T) {
+	h, _ := newTestHandler(t, []policy.Rule{
+		{PolicyID: "tls-only", Domains: []string{"localhost"}, Ports: []string{"443"}, Action: "allow"},
+	}, nil)
+	px := httptest.NewServer(h)
+	defer px.Close()
+
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		// Nothing listens on localhost:443, so an allowed request is a 502.
+		{"https://localhost/", http.StatusBadGateway},
+		{"https://localhost:443/", http.StatusBadGateway},
+		{"http://localhost/", http.StatusForbidden},
+		{"https://localhost:8443/", http.StatusForbidden},
+	} {
+		c, err := net.Dial("tcp", px.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "GET %s HTTP/1.1\r\nHost: localhost\r\nProxy-Authorization: %s\r\n\r\n", tc.url, proxyAuth)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("GET %s: want %d, got %s", tc.url, tc.want, resp.Status)
+		}
+	}
+}
+
+func TestRequestAuthority(t *testing.T) {
+	for _, tc := range []struct{ method, url, host, want string }{
+		{"GET", "http://a.example/x", "", "a.example:80"},
+		{"GET", "https://a.example/x", "", "a.example:443"},
+		{"GET", "https://a.example:8443/x", "", "a.example:8443"},
+		{"GET", "https://[2001:db8::1]/", "", "[2001:db8::1]:443"},
+		{"CONNECT", "", "a.example:443", "a.example:443"},
+	} {
+		r := httptest.NewRequest(tc.method, "http://placeholder/", nil)
+		if tc.url != "" {
+			r.URL, _ = url.Parse(tc.url)
+			r.Host = r.URL.Host
+		} else {
+			r.Host = tc.host
+		}
+		if got := requestAuthority(r); got != tc.want {
+			t.Errorf("%s %s: got %s, want %s", tc.method, tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestDrainInterrupted(t *testing.T) {
+	h, _ := newTestHandler(t, []policy.Rule{
+		{PolicyID: "allow-local", Domains: []string{"127.0.0.1"}, Action: "allow"},
+	}, nil)
+	px := httptest.NewServer(h)
+	defer px.Close()
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			c, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	connectThrough(t, px.Listener.Addr().String(), dest.Addr().String())
+
+	// A second signal cancels the drain's context; the open tunnel is
+	// force-closed long before the drain timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	h.drain(ctx, px.Config, time.Minute)
+	if el := time.Since(start); el > 10*time.Second {
+		t.Fatalf("interrupted drain took %s", el)
+	}
+	if n := h.flows.Len(); n != 0 {
+		t.Fatalf("%d tunnels still open", n)
+	}
+}
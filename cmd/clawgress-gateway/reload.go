@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/config"
+)
+
+// liveSettings are the settings SIGHUP can change without a restart. The
+// handler reads them through settings() for each request or tunnel, so a
+// reload applies to new traffic only.
+type liveSettings struct {
+	jwtSecret        []byte
+	inspectBypass    []string
+	sniMismatch      string        // sniMismatchDeny | sniMismatchAudit | sniMismatchOff
+	auditFailClosed  bool          // refuse allowed traffic while the audit sink fails
+	requestIDHeader  string        // forwards the request ID upstream; "" = off
+	progressInterval time.Duration // 0 = no interim tunnel audit events
+	drainTimeout     time.Duration
+	tunnelIdle       time.Duration // default for rules without idle_timeout_s; 0 = never
+	tunnelMax        time.Duration // default for rules without max_duration_s; 0 = never
+	deny             denyTemplates
+}
+
+// liveFields names the config settings liveSettings is built from.
+var liveFields = map[string]bool{
+	"jwt.secret":                   true,
+	"gateway.inspect.bypass":       true,
+	"gateway.sni_mismatch":         true,
+	"gateway.audit_failure":        true,
+	"gateway.request_id_header":    true,
+	"timeouts.progress_interval_s": true,
+	"timeouts.drain_s":             true,
+	"timeouts.tunnel_idle_s":       true,
+	"timeouts.tunnel_max_s":        true,
+	"gateway.deny_templates.text":  true,
+	"gateway.deny_templates.html":  true,
+}
+
+// adminOnlyPrefixes are config settings the gateway does not use.
+var adminOnlyPrefixes = []string{"admin_api.", "tls.", "rpz.", "ops_mode.", "files.sqlite"}
+
+// newLiveSettings builds the live settings from cfg, reading the deny
+// templates it names.
+func newLiveSettings(cfg config.Config) (*liveSettings, error) {
+	deny, err := loadDenyTemplates(cfg.Gateway.DenyTemplates)
+	if err != nil {
+		return nil, fmt.Errorf("deny templates: %w", err)
+	}
+	return &liveSettings{
+		jwtSecret:        []byte(cfg.JWT.Secret),
+		inspectBypass:    cfg.Gateway.Inspect.Bypass,
+		sniMismatch:      cfg.Gateway.SNIMismatch,
+		auditFailClosed:  cfg.Gateway.AuditFailure == auditFailureClosed,
+		requestIDHeader:  cfg.Gateway.RequestIDHeader,
+		progressInterval: time.Duration(cfg.Timeouts.ProgressInterval) * time.Second,
+		drainTimeout:     time.Duration(cfg.Timeouts.Drain) * time.Second,
+		tunnelIdle:       time.Duration(cfg.Timeouts.TunnelIdle) * time.Second,
+		tunnelMax:        time.Duration(cfg.Timeouts.TunnelMax) * time.Second,
+		deny:             deny,
+	}, nil
+}
+
+// settings returns the current live settings. A handler that was never
+// configured (tests) gets the zero value.
+func (h *proxyHandler) settings() *liveSettings {
+	if s := h.live.Load(); s != nil {
+		return s
+	}
+	return &liveSettings{}
+}
+
+// reloadConfig re-reads the config file and environment and applies the
+// live settings. Every other gateway setting that differs from started, the
+// config the process began with, is logged and returned as needing a
+// restart. An invalid config is rejected as a whole; current is then
+// returned unchanged with the error.
+func (h *proxyHandler) reloadConfig(path string, started, current config.Config) (config.Config, []string, error) {
+	cfg, err := config.LoadWithEnv(path, os.LookupEnv)
+	if err != nil {
+		return current, nil, err
+	}
+	live, err := newLiveSettings(cfg)
+	if err != nil {
+		return current, nil, err
+	}
+	h.live.Store(live)
+
+	var applied, restart []string
+	for _, name := range config.Changed(current, cfg) {
+		if liveFields[name] {
+			applied = append(applied, name)
+		}
+	}
+	for _, name := range config.Changed(started, cfg) {
+		if !liveFields[name] && !adminOnly(name) {
+			restart = append(restart, name)
+		}
+	}
+	if len(applied) > 0 {
+		log.Printf("reload config: applied %s", strings.Join(applied, ", "))
+	}
+	if len(restart) > 0 {
+		log.Printf("reload config: restart required to apply %s", strings.Join(restart, ", "))
+	}
+	return cfg, restart, nil
+}
+
+func adminOnly(name string) bool {
+	for _, p := range adminOnlyPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+)
+
+// flowCheck returns the Check for one of ag's flows. The flow stays
+// permitted while ag is not disabled in the identity registry (nor deleted
+// from it, if it was registered when the flow began) and, if pctx is
+// non-nil, while policy still allows pctx. Flows that decide policy per
+// request, such as inspected sessions, pass a nil pctx.
+func (h *proxyHandler) flowCheck(ag *identity.Agent, pctx *policy.RequestContext) func() bool {
+	agentID := ag.AgentID
+	registered := h.reg.LookupByID(agentID) != nil
+	var p policy.RequestContext
+	if pctx != nil {
+		p = *pctx
+	}
+	return func() bool {
+		if cur := h.reg.LookupByID(agentID); cur != nil {
+			if cur.Status != "active" {
+				return false
+			}
+		} else if registered {
+			return false
+		}
+		return pctx == nil || h.eng.EvaluateRich(p).Action == "allow"
+	}
+}
+
+// revokeFlows closes the open flows that the current identity registry and
+// policy no longer permit. Each writes its final audit event with close
+// reason "revoked".
+func (h *proxyHandler) revokeFlows() []flow.Flow {
+	revoked := h.flows.Revoke(closeRevoked)
+	for _, f := range revoked {
+		log.Printf("revoked flow %s: agent=%s %s", f.ID, f.AgentID, f.Destination)
+	}
+	return revoked
+}
+
+// killFlows closes every open flow of agentID.
+func (h *proxyHandler) killFlows(agentID string) []flow.Flow {
+	killed := h.flows.CloseAgent(agentID, closeKilled)
+	if len(killed) > 0 {
+		log.Printf("killed %d flows of agent=%s", len(killed), agentID)
+	}
+	return killed
+}
+
+// auditForcedClose writes the final event of a session whose requests are
+// audited one by one (inspected TLS, transparent HTTP), if the tracker
+// closed it: ev is completed with the close reason and duration.
+func (h *proxyHandler) auditForcedClose(fl *flow.Handle, ev audit.Event, start time.Time) {
+	reason := fl.CloseReason()
+	if reason == "" {
+		return
+	}
+	ev.Decision = "allow"
+	ev.CloseReason = reason
+	ev.LatencyMs = time.Since(start).Milliseconds()
+	ev.DurationMs = ev.LatencyMs
+	h.writeAudit(ev)
+}
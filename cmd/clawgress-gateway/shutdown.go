@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// forceCloseGrace bounds how long force-closed tunnels get to unwind and
+// write their final audit events after the drain deadline.
+const forceCloseGrace = 5 * time.Second
+
+// drain stops accepting connections and waits up to timeout, or until parent
+// ends, for in-flight requests and tracked tunnels to finish on their own.
+// Whatever is still open then is force-closed; drain returns once those
+// tunnels have written their audit events (or forceCloseGrace expires).
+func (h *proxyHandler) drain(parent context.Context, srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	// Shutdown closes the listeners and idle keep-alive conns, then waits
+	// for non-hijacked handlers, HTTP/2 tunnel streams among them. Hijacked
+	// tunnels are invisible to it.
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		err = h.flows.Wait(ctx)
+	}
+	if err != nil {
+		// Tunnels first, so they record why they ended before closing the
+		// HTTP connections cuts any HTTP/2 streams.
+		n := h.flows.CloseAll(closeShutdown)
+		why := "deadline reached"
+		if parent.Err() != nil {
+			why = "interrupted"
+		}
+		log.Printf("drain: %s, force-closed %d tunnels", why, n)
+		srv.Close()
+
+		grace, cancel := context.WithTimeout(context.Background(), forceCloseGrace)
+		defer cancel()
+		if err := h.flows.Wait(grace); err != nil {
+			log.Printf("drain: %d tunnels did not finish after force-close", h.flows.Len())
+		}
+	}
+	h.upstream.CloseIdleConnections()
+	log.Println("drain: complete")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/sniff"
+)
+
+// SNI mismatch handling modes (gateway.sni_mismatch).
+const (
+	sniMismatchDeny  = "deny"  // close tunnels whose SNI is denied by policy
+	sniMismatchAudit = "audit" // record the mismatch but keep the tunnel open
+	sniMismatchOff   = "off"   // do not look at tunnel payloads
+)
+
+// connectCheck is the outcome of re-evaluating a tunnel after its first bytes.
+type connectCheck struct {
+	dec      policy.Decision
+	sni      string
+	mismatch bool
+}
+
+// connectVerifier re-checks a tunnel once the client's first bytes are known,
+// or peekErr says they could not be read. A non-allow decision closes the
+// tunnel.
+type connectVerifier func(info sniff.Info, peekErr error) connectCheck
+
+// sniUnverifiedPolicyID marks tunnels closed because their SNI could not be
+// checked against the CONNECT authority.
+const sniUnverifiedPolicyID = "sni-unverified"
+
+// connectContext builds the policy context for a tunnel to dest.
+func connectContext(ag *identity.Agent, dest, method string) policy.RequestContext {
+	return policy.RequestContext{
+		AgentID:     ag.AgentID,
+		Destination: dest,
+		Method:      method,
+		Environment: ag.Environment,
+		TeamID:      ag.TeamID,
+		ProjectID:   ag.ProjectID,
+	}
+}
+
+// verifyConnect returns a verifier that re-evaluates pctx with the observed
+// payload protocol, and — for TLS whose SNI names a different host than the
+// CONNECT authority (domain fronting) — evaluates the SNI host as well. TLS
+// without a readable SNI to a named host, and a stream whose first bytes
+// could not be read, count as mismatches that cannot be cleared by policy.
+func (h *proxyHandler) verifyConnect(pctx policy.RequestContext) connectVerifier {
+	mode := h.settings().sniMismatch
+	return func(info sniff.Info, peekErr error) connectCheck {
+		pctx.Protocol = info.Protocol
+		c := connectCheck{dec: h.eng.EvaluateRich(pctx), sni: info.ServerName}
+		if c.dec.Action != "allow" {
+			return c
+		}
+		if peekErr != nil {
+			return unverified(c, pctx, mode, "first bytes unreadable: "+peekErr.Error())
+		}
+		if info.Protocol != sniff.ProtoTLS {
+			return c
+		}
+
+		host, port, err := net.SplitHostPort(pctx.Destination)
+		if err != nil {
+			host, port = pctx.Destination, "443"
+		}
+		if info.ServerName == "" {
+			if _, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+				return c // clients send no SNI to IP literals
+			}
+			return unverified(c, pctx, mode, "no readable SNI")
+		}
+		if policy.MatchesDomain(info.ServerName, []string{host}) {
+			return c
+		}
+		c.mismatch = true
+
+		sctx := pctx
+		sctx.Destination = net.JoinHostPort(info.ServerName, port)
+		sdec := h.eng.EvaluateRich(sctx)
+		if sdec.Action == "allow" {
+			return c
+		}
+		log.Printf("sni mismatch: agent=%s connect=%s sni=%s denied by %s (mode=%s)",
+			pctx.AgentID, pctx.Destination, info.ServerName, sdec.PolicyID, mode)
+		if mode == sniMismatchDeny {
+			c.dec = sdec
+		}
+		return c
+	}
+}
+
+// unverified marks c as a mismatch whose SNI could not be checked, denying
+// the tunnel in deny mode.
+func unverified(c connectCheck, pctx policy.RequestContext, mode, why string) connectCheck {
+	c.mismatch = true
+	log.Printf("sni mismatch: agent=%s connect=%s unverified, %s (mode=%s)",
+		pctx.AgentID, pctx.Destination, why, mode)
+	if mode == sniMismatchDeny {
+		c.dec = policy.Decision{
+			Action: "deny", PolicyID: sniUnverifiedPolicyID,
+			Reason: "tunnel SNI could not be verified: " + why,
+		}
+	}
+	return c
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/sniff"
+)
+
+var sniRules = []policy.Rule{
+	{PolicyID: "deny-blocked", Domains: []string{"blocked.example"}, Action: "deny"},
+	{PolicyID: "allow-local", Domains: []string{"localhost", "127.0.0.1"}, Action: "allow"},
+}
+
+// fragmentedHello returns a Go client's ClientHello for sni split into TLS
+// records of at most 40 bytes.
+func fragmentedHello(t *testing.T, sni string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(server, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	var out []byte
+	for len(body) > 0 {
+		n := min(40, len(body))
+		out = append(out, hdr[0], hdr[1], hdr[2], byte(n>>8), byte(n))
+		out = append(out, body[:n]...)
+		body = body[n:]
+	}
+	return out
+}
+
+func TestSNIMismatchFragmentedHello(t *testing.T) {
+	h, auditPath := newTestHandler(t, sniRules, nil)
+	px := httptest.NewServer(h)
+	defer px.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan int, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		n, _ := io.Copy(io.Discard, c)
+		got <- int(n)
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	c, _ := connectThrough(t, px.Listener.Addr().String(), "localhost:"+port)
+	c.Write(fragmentedHello(t, "blocked.example"))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("fronted tunnel should be closed")
+	}
+	select {
+	case n := <-got:
+		if n != 0 {
+			t.Fatalf("upstream received %d bytes of a denied hello", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream conn not closed")
+	}
+
+	events := waitAudit(t, auditPath, 1)
+	if len(events) != 1 {
+		t.Fatalf("want 1 audit event, got %d", len(events))
+	}
+	ev := events[0]
+	if ev.Decision != "deny" || ev.PolicyID != "deny-blocked" || ev.SNI != "blocked.example" || !ev.SNIMismatch {
+		t.Fatalf("tunnel event: %+v", ev)
+	}
+}
+
+func TestSNIUnverified(t *testing.T) {
+	h, _ := newTestHandler(t, sniRules, nil)
+	noSNI := sniff.Info{Protocol: sniff.ProtoTLS}
+	cases := []struct {
+		name     string
+		dest     string
+		info     sniff.Info
+		peekErr  error
+		mode     string
+		decision string
+		mismatch bool
+	}{
+		{"peek error", "localhost:443", sniff.Info{Protocol: sniff.ProtoUnknown}, errors.New("read: connection reset"), sniMismatchDeny, "deny", true},
+		{"peek error audited", "localhost:443", sniff.Info{Protocol: sniff.ProtoUnknown}, io.EOF, sniMismatchAudit, "allow", true},
+		{"no SNI", "localhost:443", noSNI, nil, sniMismatchDeny, "deny", true},
+		{"no SNI audited", "localhost:443", noSNI, nil, sniMismatchAudit, "allow", true},
+		{"no SNI to IP literal", "127.0.0.1:443", noSNI, nil, sniMismatchDeny, "allow", false},
+		{"matching SNI", "localhost:443", sniff.Info{Protocol: sniff.ProtoTLS, ServerName: "localhost"}, nil, sniMismatchDeny, "allow", false},
+	}
+	for _, tc := range cases {
+		h.live.Store(&liveSettings{sniMismatch: tc.mode})
+		c := h.verifyConnect(connectContext(&testAgent, tc.dest, "CONNECT"))(tc.info, tc.peekErr)
+		if c.dec.Action != tc.decision || c.mismatch != tc.mismatch {
+			t.Errorf("%s: got %s mismatch=%v, want %s mismatch=%v", tc.name, c.dec.Action, c.mismatch, tc.decision, tc.mismatch)
+		}
+		if tc.decision == "deny" && c.dec.PolicyID != sniUnverifiedPolicyID {
+			t.Errorf("%s: policy %q", tc.name, c.dec.PolicyID)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/socks5"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/upstream"
+)
+
+// serveSOCKS accepts SOCKS5 clients on ln until it is closed.
+func (h *proxyHandler) serveSOCKS(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("socks: accept: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go h.handleSOCKS(c)
+	}
+}
+
+// handleSOCKS serves one SOCKS5 client. Identity comes from RFC 1929
+// username/password: the password is the agent's API key, as in the
+// Proxy-Authorization password of the HTTP listener, and the username is
+// only recorded when the key is not recognised.
+func (h *proxyHandler) handleSOCKS(c net.Conn) {
+	start := time.Now()
+	reqID := newRequestID()
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(sniffTimeout))
+	user, key, err := socks5.Handshake(c)
+	if err != nil {
+		if errors.Is(err, socks5.ErrAuthRejected) {
+			h.auditNoIdentity(c, reqID, "", start)
+		}
+		return
+	}
+	ag := h.reg.LookupByKey(key)
+	if ag == nil {
+		socks5.WriteAuthStatus(c, false)
+		h.auditNoIdentity(c, reqID, user, start)
+		return
+	}
+	if err := socks5.WriteAuthStatus(c, true); err != nil {
+		return
+	}
+	req, err := socks5.ReadRequest(c)
+	if err != nil {
+		var re socks5.ReplyError
+		if errors.As(err, &re) {
+			socks5.WriteReply(c, byte(re), nil)
+		}
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	switch req.Cmd {
+	case socks5.CmdConnect:
+		h.socksConnect(c, ag, req.Addr, reqID, start)
+	case socks5.CmdUDPAssociate:
+		h.socksUDP(c, ag, reqID, start)
+	default:
+		socks5.WriteReply(c, socks5.ReplyCommandNotSupported, nil)
+	}
+}
+
+// socksConnect runs a SOCKS5 CONNECT through the same quota, policy,
+// inspection and tunnel path as an HTTP CONNECT. Domain-name requests reach
+// policy as names; the gateway resolves them when dialing.
+func (h *proxyHandler) socksConnect(c net.Conn, ag *identity.Agent, dest, reqID string, start time.Time) {
+	method := http.MethodConnect
+	client := connPeer(c)
+	qd, release := h.checkQuota(ag, client, dest, method, reqID, start)
+	if !qd.Allowed {
+		socks5.WriteReply(c, socks5.ReplyNotAllowed, nil)
+		return
+	}
+	defer release()
+	pctx := connectContext(ag, dest, method)
+	if h.shouldInspect(pctx) {
+		if _, refused := h.refuseConnect(ag, client, pctx, reqID, start); refused {
+			socks5.WriteReply(c, socks5.ReplyNotAllowed, nil)
+			return
+		}
+		fl := h.flows.Add(flow.Flow{
+			ID: reqID, AgentID: ag.AgentID, Destination: dest, Started: start,
+			Check: h.flowCheck(ag, nil),
+		}, c)
+		defer fl.Done()
+		if err := socks5.WriteReply(c, socks5.ReplySucceeded, nil); err != nil {
+			return
+		}
+		h.inspectConn(c, fl, ag, dest, method, reqID, start)
+		return
+	}
+	dec := h.checkPolicy(ag, client, pctx, reqID, start)
+	if dec.Action != "allow" {
+		socks5.WriteReply(c, socks5.ReplyNotAllowed, nil)
+		return
+	}
+	if !h.checkAuditSink(ag, client, dest, method, reqID, start) {
+		socks5.WriteReply(c, socks5.ReplyGeneralFailure, nil)
+		return
+	}
+
+	up, out, err := h.router.Dial(context.Background(), dec.Upstreams, egressSource(ag, dec), dest)
+	if err != nil {
+		h.auditUpstreamError(ag, client, dest, method, reqID, start, dec, err)
+		socks5.WriteReply(c, socksReply(err), nil)
+		return
+	}
+	defer up.Close()
+	fl := h.flows.Add(flow.Flow{
+		ID: reqID, AgentID: ag.AgentID, Destination: dest, Started: start,
+		Check: h.flowCheck(ag, &pctx),
+	}, c, up)
+	defer fl.Done()
+
+	if err := socks5.WriteReply(c, socks5.ReplySucceeded, up.LocalAddr()); err != nil {
+		return
+	}
+	var verify connectVerifier
+	if h.settings().sniMismatch != sniMismatchOff {
+		verify = h.verifyConnect(pctx)
+	}
+	h.splice(c, up, tunnel{
+		ag: ag, client: client, dest: dest, method: method, reqID: reqID, start: start, dec: dec,
+		out: out, flow: fl,
+	}, verify)
+}
+
+// socksReply maps a dial error to the closest SOCKS5 reply code.
+func socksReply(err error) byte {
+	var re socks5.ReplyError
+	switch {
+	case upstream.Denied(err):
+		return socks5.ReplyNotAllowed
+	case errors.As(err, &re):
+		return byte(re) // a SOCKS5 parent's answer
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5.ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5.ReplyNetworkUnreachable
+	default:
+		return socks5.ReplyHostUnreachable
+	}
+}
+
+// auditNoIdentity records a client that presented no usable credentials.
+func (h *proxyHandler) auditNoIdentity(c net.Conn, reqID, agentID string, start time.Time) {
+	h.writeAudit(audit.Event{
+		RequestID: reqID,
+		AgentID:   agentID,
+		Method:    "SOCKS5",
+		Decision:  "deny",
+		PolicyID:  "no-identity",
+		LatencyMs: time.Since(start).Milliseconds(),
+		ClientIP:  clientIP(c.RemoteAddr().String()),
+	})
+}
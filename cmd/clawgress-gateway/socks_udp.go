@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/egress"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/socks5"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/upstream"
+)
+
+// socksMethodUDP is the method SOCKS5 UDP relaying is evaluated as. Only
+// rules that list it in methods allow UDP; catch-all allow rules do not.
+const socksMethodUDP = "UDP"
+
+// socksUDPPolicyID is recorded when UDP is refused because no rule allows
+// it explicitly, or the allowing rule routes through a parent proxy.
+const socksUDPPolicyID = "socks-udp"
+
+// maxUDPDests caps the destinations one association may address. Each new
+// destination costs a policy evaluation, a lookup and an audit event, so
+// past the cap datagrams to new destinations are dropped; the first one
+// dropped is audited with socksUDPDestLimitPolicyID.
+const maxUDPDests = 256
+
+const socksUDPDestLimitPolicyID = "socks-udp-dest-limit"
+
+// socksUDP serves a UDP ASSOCIATE. The association is refused unless some
+// rule explicitly allows UDP for the agent; each destination is then
+// evaluated on its first datagram. The relay lives as long as the control
+// connection c.
+func (h *proxyHandler) socksUDP(c net.Conn, ag *identity.Agent, reqID string, start time.Time) {
+	if !h.eng.ExplicitlyAllowsMethod(connectContext(ag, "", socksMethodUDP)) {
+		h.writeAudit(audit.Event{
+			RequestID: reqID, AgentID: ag.AgentID, TeamID: ag.TeamID,
+			ProjectID: ag.ProjectID, Environment: ag.Environment,
+			Method: socksMethodUDP, Decision: "deny", PolicyID: socksUDPPolicyID,
+			LatencyMs: time.Since(start).Milliseconds(), ClientIP: clientIP(c.RemoteAddr().String()),
+		})
+		socks5.WriteReply(c, socks5.ReplyNotAllowed, nil)
+		return
+	}
+	qd, release := h.checkQuota(ag, connPeer(c), "", socksMethodUDP, reqID, start)
+	if !qd.Allowed {
+		socks5.WriteReply(c, socks5.ReplyNotAllowed, nil)
+		return
+	}
+	defer release()
+	if !h.checkAuditSink(ag, connPeer(c), "", socksMethodUDP, reqID, start) {
+		socks5.WriteReply(c, socks5.ReplyGeneralFailure, nil)
+		return
+	}
+
+	// Relay on the address the client reached us on, so it is routable
+	// from the client.
+	var local net.IP
+	if ta, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		local = ta.IP
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local})
+	if err != nil {
+		log.Printf("socks: udp relay for agent=%s: %v", ag.AgentID, err)
+		socks5.WriteReply(c, socks5.ReplyGeneralFailure, nil)
+		return
+	}
+	defer pc.Close()
+	ext, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("socks: udp relay for agent=%s: %v", ag.AgentID, err)
+		socks5.WriteReply(c, socks5.ReplyGeneralFailure, nil)
+		return
+	}
+	defer ext.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &udpRelay{
+		h: h, ag: ag, reqID: reqID, start: start, ctx: ctx,
+		clientIP: remoteAddr(c), pc: pc, ext: ext,
+		bound:  make(map[netip.Addr]*net.UDPConn),
+		byName: make(map[string]*udpDest),
+		byAddr: make(map[netip.AddrPort]*udpDest),
+	}
+	identityCheck := h.flowCheck(ag, nil)
+	fl := h.flows.Add(flow.Flow{
+		ID: reqID, AgentID: ag.AgentID, Destination: "udp", Started: start,
+		Check: func() bool { return identityCheck() && r.recheck() },
+	}, c, pc, ext)
+	defer fl.Done()
+
+	if err := socks5.WriteReply(c, socks5.ReplySucceeded, pc.LocalAddr()); err != nil {
+		return
+	}
+
+	r.wg.Add(2)
+	go func() { defer r.wg.Done(); r.fromClient() }()
+	go func() { defer r.wg.Done(); r.fromUpstream(ext) }()
+
+	// The client holds the control connection open for the association's
+	// lifetime and sends nothing on it.
+	io.Copy(io.Discard, c)
+	pc.Close()
+	r.closeSockets()
+	cancel()
+	r.wg.Wait()
+
+	reason := closeClient
+	if fl.CloseReason() != "" {
+		reason = fl.CloseReason()
+	}
+	r.auditAll(reason)
+}
+
+// udpDest is one destination of an association, evaluated once.
+type udpDest struct {
+	name    string         // host:port as the client addressed it
+	addr    netip.AddrPort // vetted address datagrams are sent to
+	ext     *net.UDPConn   // socket they leave from
+	egress  netip.Addr     // its bound address; invalid for ext
+	allowed bool
+	dec     policy.Decision
+	out, in *byteMeter
+}
+
+// udpRelay moves datagrams between one SOCKS5 client (pc) and the
+// destinations it addresses. Destinations whose agent and rule name no
+// egress source share ext, bound by the kernel; the others use a socket
+// bound to their source address, opened on first use.
+type udpRelay struct {
+	h        *proxyHandler
+	ag       *identity.Agent
+	reqID    string
+	start    time.Time
+	clientIP netip.Addr
+	pc, ext  *net.UDPConn
+	wg       sync.WaitGroup  // relay goroutines
+	ctx      context.Context // ends with the association; see flowMeters
+
+	mu     sync.Mutex
+	client netip.AddrPort // learned from the first datagram
+	bound  map[netip.Addr]*net.UDPConn
+	closed bool // closeSockets ran; open no more
+	byName map[string]*udpDest
+	byAddr map[netip.AddrPort]*udpDest
+	capped bool // maxUDPDests reached and audited
+}
+
+func (r *udpRelay) fromClient() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := r.pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		// Only the client that opened the association may use it.
+		if from.Addr() != r.clientIP {
+			continue
+		}
+		r.mu.Lock()
+		if !r.client.IsValid() {
+			r.client = from
+		}
+		ok := from == r.client
+		r.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		name, payload, err := socks5.ParseUDP(buf[:n])
+		if err != nil {
+			continue
+		}
+		d := r.dest(name)
+		if !d.allowed {
+			continue
+		}
+		// Datagrams are not split: the whole payload waits its turn.
+		if d.out.wait(len(payload)) != nil {
+			return
+		}
+		if n, err := d.ext.WriteToUDPAddrPort(payload, d.addr); err == nil {
+			d.out.add(n)
+		}
+	}
+}
+
+// fromUpstream relays replies arriving on ext, one of the relay's sockets.
+func (r *udpRelay) fromUpstream(ext *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	pkt := make([]byte, 0, 64*1024+262)
+	for {
+		n, from, err := ext.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		r.mu.Lock()
+		d, client := r.byAddr[from], r.client
+		r.mu.Unlock()
+		// Drop anything from an address the client never sent to, or
+		// did not send to from this socket.
+		if d == nil || d.ext != ext || !client.IsValid() {
+			continue
+		}
+		pkt, err = socks5.AppendUDP(pkt[:0], from.String(), buf[:n])
+		if err != nil {
+			continue
+		}
+		if d.in.wait(n) != nil {
+			return
+		}
+		if _, err := r.pc.WriteToUDPAddrPort(pkt, client); err == nil {
+			d.in.add(n)
+		}
+	}
+}
+
+// dest evaluates name on first use: policy (which must name UDP
+// explicitly), then the SSRF guard. Refusals are audited once and cached.
+// Past maxUDPDests a new name is refused without being evaluated or cached.
+func (r *udpRelay) dest(name string) *udpDest {
+	r.mu.Lock()
+	d := r.byName[name]
+	full := d == nil && len(r.byName) >= maxUDPDests
+	firstRefusal := full && !r.capped
+	r.capped = r.capped || full
+	r.mu.Unlock()
+	if d != nil {
+		return d
+	}
+	if full {
+		d = &udpDest{name: name}
+		if firstRefusal {
+			log.Printf("socks: udp association of agent=%s reached %d destinations; dropping datagrams to new ones", r.ag.AgentID, maxUDPDests)
+			ev := r.event(d)
+			ev.Decision, ev.PolicyID = "deny", socksUDPDestLimitPolicyID
+			ev.LatencyMs = time.Since(r.start).Milliseconds()
+			r.h.writeAudit(ev)
+		}
+		return d
+	}
+
+	d = &udpDest{name: name}
+	d.out, d.in = r.h.flowMeters(r.ctx, r.ag)
+	d.dec = r.h.eng.EvaluateRich(connectContext(r.ag, name, socksMethodUDP))
+	ev := r.event(d)
+	switch {
+	case d.dec.Action != "allow":
+		ev.Decision = "deny"
+	case !d.dec.Explicit || !directOnly(d.dec.Upstreams):
+		// UDP is never relayed through parent proxies.
+		ev.Decision, ev.PolicyID = "deny", socksUDPPolicyID
+	default:
+		ev = r.resolve(d, ev)
+		d.allowed = d.addr.IsValid()
+	}
+	if !d.allowed {
+		ev.LatencyMs = time.Since(r.start).Milliseconds()
+		r.h.writeAudit(ev)
+	}
+
+	r.mu.Lock()
+	r.byName[name] = d
+	if d.allowed {
+		r.byAddr[d.addr] = d
+	}
+	r.mu.Unlock()
+	return d
+}
+
+// resolve vets d's host with the SSRF guard, then picks the address to send
+// to and the socket to send from for the egress source of the agent and
+// rule, as for TCP. It fills in d.addr and d.ext, or leaves d.addr invalid
+// and returns the refusal to audit.
+func (r *udpRelay) resolve(d *udpDest, ev audit.Event) audit.Event {
+	host, portStr, err := net.SplitHostPort(d.name)
+	port, perr := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || perr != nil || port == 0 {
+		ev.Decision = "allow-upstream-error"
+		return ev
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := r.h.guard.Resolve(ctx, host)
+	if err != nil {
+		if upstream.Denied(err) {
+			log.Printf("agent=%s blocked: %v", r.ag.AgentID, err)
+			ev.Decision, ev.PolicyID = "deny", ssrfPolicyID
+		} else {
+			ev.Decision = "allow-upstream-error"
+		}
+		return ev
+	}
+	src := egressSource(r.ag, d.dec)
+	local, remote, err := (&egress.Dialer{Source: src}).Pick(ips)
+	if err == nil {
+		d.ext, err = r.socket(local)
+	}
+	if err != nil {
+		log.Printf("socks: udp relay for agent=%s to %s: %v", r.ag.AgentID, d.name, err)
+		ev.Decision = "allow-upstream-error"
+		return ev
+	}
+	if !local.IsUnspecified() {
+		d.egress = local
+	}
+	d.addr = netip.AddrPortFrom(remote, uint16(port))
+	return ev
+}
+
+// socket returns the relay socket bound to local, opening it on first use.
+// The unspecified address is the shared, kernel-bound ext.
+func (r *udpRelay) socket(local netip.Addr) (*net.UDPConn, error) {
+	if local.IsUnspecified() {
+		return r.ext, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.bound[local]; s != nil {
+		return s, nil
+	}
+	if r.closed {
+		return nil, net.ErrClosed
+	}
+	s, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.AsSlice()})
+	if err != nil {
+		return nil, err
+	}
+	r.bound[local] = s
+	r.wg.Add(1)
+	go func() { defer r.wg.Done(); r.fromUpstream(s) }()
+	return s, nil
+}
+
+// recheck re-evaluates the association against the current policy after a
+// reload. Destinations no longer allowed are dropped, each with a final
+// audit event closed as revoked; a later datagram to one is evaluated
+// afresh. It reports false, revoking the whole association, once no rule
+// allows UDP for the agent.
+func (r *udpRelay) recheck() bool {
+	if !r.h.eng.ExplicitlyAllowsMethod(connectContext(r.ag, "", socksMethodUDP)) {
+		return false
+	}
+	r.mu.Lock()
+	open := make([]*udpDest, 0, len(r.byName))
+	for _, d := range r.byName {
+		if d.allowed {
+			open = append(open, d)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, d := range open {
+		dec := r.h.eng.EvaluateRich(connectContext(r.ag, d.name, socksMethodUDP))
+		if dec.Action == "allow" && dec.Explicit && directOnly(dec.Upstreams) {
+			continue
+		}
+		r.mu.Lock()
+		if r.byName[d.name] != d {
+			r.mu.Unlock()
+			continue
+		}
+		delete(r.byName, d.name)
+		if r.byAddr[d.addr] == d {
+			delete(r.byAddr, d.addr)
+		}
+		r.mu.Unlock()
+		log.Printf("revoked udp destination %s of flow %s: agent=%s", d.name, r.reqID, r.ag.AgentID)
+		r.h.writeAudit(r.closeEvent(d, closeRevoked))
+	}
+	return true
+}
+
+// closeSockets closes every upstream socket, ending their relay loops.
+func (r *udpRelay) closeSockets() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.ext.Close()
+	for _, s := range r.bound {
+		s.Close()
+	}
+}
+
+// auditAll writes the final event for every destination the association
+// relayed to.
+func (r *udpRelay) auditAll(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.byName {
+		if d.allowed {
+			r.h.writeAudit(r.closeEvent(d, reason))
+		}
+	}
+}
+
+// closeEvent is the final event of an allowed destination.
+func (r *udpRelay) closeEvent(d *udpDest, reason string) audit.Event {
+	ev := r.event(d)
+	ev.Decision = "allow"
+	ev.LatencyMs = time.Since(r.start).Milliseconds()
+	ev.DurationMs = ev.LatencyMs
+	ev.BytesOut, ev.BytesIn = d.out.load(), d.in.load()
+	ev.Route, ev.ResolvedIP = policy.RouteDirect, d.addr.Addr().String()
+	if d.egress.IsValid() {
+		ev.EgressIP = d.egress.String()
+	}
+	ev.CloseReason = reason
+	return ev
+}
+
+func (r *udpRelay) event(d *udpDest) audit.Event {
+	return audit.Event{
+		RequestID: r.reqID, AgentID: r.ag.AgentID, TeamID: r.ag.TeamID,
+		ProjectID: r.ag.ProjectID, Environment: r.ag.Environment,
+		Destination: d.name, Method: socksMethodUDP, PolicyID: d.dec.PolicyID,
+		ClientIP: r.clientIP.String(),
+	}
+}
+
+// directOnly reports whether routes leave the gateway directly.
+func directOnly(routes []policy.Route) bool {
+	for _, rt := range routes {
+		if rt.Type != policy.RouteDirect && rt.Type != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/egress"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/socks5"
+)
+
+// newTestRelay returns a relay for testAgent with no client attached.
+func newTestRelay(t *testing.T, h *proxyHandler) *udpRelay {
+	t.Helper()
+	ext, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &udpRelay{
+		h: h, ag: &testAgent, reqID: "r1", start: time.Now(), ext: ext, ctx: context.Background(),
+		bound:  make(map[netip.Addr]*net.UDPConn),
+		byName: make(map[string]*udpDest),
+		byAddr: make(map[netip.AddrPort]*udpDest),
+	}
+	t.Cleanup(func() { r.closeSockets(); r.wg.Wait() })
+	return r
+}
+
+func TestUDPRelayEgressSource(t *testing.T) {
+	srv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	h, _ := newTestHandler(t, []policy.Rule{{
+		PolicyID: "udp-local", Domains: []string{"127.0.0.1"}, Methods: []string{socksMethodUDP}, Action: "allow",
+		Source: egress.Source{Address: "127.0.0.2"},
+	}}, nil)
+	r := newTestRelay(t, h)
+
+	d := r.dest(srv.LocalAddr().String())
+	if !d.allowed {
+		t.Skipf("cannot bind 127.0.0.2 here")
+	}
+	if d.ext == r.ext || d.egress.String() != "127.0.0.2" {
+		t.Fatalf("destination not bound to the rule's egress address: egress=%s", d.egress)
+	}
+	if _, err := d.ext.WriteToUDPAddrPort([]byte("ping"), d.addr); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, from, err := srv.ReadFromUDPAddrPort(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Addr().String() != "127.0.0.2" {
+		t.Fatalf("datagram left from %s, want 127.0.0.2", from.Addr())
+	}
+
+	// A destination without an egress source shares the kernel-bound socket.
+	h2, _ := newTestHandler(t, []policy.Rule{{
+		PolicyID: "udp-local", Domains: []string{"127.0.0.1"}, Methods: []string{socksMethodUDP}, Action: "allow",
+	}}, nil)
+	r = newTestRelay(t, h2)
+	if d := r.dest(srv.LocalAddr().String()); !d.allowed || d.ext != r.ext || d.egress.IsValid() {
+		t.Fatalf("unbound destination: allowed=%v shared=%v egress=%s", d.allowed, d.ext == r.ext, d.egress)
+	}
+}
+
+func TestUDPRelayCapsDestinations(t *testing.T) {
+	h, auditPath := newTestHandler(t, nil, nil)
+	r := newTestRelay(t, h)
+	for i := range maxUDPDests + 2 {
+		if d := r.dest(fmt.Sprintf("198.51.100.1:%d", 1000+i)); d.allowed {
+			t.Fatalf("destination %d allowed without a rule", i)
+		}
+	}
+	if len(r.byName) != maxUDPDests {
+		t.Fatalf("association tracks %d destinations, want %d", len(r.byName), maxUDPDests)
+	}
+	// A destination seen before the cap is still answered from the cache.
+	if d := r.dest("198.51.100.1:1000"); d != r.byName["198.51.100.1:1000"] {
+		t.Fatal("known destination re-evaluated past the cap")
+	}
+
+	events := readAudit(t, auditPath)
+	if len(events) != maxUDPDests+1 {
+		t.Fatalf("want %d audit events, got %d", maxUDPDests+1, len(events))
+	}
+	if last := events[len(events)-1]; last.PolicyID != socksUDPDestLimitPolicyID || last.Decision != "deny" {
+		t.Fatalf("cap event: %+v", last)
+	}
+}
+
+// udpAssociate opens a UDP association through the SOCKS5 listener at addr
+// and returns a function sending "ping" to dest through it and reporting the
+// reply, if one arrives.
+func udpAssociate(t *testing.T, addr string) func(dest string) (string, bool) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte{socks5.Version, 1, socks5.AuthPassword})
+	auth := []byte{1, byte(len(testAgent.AgentID))}
+	auth = append(auth, testAgent.AgentID...)
+	auth = append(auth, byte(len(testAgent.APIKey)))
+	c.Write(append(auth, testAgent.APIKey...))
+	c.Write([]byte{socks5.Version, socks5.CmdUDPAssociate, 0, socks5.AtypIPv4, 0, 0, 0, 0, 0, 0})
+	resp := make([]byte, 7)
+	if _, err := io.ReadFull(c, resp); err != nil || resp[1] != socks5.AuthPassword || resp[3] != 0 || resp[5] != socks5.ReplySucceeded {
+		t.Fatalf("UDP ASSOCIATE: %v %v", resp, err)
+	}
+	relay, err := socks5.ReadAddr(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Time{})
+	pc, err := net.Dial("udp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return func(dest string) (string, bool) {
+		t.Helper()
+		pkt, err := socks5.AppendUDP(nil, dest, []byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc.Write(pkt)
+		pc.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		buf := make([]byte, 512)
+		n, err := pc.Read(buf)
+		if err != nil {
+			return "", false
+		}
+		_, payload, err := socks5.ParseUDP(buf[:n])
+		return string(payload), err == nil
+	}
+}
+
+func TestUDPRelayRevokedOnReload(t *testing.T) {
+	echo, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := echo.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDPAddrPort(buf[:n], from)
+		}
+	}()
+
+	allowOther := policy.Rule{PolicyID: "udp-other", Domains: []string{"other.example"}, Methods: []string{socksMethodUDP}, Action: "allow"}
+	h, auditPath := newTestHandler(t, []policy.Rule{
+		{PolicyID: "udp-local", Domains: []string{"127.0.0.1"}, Methods: []string{socksMethodUDP}, Action: "allow"},
+		allowOther,
+	}, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go h.serveSOCKS(ln)
+
+	exchange := udpAssociate(t, ln.Addr().String())
+	dest := echo.LocalAddr().String()
+	if got, ok := exchange(dest); !ok || got != "ping" {
+		t.Fatalf("before reload: %q %v", got, ok)
+	}
+
+	// Reload a policy that denies the destination while UDP stays allowed
+	// for others: the association lives on, the destination is dropped.
+	writeJSON(t, filepath.Join(filepath.Dir(auditPath), "policy.json"), []policy.Rule{
+		{PolicyID: "udp-local", Domains: []string{"127.0.0.1"}, Methods: []string{socksMethodUDP}, Action: "deny"},
+		allowOther,
+	})
+	if err := h.eng.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if revoked := h.revokeFlows(); len(revoked) != 0 {
+		t.Fatalf("association revoked while UDP is still allowed: %+v", revoked)
+	}
+	if got, ok := exchange(dest); ok {
+		t.Fatalf("denied destination still relayed: %q", got)
+	}
+	var closed, denied bool
+	for _, e := range readAudit(t, auditPath) {
+		if e.Destination != dest {
+			continue
+		}
+		closed = closed || e.Decision == "allow" && e.CloseReason == closeRevoked
+		denied = denied || e.Decision == "deny" && e.PolicyID == "udp-local"
+	}
+	if !closed || !denied {
+		t.Fatalf("want a revoked close and a deny for %s: closed=%v denied=%v", dest, closed, denied)
+	}
+
+	// Without any rule allowing UDP the whole association is revoked.
+	writeJSON(t, filepath.Join(filepath.Dir(auditPath), "policy.json"), []policy.Rule{})
+	if err := h.eng.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if revoked := h.revokeFlows(); len(revoked) != 1 || revoked[0].Destination != "udp" {
+		t.Fatalf("want the association revoked, got %+v", revoked)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/ssrf"
+)
+
+// ssrfPolicyID is the policy_id recorded when the SSRF guard refuses a
+// destination that policy allowed.
+const ssrfPolicyID = "ssrf-guard"
+
+// newGuard builds the SSRF guard from CLAWGRESS_SSRF_DENY_CIDRS. "none"
+// disables vetting.
+func newGuard(spec string) (*ssrf.Guard, error) {
+	if strings.EqualFold(strings.TrimSpace(spec), "none") {
+		return nil, nil
+	}
+	deny, err := ssrf.ParsePrefixes(splitList(spec))
+	if err != nil {
+		return nil, err
+	}
+	return ssrf.New(deny), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/tracectx"
+)
+
+// newRequestID returns a UUIDv7: unique across gateways and restarts, and
+// sortable by creation time.
+func newRequestID() string {
+	return uuid.Must(uuid.NewV7()).String()
+}
+
+// propagateTrace continues the agent's W3C trace on hdr, the headers about
+// to be forwarded, or starts one if the agent sent no valid traceparent. The
+// forwarded traceparent names a new span for the gateway hop; its IDs are
+// recorded on ev. With gateway.request_id_header set, the request ID is
+// forwarded too, replacing any the agent sent.
+func (h *proxyHandler) propagateTrace(hdr http.Header, ev *audit.Event) {
+	tc, ok := tracectx.FromHeader(hdr)
+	if ok {
+		ev.ParentSpanID = tc.SpanIDString()
+		tc = tc.Child()
+	} else {
+		// tracestate belongs to the trace the agent failed to name.
+		hdr.Del(tracectx.StateHeader)
+		tc = tracectx.New()
+	}
+	hdr.Set(tracectx.Header, tc.String())
+	ev.TraceID, ev.SpanID = tc.TraceIDString(), tc.SpanIDString()
+
+	if name := h.settings().requestIDHeader; name != "" {
+		hdr.Set(name, ev.RequestID)
+	}
+}
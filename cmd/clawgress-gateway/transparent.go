@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/origdst"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/sniff"
+)
+
+// sniffTimeout bounds how long a redirected client may stay silent before
+// its first bytes (ClientHello or request line) arrive.
+const sniffTimeout = 10 * time.Second
+
+// transparentListener wraps the proxy listener. Connections that netfilter
+// redirected to the proxy port (see enforcer.RenderTransparentNft) are
+// diverted to handleTransparent; direct explicit-proxy clients are returned
+// to the http.Server unchanged.
+type transparentListener struct {
+	net.Listener
+	h *proxyHandler
+}
+
+func (l *transparentListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		orig, err := origdst.Lookup(c)
+		if err != nil {
+			return c, nil // not redirected: explicit proxy client
+		}
+		go l.h.handleTransparent(c, orig)
+	}
+}
+
+// handleTransparent serves one redirected connection. Identity comes from the
+// client's source address; the destination name comes from the TLS SNI or
+// HTTP Host header, falling back to the original destination IP.
+func (h *proxyHandler) handleTransparent(c net.Conn, orig *net.TCPAddr) {
+	start := time.Now()
+	reqID := newRequestID()
+	defer c.Close()
+
+	sc, info, err := sniff.Peek(c, sniffTimeout)
+	if err != nil && err != io.EOF {
+		log.Printf("transparent: peek from %s: %v", c.RemoteAddr(), err)
+		return
+	}
+	host := info.ServerName
+	if host == "" {
+		host = orig.IP.String()
+	}
+	dest := net.JoinHostPort(host, strconv.Itoa(orig.Port))
+
+	client := remoteAddr(c)
+	ag := h.reg.LookupBySourceIP(client)
+	if ag == nil {
+		h.writeAudit(audit.Event{
+			RequestID:   reqID,
+			Destination: dest,
+			Method:      transparentMethod(info),
+			Decision:    "deny",
+			PolicyID:    "no-identity",
+			LatencyMs:   time.Since(start).Milliseconds(),
+			ClientIP:    client.String(),
+		})
+		if info.Protocol == sniff.ProtoHTTP {
+			fmt.Fprint(sc, "HTTP/1.1 403 Forbidden\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		}
+		return
+	}
+	from := peer{ip: client.String()}
+	fl := h.flows.Add(flow.Flow{
+		ID: reqID, AgentID: ag.AgentID, Destination: dest, Started: start,
+		Check: h.flowCheck(ag, nil),
+	}, c)
+	defer fl.Done()
+
+	if info.Protocol == sniff.ProtoHTTP {
+		h.serveTransparentHTTP(sc, ag, orig)
+		h.auditForcedClose(fl, audit.Event{
+			RequestID: reqID, AgentID: ag.AgentID, TeamID: ag.TeamID,
+			ProjectID: ag.ProjectID, Environment: ag.Environment,
+			Destination: dest, Method: transparentMethod(info), ClientIP: from.ip,
+		}, start)
+		return
+	}
+
+	// TLS and opaque streams are handled like a CONNECT to dest.
+	method := transparentMethod(info)
+	qd, release := h.checkQuota(ag, from, dest, method, reqID, start)
+	if !qd.Allowed {
+		return
+	}
+	defer release()
+	pctx := connectContext(ag, dest, method)
+	pctx.Protocol = info.Protocol
+	if info.Protocol == sniff.ProtoTLS && h.shouldInspect(pctx) {
+		h.inspectConn(sc, fl, ag, dest, method, reqID, start)
+		return
+	}
+	fl.SetCheck(h.flowCheck(ag, &pctx))
+	dec := h.checkPolicy(ag, from, pctx, reqID, start)
+	if dec.Action != "allow" || !h.checkAuditSink(ag, from, dest, method, reqID, start) {
+		return
+	}
+
+	// Dial by name so the policy-checked host is the one actually reached,
+	// regardless of which IP the client resolved.
+	up, out, err := h.router.Dial(context.Background(), dec.Upstreams, egressSource(ag, dec), dest)
+	if err != nil {
+		h.auditUpstreamError(ag, from, dest, method, reqID, start, dec, err)
+		return
+	}
+	defer up.Close()
+
+	// The destination was derived from the SNI, so there is nothing to verify.
+	h.splice(sc, up, tunnel{
+		ag: ag, client: from, dest: dest, method: method, reqID: reqID, start: start, dec: dec,
+		out: out, flow: fl,
+	}, nil)
+}
+
+// serveTransparentHTTP runs redirected plain-HTTP requests through the same
+// quota/policy/forward path as explicit proxy requests.
+func (h *proxyHandler) serveTransparentHTTP(c net.Conn, ag *identity.Agent, orig *net.TCPAddr) {
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Origin-form request: rebuild the absolute URL handleHTTP expects.
+			r.URL.Scheme = "http"
+			if r.Host == "" {
+				r.Host = orig.String()
+			}
+			r.URL.Host = r.Host
+			h.serveAgent(w, r, ag, newRequestID(), time.Now())
+		}),
+		ReadHeaderTimeout: 60 * time.Second,
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+	srv.Serve(newOneConnListener(c))
+}
+
+// transparentMethod is the pseudo-method recorded for non-HTTP transparent flows.
+func transparentMethod(info sniff.Info) string {
+	if info.Protocol == sniff.ProtoHTTP {
+		return "HTTP"
+	}
+	return http.MethodConnect
+}
+
+// remoteAddr returns the client's IP address, or the zero Addr if unknown.
+func remoteAddr(c net.Conn) netip.Addr {
+	if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		if a, ok := netip.AddrFromSlice(ta.IP); ok {
+			return a.Unmap()
+		}
+	}
+	return netip.Addr{}
+}
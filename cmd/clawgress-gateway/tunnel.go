@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/audit"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/quota"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/sniff"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/upstream"
+)
+
+// Close reasons recorded on a tunnel's final audit event.
+const (
+	closeClient   = "client_closed"   // agent closed its side first
+	closeUpstream = "upstream_closed" // upstream closed its side first
+	closeDenied   = "denied"          // first client bytes failed verification
+	closeShutdown = "shutdown"        // force-closed at the drain deadline
+	closeIdle     = "idle_timeout"    // no bytes either way for the idle timeout
+	closeMaxAge   = "max_duration"    // open for the maximum tunnel lifetime
+	closeRevoked  = "revoked"         // identity or policy no longer permits it after a reload
+	closeKilled   = "killed"          // the agent's flows were killed through the control API
+)
+
+// tunnel identifies one spliced flow for accounting and audit.
+type tunnel struct {
+	ag     *identity.Agent
+	client peer
+	dest   string
+	method string
+	reqID  string
+	start  time.Time
+	dec    policy.Decision
+	out    upstream.Outcome // how the upstream conn was dialed
+	flow   *flow.Handle     // nil if untracked
+
+	path    string // request path of an HTTP Upgrade tunnel
+	upgrade string // upgraded protocol, e.g. websocket; empty for CONNECT
+
+	// Trace context forwarded with an HTTP Upgrade; see propagateTrace.
+	traceID, spanID, parentSpanID string
+}
+
+func (t tunnel) event() audit.Event {
+	return audit.Event{
+		RequestID: t.reqID, AgentID: t.ag.AgentID, TeamID: t.ag.TeamID,
+		ProjectID: t.ag.ProjectID, Environment: t.ag.Environment,
+		Destination: t.dest, Method: t.method, PolicyID: t.dec.PolicyID,
+		Route: t.out.Route.String(), ResolvedIP: t.out.ResolvedIP, EgressIP: t.out.EgressIP,
+		Path: t.path, Upgrade: t.upgrade,
+		ClientIP: t.client.ip, CertFingerprint: t.client.cert,
+		TraceID: t.traceID, SpanID: t.spanID, ParentSpanID: t.parentSpanID,
+	}
+}
+
+// splice copies bytes between an established client conn and upstream until
+// both directions finish, then writes the flow's audit event. While the
+// tunnel is open a "progress" event with running totals is written every
+// progress interval. If verify is set, the client's first bytes are held
+// back until verify approves them; upstream bytes are relayed immediately so
+// server-speaks-first protocols work. A tunnel idle in both directions for
+// the idle timeout, or open for the maximum lifetime, is closed.
+func (h *proxyHandler) splice(clientConn net.Conn, upstream io.ReadWriteCloser, t tunnel, verify connectVerifier) {
+	var (
+		mu    sync.Mutex
+		check connectCheck
+	)
+	check.dec = t.dec
+	// Ending either direction closes both conns; cancel then wakes a
+	// direction still waiting on the bandwidth limit.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out, in := h.flowMeters(ctx, t.ag)
+
+	// Each direction reports why it stopped; closing the far side makes the
+	// other direction finish promptly.
+	done := make(chan string, 2)
+	go func() {
+		var src io.Reader = clientConn
+		if verify != nil {
+			sc, info, err := sniff.Peek(clientConn, 0)
+			c := verify(info, err)
+			mu.Lock()
+			check = c
+			mu.Unlock()
+			if c.dec.Action != "allow" {
+				upstream.Close()
+				clientConn.Close()
+				done <- closeDenied
+				return
+			}
+			src = sc
+		}
+		io.Copy(meteredWriter{upstream, out}, src)
+		upstream.Close()
+		done <- closeClient
+	}()
+	go func() {
+		io.Copy(meteredWriter{clientConn, in}, upstream)
+		clientConn.Close()
+		done <- closeUpstream
+	}()
+
+	var tick <-chan time.Time
+	if interval := h.settings().progressInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	// Idle and lifetime limits close both conns, which ends the copies.
+	idle, maxAge := h.tunnelTimeouts(t.dec)
+	var (
+		idleTimer   *time.Timer
+		idleC, maxC <-chan time.Time
+	)
+	if idle > 0 {
+		idleTimer = time.NewTimer(idle)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	if maxAge > 0 {
+		timer := time.NewTimer(time.Until(t.start.Add(maxAge)))
+		defer timer.Stop()
+		maxC = timer.C
+	}
+	var reason string
+	expire := func(r string) {
+		if reason == "" {
+			reason = r
+		}
+		idleC, maxC = nil, nil
+		clientConn.Close()
+		upstream.Close()
+		cancel()
+	}
+	for pending := 2; pending > 0; {
+		select {
+		case r := <-done:
+			cancel()
+			if reason == "" {
+				reason = r
+			}
+			pending--
+		case <-idleC:
+			if quiet := time.Since(lastActivity(out, in)); quiet < idle {
+				idleTimer.Reset(idle - quiet)
+				continue
+			}
+			expire(closeIdle)
+		case <-maxC:
+			expire(closeMaxAge)
+		case <-tick:
+			ev := t.event()
+			ev.Decision = "progress"
+			ev.BytesOut, ev.BytesIn = out.load(), in.load()
+			ev.DurationMs = time.Since(t.start).Milliseconds()
+			h.writeAudit(ev)
+		}
+	}
+	if t.flow != nil && t.flow.CloseReason() != "" {
+		reason = t.flow.CloseReason()
+	}
+
+	mu.Lock()
+	final := check
+	mu.Unlock()
+	ev := t.event()
+	ev.Decision = "allow"
+	if final.dec.Action != "allow" {
+		ev.Decision = "deny"
+		reason = closeDenied // whichever direction noticed the close first
+	}
+	ev.PolicyID = final.dec.PolicyID
+	ev.LatencyMs = time.Since(t.start).Milliseconds()
+	ev.DurationMs = ev.LatencyMs
+	ev.BytesOut, ev.BytesIn = out.load(), in.load()
+	ev.SNI, ev.SNIMismatch = final.sni, final.mismatch
+	ev.CloseReason = reason
+	h.writeAudit(ev)
+}
+
+// byteMeter counts the bytes moved in one direction of a flow. The audit
+// total is read at the end; the Prometheus counter advances as bytes move,
+// so long-running flows are visible in metrics while still open. It also
+// remembers when bytes last moved, for tunnel idle timeouts, and paces the
+// flow through the agent's bandwidth limit.
+type byteMeter struct {
+	n    atomic.Int64
+	last atomic.Int64 // UnixNano of the last add; creation time until then
+	c    prometheus.Counter
+
+	ctx   context.Context    // the flow's lifetime; ends waits on shape
+	shape *quota.Shaper      // nil = unshaped
+	delay prometheus.Counter // seconds spent waiting on shape
+}
+
+func newByteMeter(c prometheus.Counter) *byteMeter {
+	m := &byteMeter{c: c}
+	m.last.Store(time.Now().UnixNano())
+	return m
+}
+
+// chunk returns how many of n bytes to move next: at most one burst of the
+// bandwidth limit, so a shaped flow trickles rather than stalls.
+func (m *byteMeter) chunk(n int) int {
+	if b := m.shape.Burst(); b > 0 && n > b {
+		return b
+	}
+	return n
+}
+
+// wait blocks until n bytes fit the bandwidth limit, or the flow ends.
+func (m *byteMeter) wait(n int) error {
+	d, err := m.shape.Wait(m.ctx, n)
+	if d > 0 {
+		m.delay.Add(d.Seconds())
+	}
+	return err
+}
+
+func (m *byteMeter) add(n int) {
+	if n > 0 {
+		m.n.Add(int64(n))
+		m.c.Add(float64(n))
+		m.last.Store(time.Now().UnixNano())
+	}
+}
+
+func (m *byteMeter) load() int64 { return m.n.Load() }
+
+// lastActivity returns when bytes last moved in either direction.
+func lastActivity(a, b *byteMeter) time.Time {
+	return time.Unix(0, max(a.last.Load(), b.last.Load()))
+}
+
+// tunnelTimeouts returns the idle timeout and maximum lifetime for a tunnel
+// opened by dec: the matched rule's, else the gateway defaults.
+func (h *proxyHandler) tunnelTimeouts(dec policy.Decision) (idle, maxAge time.Duration) {
+	s := h.settings()
+	idle, maxAge = dec.IdleTimeout, dec.MaxDuration
+	if idle == 0 {
+		idle = s.tunnelIdle
+	}
+	if maxAge == 0 {
+		maxAge = s.tunnelMax
+	}
+	return idle, maxAge
+}
+
+// meteredWriter counts and paces bytes written through it.
+type meteredWriter struct {
+	w io.Writer
+	m *byteMeter
+}
+
+func (w meteredWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		k := w.m.chunk(len(p))
+		if err := w.m.wait(k); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(p[:k])
+		w.m.add(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[k:]
+	}
+	return written, nil
+}
+
+// meteredBody counts and paces bytes read from a request body.
+type meteredBody struct {
+	io.ReadCloser
+	m *byteMeter
+}
+
+func (b meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p[:b.m.chunk(len(p))])
+	if werr := b.m.wait(n); werr != nil {
+		return 0, werr
+	}
+	b.m.add(n)
+	return n, err
+}
+
+// meterRequestBody wraps r.Body so uploaded bytes are counted. Bodiless
+// requests are left alone so the transport still sees http.NoBody.
+func meterRequestBody(r *http.Request, m *byteMeter) {
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = meteredBody{r.Body, m}
+	}
+}
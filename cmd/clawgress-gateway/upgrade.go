@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/sniff"
+)
+
+// upgradeProtocol returns the lowercased protocol an HTTP/1.1 Upgrade request
+// asks for (e.g. "websocket"), or "" if h does not request an upgrade.
+func upgradeProtocol(h http.Header) string {
+	for _, v := range h.Values("Connection") {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), "upgrade") {
+				proto, _, _ := strings.Cut(h.Get("Upgrade"), ",")
+				return strings.ToLower(strings.TrimSpace(proto))
+			}
+		}
+	}
+	return ""
+}
+
+// spliceUpgrade completes a 101 Switching Protocols exchange: the upstream
+// response is relayed to the agent, then both connections are spliced and
+// accounted like a CONNECT tunnel. The transport hands over the upgraded
+// upstream conn as the response body.
+func (h *proxyHandler) spliceUpgrade(w http.ResponseWriter, r *http.Request, resp *http.Response, t tunnel) {
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf("upgrade: agent=%s %s: upstream body is not writable", t.ag.AgentID, t.dest)
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer backConn.Close()
+
+	for k := range resp.Header {
+		if isClawgressHeader(k) {
+			delete(resp.Header, k)
+		}
+	}
+	setClawgressHeaders(resp.Header, t.reqID, t.dec.PolicyID)
+	agent, err := acceptUpgrade(w, r, resp)
+	if err != nil {
+		return
+	}
+	defer agent.Close()
+	pctx := connectContext(t.ag, requestAuthority(r), t.method)
+	pctx.Path, pctx.Protocol, pctx.Upgrade = t.path, sniff.ProtoHTTP, t.upgrade
+	t.flow = h.flows.Add(flow.Flow{
+		ID: t.reqID, AgentID: t.ag.AgentID, Destination: t.dest, Started: t.start,
+		Check: h.flowCheck(t.ag, &pctx),
+	}, agent, backConn)
+	defer t.flow.Done()
+
+	h.splice(agent, backConn, t, nil)
+}
+
+// acceptUpgrade relays the upstream's 101 to the agent and returns the
+// agent's end of the tunnel. Over HTTP/1.1 the 101 and its Upgrade headers
+// go out verbatim on the hijacked conn. An HTTP/2 extended CONNECT is
+// answered with 200 instead, without the HTTP/1.1-only headers.
+func acceptUpgrade(w http.ResponseWriter, r *http.Request, resp *http.Response) (net.Conn, error) {
+	if r.ProtoMajor == 2 {
+		resp.Header.Del("Connection")
+		resp.Header.Del("Upgrade")
+		resp.Header.Del("Sec-WebSocket-Accept")
+		copyResponseHeader(w.Header(), resp.Header)
+		return openStream(w, r)
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "500 Internal Server Error — hijack unsupported", http.StatusInternalServerError)
+		return nil, errors.New("hijack unsupported")
+	}
+	clientConn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = nil
+	if err := resp.Write(brw); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	// The agent may have sent frames right behind the request.
+	if brw.Reader.Buffered() > 0 {
+		return &bufferedConn{Conn: clientConn, r: brw.Reader}, nil
+	}
+	return clientConn, nil
+}
+
+// bufferedConn is a net.Conn whose reads drain r (which wraps the conn) first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
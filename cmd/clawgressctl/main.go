@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -19,6 +20,8 @@ import (
 	"time"
 
 	"github.com/bufordtjustice2918/crispy-garbanzo/internal/cmdmap"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/config"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/control"
 	"github.com/bufordtjustice2918/crispy-garbanzo/internal/identity"
 )
 
@@ -46,6 +49,8 @@ func main() {
 		}
 	case "token":
 		runToken(os.Args[2:])
+	case "gateway":
+		runGateway(os.Args[2:])
 	case "install":
 		runInstall(os.Args[2:])
 	default:
@@ -274,7 +279,7 @@ func runShowAudit(args []string) {
 	fs := flag.NewFlagSet("show audit", flag.ExitOnError)
 	apiURL := fs.String("url", "http://127.0.0.1:8080", "admin API base URL")
 	agentID := fs.String("agent", "", "filter by agent_id")
-	decision := fs.String("decision", "", "filter by decision (allow|deny)")
+	decision := fs.String("decision", "", "filter by decision (allow|deny|progress)")
 	since := fs.String("since", "", "filter events after RFC3339 timestamp")
 	limit := fs.Int("limit", 50, "max events to return (most recent)")
 	jsonOut := fs.Bool("json", false, "output raw JSON array")
@@ -372,6 +377,78 @@ func runToken(args []string) {
 	fmt.Println(token)
 }
 
+// runGateway talks to the local gateway over its control socket:
+// clawgressctl gateway <reload|status|flows|kill|drain> [--socket path] [--agent id] [--timeout 30s].
+func runGateway(args []string) {
+	const use = "usage: clawgressctl gateway <reload|status|flows|kill|drain> [--socket path] [--agent id] [--timeout d]"
+	if len(args) < 1 {
+		fatal(use)
+	}
+	op := args[0]
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	defSocket := config.Defaults().Gateway.ControlSocket
+	if v := os.Getenv("CLAWGRESS_CONTROL_SOCKET"); v != "" {
+		defSocket = v
+	}
+	socket := fs.String("socket", defSocket, "gateway control socket (default $CLAWGRESS_CONTROL_SOCKET)")
+	agent := fs.String("agent", "", "flows: only this agent's; kill: the agent whose flows to close (required)")
+	timeout := fs.Duration("timeout", 0, "drain: how long open flows may finish (0 = gateway's timeouts.drain_s)")
+	fs.Parse(args[1:])
+
+	gw := control.NewClient(*socket)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	switch op {
+	case "reload":
+		res, err := gw.Reload(ctx)
+		if err != nil {
+			fatalf("reload: %v", err)
+		}
+		prettyPrint(res)
+		if err := res.Err(); err != nil {
+			fatalf("reload failed: %v", err)
+		}
+	case "status":
+		st, err := gw.Status(ctx)
+		if err != nil {
+			fatalf("status: %v", err)
+		}
+		prettyPrint(st)
+	case "flows":
+		flows, err := gw.Flows(ctx)
+		if err != nil {
+			fatalf("flows: %v", err)
+		}
+		if *agent != "" {
+			mine := flows[:0]
+			for _, f := range flows {
+				if f.AgentID == *agent {
+					mine = append(mine, f)
+				}
+			}
+			flows = mine
+		}
+		prettyPrint(flows)
+	case "kill":
+		if *agent == "" {
+			fatal("usage: clawgressctl gateway kill --agent <id> [--socket path]")
+		}
+		res, err := gw.Kill(ctx, *agent)
+		if err != nil {
+			fatalf("kill: %v", err)
+		}
+		prettyPrint(res)
+	case "drain":
+		res, err := gw.Drain(ctx, *timeout)
+		if err != nil {
+			fatalf("drain: %v", err)
+		}
+		prettyPrint(res)
+	default:
+		fatal(use)
+	}
+}
+
 func runInstall(args []string) {
 	fs := flag.NewFlagSet("install", flag.ExitOnError)
 	targetDisk := fs.String("target-disk", "", "install target disk (example: /dev/sda)")
@@ -701,7 +778,7 @@ func prettyPrint(v any) {
 }
 
 func usage() {
-	fmt.Println("clawgressctl <configure|commit|state|set|show|install> [flags]")
+	fmt.Println("clawgressctl <configure|commit|state|set|show|token|gateway|install> [flags]")
 }
 
 func fatal(msg string) {
@@ -78,3 +78,57 @@ func TestLogContinuesAfterPartialFailure(t *testing.T) {
 		t.Fatalf("expected 2 events after recovery, got %d", len(events))
 	}
 }
+
+// TestLogReopensAfterWriteFailure verifies the log reports a failed write
+// through Err and recovers on the next write by reopening its file.
+func TestLogReopensAfterWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+
+	l, err := NewLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Break the descriptor underneath the log, as a lost mount would.
+	l.f.Close()
+	if err := l.Write(Event{RequestID: "r1", Decision: "allow"}); err == nil {
+		t.Fatal("expected write error")
+	}
+	if l.Err() == nil {
+		t.Fatal("Err should report the failed write")
+	}
+
+	if err := l.Write(Event{RequestID: "r2", Decision: "allow"}); err != nil {
+		t.Fatalf("write after reopen: %v", err)
+	}
+	if l.Err() != nil {
+		t.Fatalf("Err after recovery: %v", l.Err())
+	}
+	events, _ := Query(path, Filter{})
+	if len(events) != 1 || events[0].RequestID != "r2" {
+		t.Fatalf("want only r2 in the log, got %+v", events)
+	}
+}
+
+// TestLogReopenFollowsRotation verifies Reopen starts a new file after the
+// old one was renamed away.
+func TestLogReopenFollowsRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+
+	l, _ := NewLog(path)
+	defer l.Close()
+	l.Write(Event{RequestID: "r1", Decision: "allow"})
+	os.Rename(path, path+".1")
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.Write(Event{RequestID: "r2", Decision: "allow"})
+
+	events, _ := Query(path, Filter{})
+	if len(events) != 1 || events[0].RequestID != "r2" {
+		t.Fatalf("want only r2 in the new file, got %+v", events)
+	}
+}
@@ -9,28 +9,60 @@ import (
 	"time"
 )
 
-// Event is one decision record written per proxy request.
+// Event is one decision record written per proxy request. Long-lived tunnels
+// also emit interim events with Decision "progress" carrying running totals.
+// An allowed exchange aborted by a policy body limit is recorded with Decision
+// "limit-exceeded" and the Limit it broke.
 type Event struct {
-	Timestamp   string `json:"timestamp"`
-	RequestID   string `json:"request_id"`
-	AgentID     string `json:"agent_id"`
-	TeamID      string `json:"team_id"`
-	ProjectID   string `json:"project_id"`
-	Environment string `json:"environment"`
-	Destination string `json:"destination"`
-	Method      string `json:"http_method"`
-	Decision    string `json:"decision"`
-	PolicyID    string `json:"policy_id"`
-	LatencyMs   int64  `json:"latency_ms"`
-	BytesOut    int64  `json:"bytes_out"`
+	Timestamp       string `json:"timestamp"`
+	RequestID       string `json:"request_id"`
+	AgentID         string `json:"agent_id"`
+	TeamID          string `json:"team_id"`
+	ProjectID       string `json:"project_id"`
+	Environment     string `json:"environment"`
+	Destination     string `json:"destination"`
+	Method          string `json:"http_method"`
+	Decision        string `json:"decision"`
+	PolicyID        string `json:"policy_id"`
+	LatencyMs       int64  `json:"latency_ms"`
+	BytesOut        int64  `json:"bytes_out"`                  // client → upstream
+	BytesIn         int64  `json:"bytes_in"`                   // upstream → client
+	Path            string `json:"path,omitempty"`             // inner request path (plain HTTP and inspected TLS)
+	Inspected       bool   `json:"inspected,omitempty"`        // request was seen through TLS interception
+	SNI             string `json:"sni,omitempty"`              // TLS ClientHello server name seen in the tunnel
+	SNIMismatch     bool   `json:"sni_mismatch,omitempty"`     // SNI differs from the CONNECT authority
+	DurationMs      int64  `json:"duration_ms,omitempty"`      // tunnel lifetime so far (CONNECT, transparent)
+	CloseReason     string `json:"close_reason,omitempty"`     // why a tunnel ended, e.g. client_closed, shutdown
+	Route           string `json:"route,omitempty"`            // egress route taken: direct, http://parent:port, socks5://parent:port
+	ResolvedIP      string `json:"resolved_ip,omitempty"`      // vetted upstream IP dialed on a direct route
+	EgressIP        string `json:"egress_ip,omitempty"`        // gateway address the upstream conn left from
+	Upgrade         string `json:"upgrade,omitempty"`          // protocol of an HTTP Upgrade tunnel, e.g. websocket
+	Limit           string `json:"limit,omitempty"`            // body limit that aborted a "limit-exceeded" exchange
+	ContentType     string `json:"content_type,omitempty"`     // response media type refused by a content-type limit
+	ClientIP        string `json:"client_ip,omitempty"`        // client address; behind a trusted load balancer, from its PROXY header
+	CertFingerprint string `json:"cert_fingerprint,omitempty"` // SHA-256 of the client certificate (TLS proxy listener)
+	TraceID         string `json:"trace_id,omitempty"`         // W3C trace forwarded upstream (plain and inspected HTTP)
+	SpanID          string `json:"span_id,omitempty"`          // the gateway's span in that trace
+	ParentSpanID    string `json:"parent_span_id,omitempty"`   // the agent's span, if it sent a traceparent
 }
 
+// ReopenInterval is how often a failing Log reopens its file, at most.
+const ReopenInterval = time.Second
+
 // Log is an append-only JSONL file. One line per Event.
 // All methods are safe for concurrent use.
+//
+// A failed write leaves the log unhealthy (see Err). The next write reopens
+// the file first, and again at most every ReopenInterval while writes keep
+// failing, so a removed file, a remounted filesystem or freed disk space
+// recovers without a restart.
 type Log struct {
-	mu   sync.Mutex
-	path string
-	f    *os.File
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	err     error     // last write failure; nil while healthy
+	retryAt time.Time // earliest reopen while unhealthy
+	closed  bool
 }
 
 // NewLog opens (or creates) the JSONL file at path, creating parent directories as needed.
@@ -38,11 +70,19 @@ func NewLog(path string) (*Log, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return nil, fmt.Errorf("create audit log dir: %w", err)
 	}
+	f, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, f: f}, nil
+}
+
+func openLog(path string) (*os.File, error) {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
 	if err != nil {
 		return nil, fmt.Errorf("open audit log %s: %w", path, err)
 	}
-	return &Log{path: path, f: f}, nil
+	return f, nil
 }
 
 // Write appends a single JSON line to the log.
@@ -55,13 +95,57 @@ func (l *Log) Write(e Event) error {
 	if err != nil {
 		return fmt.Errorf("marshal audit event: %w", err)
 	}
+	data = append(data, '\n')
+
 	l.mu.Lock()
-	_, err = fmt.Fprintf(l.f, "%s\n", data)
-	l.mu.Unlock()
-	return err
+	defer l.mu.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	if now := time.Now(); l.err != nil && !now.Before(l.retryAt) {
+		l.retryAt = now.Add(ReopenInterval)
+		// On failure keep the old file; the write below reports why.
+		l.reopen()
+	}
+	if _, err := l.f.Write(data); err != nil {
+		l.err = fmt.Errorf("write audit log %s: %w", l.path, err)
+		return l.err
+	}
+	l.err = nil
+	return nil
+}
+
+// Err returns the error of the last write, or nil if it succeeded.
+func (l *Log) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Reopen closes and reopens the file, e.g. after it was rotated.
+func (l *Log) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	return l.reopen()
+}
+
+func (l *Log) reopen() error {
+	f, err := openLog(l.path)
+	if err != nil {
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	return nil
 }
 
 // Close flushes and closes the underlying file.
 func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
 	return l.f.Close()
 }
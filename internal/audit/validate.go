@@ -10,7 +10,9 @@ func Validate(e Event) error {
 	if e.Decision == "" {
 		return fmt.Errorf("missing decision")
 	}
-	if e.Decision != "allow" && e.Decision != "deny" && e.Decision != "allow-upstream-error" {
+	switch e.Decision {
+	case "allow", "deny", "allow-upstream-error", "limit-exceeded", "progress":
+	default:
 		return fmt.Errorf("invalid decision: %q", e.Decision)
 	}
 	if e.PolicyID == "" {
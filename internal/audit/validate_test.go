@@ -46,3 +46,33 @@ func TestValidateBadDecision(t *testing.T) {
 		t.Fatal("invalid decision should fail")
 	}
 }
+
+func TestValidateProgress(t *testing.T) {
+	e := Event{
+		RequestID:   "r1",
+		Decision:    "progress",
+		PolicyID:    "p1",
+		Destination: "example.com:443",
+		Method:      "CONNECT",
+		BytesOut:    10,
+		BytesIn:     2048,
+		DurationMs:  60000,
+	}
+	if err := Validate(e); err != nil {
+		t.Fatalf("progress event rejected: %v", err)
+	}
+}
+
+func TestValidateLimitExceeded(t *testing.T) {
+	e := Event{
+		RequestID:   "r1",
+		Decision:    "limit-exceeded",
+		PolicyID:    "p1",
+		Destination: "files.example.com",
+		Method:      "GET",
+		Limit:       "response_body",
+	}
+	if err := Validate(e); err != nil {
+		t.Fatalf("limit-exceeded event rejected: %v", err)
+	}
+}
@@ -2,12 +2,15 @@
 //
 // Configuration is loaded from a JSON file. Unknown fields are rejected.
 // All fields have sane defaults — a missing config file starts with defaults.
+// LoadWithEnv layers CLAWGRESS_* environment variables over the file; see
+// env.go for the mapping.
 package config
 
 import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -16,6 +19,12 @@ type Config struct {
 	Gateway  GatewayConfig  `json:"gateway"`
 	AdminAPI AdminAPIConfig `json:"admin_api"`
 	Files    FilesConfig    `json:"files"`
+	JWT      JWTConfig      `json:"jwt"`
+	Metrics  MetricsConfig  `json:"metrics"`
+	TLS      TLSConfig      `json:"tls"`
+	RPZ      RPZConfig      `json:"rpz"`
+	OpsMode  OpsModeConfig  `json:"ops_mode"`
+	Timeouts TimeoutsConfig `json:"timeouts"`
 }
 
 // GatewayConfig controls the proxy listener.
@@ -23,22 +32,114 @@ type GatewayConfig struct {
 	Listen       string `json:"listen"`         // default ":3128"
 	ReadTimeout  int    `json:"read_timeout_s"` // seconds, default 60
 	WriteTimeout int    `json:"write_timeout_s"`
+
+	SOCKSListen     string              `json:"socks_listen"`         // default "" (SOCKS5 disabled)
+	Transparent     bool                `json:"transparent"`          // accept nft-redirected 80/443 traffic
+	SNIMismatch     string              `json:"sni_mismatch"`         // deny | audit | off, default "deny"
+	AuditFailure    string              `json:"audit_failure"`        // alert_only | fail_closed, default "alert_only"
+	RequestIDHeader string              `json:"request_id_header"`    // header carrying the request ID upstream, e.g. "X-Request-Id"; default "" = not sent
+	SSRFDenyCIDRs   []string            `json:"ssrf_deny_cidrs"`      // default empty = built-in list; ["none"] = off
+	ProxyProtocol   []string            `json:"proxy_protocol_cidrs"` // load balancers whose PROXY v1/v2 headers are trusted; default empty = off
+	TLSListen       string              `json:"tls_listen"`           // HTTPS proxy listener requiring client certificates, e.g. ":3130"; default "" = off
+	HTTP2           bool                `json:"http2"`                // serve HTTP/2 to agents: h2 by ALPN on tls_listen, prior-knowledge h2c on listen; default true
+	ControlSocket   string              `json:"control_socket"`       // unix socket of the local control API, also used by the admin API; default "/run/clawgress/gateway.sock", "" = off
+	TLS             ProxyTLSConfig      `json:"tls"`
+	Inspect         InspectConfig       `json:"inspect"`
+	Upstream        UpstreamConfig      `json:"upstream"`
+	DenyTemplates   DenyTemplatesConfig `json:"deny_templates"`
+}
+
+// DenyTemplatesConfig names operator-supplied templates for the body of
+// deny responses to clients that do not ask for JSON. Empty keeps the
+// built-in page.
+type DenyTemplatesConfig struct {
+	Text string `json:"text"` // text/template file for plain-text clients
+	HTML string `json:"html"` // html/template file for browsers
+}
+
+// ProxyTLSConfig is the certificate setup of the gateway's TLS listener.
+// Clients must present a certificate signed by ClientCA that CRL, when set,
+// does not revoke.
+type ProxyTLSConfig struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"client_ca"`
+	CRL      string `json:"crl"` // PEM or DER revocation list issued by ClientCA; default "" = no revocation check
+}
+
+// InspectConfig controls TLS inspection of CONNECT tunnels.
+type InspectConfig struct {
+	CACert string   `json:"ca_cert"` // default "" (inspection disabled)
+	CAKey  string   `json:"ca_key"`  // default "/var/lib/clawgress/inspect-ca.key"
+	Bypass []string `json:"bypass"`  // domain patterns never intercepted
+}
+
+// UpstreamConfig tunes the pooled upstream transport. Zero keeps the
+// transport's own default.
+type UpstreamConfig struct {
+	MaxIdle         int  `json:"max_idle"`
+	MaxIdlePerHost  int  `json:"max_idle_per_host"`
+	MaxConnsPerHost int  `json:"max_conns_per_host"` // 0 = unlimited
+	H2C             bool `json:"h2c"`
 }
 
 // AdminAPIConfig controls the admin API listener.
 type AdminAPIConfig struct {
-	Listen   string `json:"listen"`    // default ":8080"
-	UIPath   string `json:"ui_path"`   // default "/ui/"
-	StateDir string `json:"state_dir"` // default "/var/lib/clawgress/state"
+	Listen           string `json:"listen"`             // default ":8080"
+	UIPath           string `json:"ui_path"`            // default "/ui/"
+	StateDir         string `json:"state_dir"`          // default "/var/lib/clawgress/state"
+	PolicySignSecret string `json:"policy_sign_secret"` // HMAC key for policy bundles
+}
+
+// JWTConfig controls Bearer-token identity on the gateway.
+type JWTConfig struct {
+	Secret string `json:"secret"` // default "" (JWT identity disabled)
+}
+
+// MetricsConfig controls the gateway's Prometheus listener. The admin API
+// serves /metrics on its own listener.
+type MetricsConfig struct {
+	Listen string `json:"listen"` // default ":9128", "" = disabled
+}
+
+// TLSConfig enables HTTPS on the admin API. With ClientCA set, clients must
+// present a certificate signed by it.
+type TLSConfig struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"client_ca"`
+}
+
+// RPZConfig controls the DNS response-policy zone the admin API generates.
+type RPZConfig struct {
+	ZonePath string `json:"zone_path"` // default "/etc/bind/db.rpz.clawgress"
+	ZoneName string `json:"zone_name"` // default "rpz.clawgress.local"
+}
+
+// OpsModeConfig controls how committed opmode changes are applied.
+type OpsModeConfig struct {
+	Default  string `json:"default"`   // dry-run | apply, default "dry-run"
+	NftApply bool   `json:"nft_apply"` // default true
+}
+
+// TimeoutsConfig holds gateway intervals and deadlines, in seconds.
+type TimeoutsConfig struct {
+	Drain                  int `json:"drain_s"`                    // default 30
+	ProgressInterval       int `json:"progress_interval_s"`        // default 60, 0 = off
+	UpstreamIdle           int `json:"upstream_idle_s"`            // default 0 = transport default (90)
+	UpstreamHealthInterval int `json:"upstream_health_interval_s"` // default 10
+	TunnelIdle             int `json:"tunnel_idle_s"`              // close tunnels idle this long; default 0 = never
+	TunnelMax              int `json:"tunnel_max_s"`               // close tunnels open this long; default 0 = never
 }
 
 // FilesConfig specifies paths for data files.
 type FilesConfig struct {
-	Agents string `json:"agents"` // default "/etc/clawgress/agents.json"
-	Policy string `json:"policy"` // default "/etc/clawgress/policy.json"
-	Quotas string `json:"quotas"` // default "/etc/clawgress/quotas.json"
-	Audit  string `json:"audit"`  // default "/var/log/clawgress/audit.jsonl"
-	SQLite string `json:"sqlite"` // default "" (empty = file-only mode)
+	Agents  string `json:"agents"`  // default "/etc/clawgress/agents.json"
+	Policy  string `json:"policy"`  // default "/etc/clawgress/policy.json"
+	Quotas  string `json:"quotas"`  // default "/etc/clawgress/quotas.json"
+	Secrets string `json:"secrets"` // default "/etc/clawgress/secrets.json"; brokered upstream credentials
+	Audit   string `json:"audit"`   // default "/var/log/clawgress/audit.jsonl"
+	SQLite  string `json:"sqlite"`  // default "" (empty = file-only mode)
 }
 
 // Defaults returns a Config with all default values.
@@ -48,6 +149,13 @@ func Defaults() Config {
 			Listen:       ":3128",
 			ReadTimeout:  60,
 			WriteTimeout: 0,
+			SNIMismatch:  "deny",
+			AuditFailure: "alert_only",
+			HTTP2:        true,
+			Inspect: InspectConfig{
+				CAKey: "/var/lib/clawgress/inspect-ca.key",
+			},
+			ControlSocket: "/run/clawgress/gateway.sock",
 		},
 		AdminAPI: AdminAPIConfig{
 			Listen:   ":8080",
@@ -55,16 +163,60 @@ func Defaults() Config {
 			StateDir: "/var/lib/clawgress/state",
 		},
 		Files: FilesConfig{
-			Agents: "/etc/clawgress/agents.json",
-			Policy: "/etc/clawgress/policy.json",
-			Quotas: "/etc/clawgress/quotas.json",
-			Audit:  "/var/log/clawgress/audit.jsonl",
+			Agents:  "/etc/clawgress/agents.json",
+			Policy:  "/etc/clawgress/policy.json",
+			Quotas:  "/etc/clawgress/quotas.json",
+			Secrets: "/etc/clawgress/secrets.json",
+			Audit:   "/var/log/clawgress/audit.jsonl",
+		},
+		Metrics: MetricsConfig{
+			Listen: ":9128",
+		},
+		RPZ: RPZConfig{
+			ZonePath: "/etc/bind/db.rpz.clawgress",
+			ZoneName: "rpz.clawgress.local",
+		},
+		OpsMode: OpsModeConfig{
+			Default:  "dry-run",
+			NftApply: true,
+		},
+		Timeouts: TimeoutsConfig{
+			Drain:                  30,
+			ProgressInterval:       60,
+			UpstreamHealthInterval: 10,
 		},
 	}
 }
 
 // Load reads and validates a config file. Returns defaults if the file doesn't exist.
 func Load(path string) (Config, error) {
+	return LoadWithEnv(path, nil)
+}
+
+// LoadWithEnv reads a config file like Load, then applies CLAWGRESS_*
+// overrides found by lookup (normally os.LookupEnv) before validating. A nil
+// lookup applies no overrides.
+func LoadWithEnv(path string, lookup func(string) (string, bool)) (Config, error) {
+	cfg, err := decode(path)
+	if err != nil {
+		return cfg, err
+	}
+	if lookup != nil {
+		if err := applyEnv(&cfg, lookup); err != nil {
+			return cfg, err
+		}
+	}
+	if err := validate(cfg); err != nil {
+		if path == "" {
+			return cfg, fmt.Errorf("validate config: %w", err)
+		}
+		return cfg, fmt.Errorf("validate config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// decode reads path over the defaults without validating.
+func decode(path string) (Config, error) {
 	cfg := Defaults()
 	if path == "" {
 		return cfg, nil
@@ -84,11 +236,6 @@ func Load(path string) (Config, error) {
 	if err := dec.Decode(&cfg); err != nil {
 		return cfg, fmt.Errorf("parse config %s: %w", path, err)
 	}
-
-	if err := validate(cfg); err != nil {
-		return cfg, fmt.Errorf("validate config %s: %w", path, err)
-	}
-
 	return cfg, nil
 }
 
@@ -114,5 +261,62 @@ func validate(cfg Config) error {
 	if cfg.Files.Audit == "" {
 		return fmt.Errorf("files.audit must not be empty")
 	}
+	switch cfg.Gateway.SNIMismatch {
+	case "deny", "audit", "off":
+	default:
+		return fmt.Errorf("gateway.sni_mismatch must be deny, audit or off")
+	}
+	if name := cfg.Gateway.RequestIDHeader; name != "" && !validToken(name) {
+		return fmt.Errorf("gateway.request_id_header %q is not a valid header name", name)
+	}
+	switch cfg.Gateway.AuditFailure {
+	case "alert_only", "fail_closed":
+	default:
+		return fmt.Errorf("gateway.audit_failure must be alert_only or fail_closed")
+	}
+	up := cfg.Gateway.Upstream
+	if up.MaxIdle < 0 || up.MaxIdlePerHost < 0 || up.MaxConnsPerHost < 0 {
+		return fmt.Errorf("gateway.upstream limits must be >= 0")
+	}
+	if s := cfg.Gateway.ControlSocket; s != "" && !filepath.IsAbs(s) {
+		return fmt.Errorf("gateway.control_socket must be an absolute path")
+	}
+	if pt := cfg.Gateway.TLS; cfg.Gateway.TLSListen != "" && (pt.Cert == "" || pt.Key == "" || pt.ClientCA == "") {
+		return fmt.Errorf("gateway.tls_listen requires gateway.tls.cert, key and client_ca")
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		return fmt.Errorf("tls.cert and tls.key must be set together")
+	}
+	if cfg.TLS.ClientCA != "" && cfg.TLS.Cert == "" {
+		return fmt.Errorf("tls.client_ca requires tls.cert and tls.key")
+	}
+	switch cfg.OpsMode.Default {
+	case "dry-run", "apply":
+	default:
+		return fmt.Errorf("ops_mode.default must be dry-run or apply")
+	}
+	t := cfg.Timeouts
+	if t.Drain < 0 || t.ProgressInterval < 0 || t.UpstreamIdle < 0 || t.TunnelIdle < 0 || t.TunnelMax < 0 {
+		return fmt.Errorf("timeouts must be >= 0")
+	}
+	if t.UpstreamHealthInterval <= 0 {
+		return fmt.Errorf("timeouts.upstream_health_interval_s must be > 0")
+	}
 	return nil
 }
+
+// validToken reports whether s is an RFC 9110 token, as header names are.
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -17,6 +17,9 @@ func TestDefaults(t *testing.T) {
 	if cfg.Files.Agents != "/etc/clawgress/agents.json" {
 		t.Fatalf("want default agents path, got %s", cfg.Files.Agents)
 	}
+	if !cfg.Gateway.HTTP2 {
+		t.Fatal("HTTP/2 should be on by default")
+	}
 }
 
 func TestLoadMissing(t *testing.T) {
@@ -78,3 +81,100 @@ func TestValidationEmpty(t *testing.T) {
 		t.Fatal("empty listen should fail validation")
 	}
 }
+
+func TestLoadWithEnvOverridesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{
+		"gateway": {"listen": ":9999", "sni_mismatch": "audit"},
+		"jwt": {"secret": "from-file"},
+		"timeouts": {"drain_s": 10}
+	}`), 0o644)
+
+	env := map[string]string{
+		"CLAWGRESS_PROXY_LISTEN":      ":4128",
+		"CLAWGRESS_DRAIN_TIMEOUT":     "45s",
+		"CLAWGRESS_INSPECT_BYPASS":    "*.apple.com, ,pinned.example",
+		"CLAWGRESS_OPS_MODE":          "DryRun",
+		"CLAWGRESS_NFT_APPLY":         "false",
+		"CLAWGRESS_PROXY_HTTP2":       "false",
+		"CLAWGRESS_JWT_SECRET":        "", // empty leaves the file value
+		"CLAWGRESS_PROGRESS_INTERVAL": "0",
+	}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+
+	cfg, err := LoadWithEnv(path, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Gateway.Listen != ":4128" {
+		t.Fatalf("env should override file listen, got %s", cfg.Gateway.Listen)
+	}
+	if cfg.Gateway.SNIMismatch != "audit" {
+		t.Fatalf("file value should survive without env, got %s", cfg.Gateway.SNIMismatch)
+	}
+	if cfg.JWT.Secret != "from-file" {
+		t.Fatalf("empty env should not override, got %q", cfg.JWT.Secret)
+	}
+	if cfg.Timeouts.Drain != 45 || cfg.Timeouts.ProgressInterval != 0 {
+		t.Fatalf("timeouts: drain=%d progress=%d", cfg.Timeouts.Drain, cfg.Timeouts.ProgressInterval)
+	}
+	if len(cfg.Gateway.Inspect.Bypass) != 2 || cfg.Gateway.Inspect.Bypass[1] != "pinned.example" {
+		t.Fatalf("bypass list: %v", cfg.Gateway.Inspect.Bypass)
+	}
+	if cfg.OpsMode.Default != "dry-run" || cfg.OpsMode.NftApply {
+		t.Fatalf("ops mode: %+v", cfg.OpsMode)
+	}
+	if cfg.Gateway.HTTP2 {
+		t.Fatal("CLAWGRESS_PROXY_HTTP2=false should turn HTTP/2 off")
+	}
+}
+
+func TestLoadWithEnvRejectsBadValues(t *testing.T) {
+	for k, v := range map[string]string{
+		"CLAWGRESS_TRANSPARENT":       "maybe",
+		"CLAWGRESS_UPSTREAM_MAX_IDLE": "lots",
+		"CLAWGRESS_DRAIN_TIMEOUT":     "1500ms",
+		"CLAWGRESS_SNI_MISMATCH":      "block",
+	} {
+		lookup := func(key string) (string, bool) {
+			if key == k {
+				return v, true
+			}
+			return "", false
+		}
+		if _, err := LoadWithEnv("", lookup); err == nil {
+			t.Fatalf("%s=%s should be rejected", k, v)
+		}
+	}
+}
+
+func TestChanged(t *testing.T) {
+	a := Defaults()
+	b := Defaults()
+	if got := Changed(a, b); len(got) != 0 {
+		t.Fatalf("identical configs: %v", got)
+	}
+	b.Gateway.Inspect.Bypass = []string{}
+	if got := Changed(a, b); len(got) != 0 {
+		t.Fatalf("nil and empty lists should compare equal: %v", got)
+	}
+
+	b.Gateway.Listen = ":4128"
+	b.Gateway.Inspect.Bypass = []string{"*.apple.com"}
+	b.JWT.Secret = "s3cret"
+	b.Timeouts.Drain = 5
+	want := []string{"gateway.listen", "gateway.inspect.bypass", "jwt.secret", "timeouts.drain_s"}
+	got := Changed(a, b)
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
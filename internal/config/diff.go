@@ -0,0 +1,37 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Changed returns the dotted JSON names of the settings that differ between
+// a and b, e.g. "gateway.listen" or "timeouts.drain_s". Values are never
+// returned, so the result is safe to log even when secrets changed.
+func Changed(a, b Config) []string {
+	var out []string
+	changed(reflect.ValueOf(a), reflect.ValueOf(b), "", &out)
+	return out
+}
+
+func changed(a, b reflect.Value, prefix string, out *[]string) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct {
+			changed(fa, fb, name, out)
+			continue
+		}
+		// An empty list and a missing one mean the same thing.
+		if fa.Kind() == reflect.Slice && fa.Len() == 0 && fb.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			*out = append(*out, name)
+		}
+	}
+}
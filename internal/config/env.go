@@ -0,0 +1,161 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envVar maps one CLAWGRESS_* variable onto a Config field.
+type envVar struct {
+	name string
+	set  func(c *Config, v string) error
+}
+
+// envVars lists every environment override, in the order they are applied.
+// A variable that is unset or empty leaves the file value alone.
+var envVars = []envVar{
+	// Gateway
+	{"CLAWGRESS_PROXY_LISTEN", envString(func(c *Config) *string { return &c.Gateway.Listen })},
+	{"CLAWGRESS_SOCKS_LISTEN", envString(func(c *Config) *string { return &c.Gateway.SOCKSListen })},
+	{"CLAWGRESS_TRANSPARENT", envBool(func(c *Config) *bool { return &c.Gateway.Transparent })},
+	{"CLAWGRESS_SNI_MISMATCH", envString(func(c *Config) *string { return &c.Gateway.SNIMismatch })},
+	{"CLAWGRESS_AUDIT_FAILURE", envString(func(c *Config) *string { return &c.Gateway.AuditFailure })},
+	{"CLAWGRESS_REQUEST_ID_HEADER", envString(func(c *Config) *string { return &c.Gateway.RequestIDHeader })},
+	{"CLAWGRESS_SSRF_DENY_CIDRS", envList(func(c *Config) *[]string { return &c.Gateway.SSRFDenyCIDRs })},
+	{"CLAWGRESS_PROXY_TLS_LISTEN", envString(func(c *Config) *string { return &c.Gateway.TLSListen })},
+	{"CLAWGRESS_PROXY_HTTP2", envBool(func(c *Config) *bool { return &c.Gateway.HTTP2 })},
+	{"CLAWGRESS_PROXY_TLS_CERT", envString(func(c *Config) *string { return &c.Gateway.TLS.Cert })},
+	{"CLAWGRESS_PROXY_TLS_KEY", envString(func(c *Config) *string { return &c.Gateway.TLS.Key })},
+	{"CLAWGRESS_PROXY_TLS_CA", envString(func(c *Config) *string { return &c.Gateway.TLS.ClientCA })},
+	{"CLAWGRESS_PROXY_TLS_CRL", envString(func(c *Config) *string { return &c.Gateway.TLS.CRL })},
+	{"CLAWGRESS_CONTROL_SOCKET", envString(func(c *Config) *string { return &c.Gateway.ControlSocket })},
+	{"CLAWGRESS_PROXY_PROTOCOL_CIDRS", envList(func(c *Config) *[]string { return &c.Gateway.ProxyProtocol })},
+	{"CLAWGRESS_INSPECT_CA_CERT", envString(func(c *Config) *string { return &c.Gateway.Inspect.CACert })},
+	{"CLAWGRESS_INSPECT_CA_KEY", envString(func(c *Config) *string { return &c.Gateway.Inspect.CAKey })},
+	{"CLAWGRESS_INSPECT_BYPASS", envList(func(c *Config) *[]string { return &c.Gateway.Inspect.Bypass })},
+	{"CLAWGRESS_UPSTREAM_MAX_IDLE", envInt(func(c *Config) *int { return &c.Gateway.Upstream.MaxIdle })},
+	{"CLAWGRESS_UPSTREAM_MAX_IDLE_PER_HOST", envInt(func(c *Config) *int { return &c.Gateway.Upstream.MaxIdlePerHost })},
+	{"CLAWGRESS_UPSTREAM_MAX_CONNS_PER_HOST", envInt(func(c *Config) *int { return &c.Gateway.Upstream.MaxConnsPerHost })},
+	{"CLAWGRESS_UPSTREAM_H2C", envBool(func(c *Config) *bool { return &c.Gateway.Upstream.H2C })},
+	{"CLAWGRESS_DENY_TEMPLATE_TEXT", envString(func(c *Config) *string { return &c.Gateway.DenyTemplates.Text })},
+	{"CLAWGRESS_DENY_TEMPLATE_HTML", envString(func(c *Config) *string { return &c.Gateway.DenyTemplates.HTML })},
+
+	// Admin API
+	{"CLAWGRESS_ADMIN_LISTEN", envString(func(c *Config) *string { return &c.AdminAPI.Listen })},
+	{"CLAWGRESS_STATE_DIR", envString(func(c *Config) *string { return &c.AdminAPI.StateDir })},
+	{"CLAWGRESS_POLICY_SIGN_SECRET", envString(func(c *Config) *string { return &c.AdminAPI.PolicySignSecret })},
+
+	// Files
+	{"CLAWGRESS_AGENTS_FILE", envString(func(c *Config) *string { return &c.Files.Agents })},
+	{"CLAWGRESS_POLICY_FILE", envString(func(c *Config) *string { return &c.Files.Policy })},
+	{"CLAWGRESS_QUOTA_FILE", envString(func(c *Config) *string { return &c.Files.Quotas })},
+	{"CLAWGRESS_SECRETS_FILE", envString(func(c *Config) *string { return &c.Files.Secrets })},
+	{"CLAWGRESS_AUDIT_FILE", envString(func(c *Config) *string { return &c.Files.Audit })},
+
+	{"CLAWGRESS_JWT_SECRET", envString(func(c *Config) *string { return &c.JWT.Secret })},
+	{"CLAWGRESS_METRICS_LISTEN", envString(func(c *Config) *string { return &c.Metrics.Listen })},
+
+	{"CLAWGRESS_TLS_CERT", envString(func(c *Config) *string { return &c.TLS.Cert })},
+	{"CLAWGRESS_TLS_KEY", envString(func(c *Config) *string { return &c.TLS.Key })},
+	{"CLAWGRESS_TLS_CA", envString(func(c *Config) *string { return &c.TLS.ClientCA })},
+
+	{"CLAWGRESS_RPZ_ZONE_PATH", envString(func(c *Config) *string { return &c.RPZ.ZonePath })},
+	{"CLAWGRESS_RPZ_ZONE_NAME", envString(func(c *Config) *string { return &c.RPZ.ZoneName })},
+
+	{"CLAWGRESS_OPS_MODE", func(c *Config, v string) error {
+		// Accept the spellings the admin API always has.
+		switch m := strings.ToLower(strings.TrimSpace(v)); m {
+		case "dryrun", "dry-run":
+			c.OpsMode.Default = "dry-run"
+		default:
+			c.OpsMode.Default = m
+		}
+		return nil
+	}},
+	{"CLAWGRESS_NFT_APPLY", envBool(func(c *Config) *bool { return &c.OpsMode.NftApply })},
+
+	// Timeouts take Go durations ("30s") or bare seconds.
+	{"CLAWGRESS_DRAIN_TIMEOUT", envSeconds(func(c *Config) *int { return &c.Timeouts.Drain })},
+	{"CLAWGRESS_PROGRESS_INTERVAL", envSeconds(func(c *Config) *int { return &c.Timeouts.ProgressInterval })},
+	{"CLAWGRESS_UPSTREAM_IDLE_TIMEOUT", envSeconds(func(c *Config) *int { return &c.Timeouts.UpstreamIdle })},
+	{"CLAWGRESS_UPSTREAM_HEALTH_INTERVAL", envSeconds(func(c *Config) *int { return &c.Timeouts.UpstreamHealthInterval })},
+	{"CLAWGRESS_TUNNEL_IDLE_TIMEOUT", envSeconds(func(c *Config) *int { return &c.Timeouts.TunnelIdle })},
+	{"CLAWGRESS_TUNNEL_MAX_DURATION", envSeconds(func(c *Config) *int { return &c.Timeouts.TunnelMax })},
+}
+
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	for _, e := range envVars {
+		v, ok := lookup(e.name)
+		if !ok || v == "" {
+			continue
+		}
+		if err := e.set(cfg, v); err != nil {
+			return fmt.Errorf("%s: %w", e.name, err)
+		}
+	}
+	return nil
+}
+
+func envString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func envBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func envInt(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// envList parses a comma-separated list, dropping empty entries.
+func envList(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		var out []string
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				out = append(out, f)
+			}
+		}
+		*field(c) = out
+		return nil
+	}
+}
+
+// envSeconds parses a duration ("90s", "2m") or a whole number of seconds.
+func envSeconds(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		if n, err := strconv.Atoi(v); err == nil {
+			*field(c) = n
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		if d%time.Second != 0 {
+			return fmt.Errorf("duration %q is not a whole number of seconds", v)
+		}
+		*field(c) = int(d / time.Second)
+		return nil
+	}
+}
@@ -100,6 +100,17 @@ func TestConfigMatrixRejectsInvalid(t *testing.T) {
 		{"empty policy path", `{"files":{"policy":""}}`},
 		{"empty audit path", `{"files":{"audit":""}}`},
 		{"negative read timeout", `{"gateway":{"read_timeout_s":-1}}`},
+		{"bad sni mismatch mode", `{"gateway":{"sni_mismatch":"block"}}`},
+		{"bad audit failure mode", `{"gateway":{"audit_failure":"fail_open"}}`},
+		{"bad request id header", `{"gateway":{"request_id_header":"X Request Id"}}`},
+		{"relative control socket", `{"gateway":{"control_socket":"gateway.sock"}}`},
+		{"negative upstream limit", `{"gateway":{"upstream":{"max_idle":-1}}}`},
+		{"tls cert without key", `{"tls":{"cert":"/tmp/c.pem"}}`},
+		{"proxy tls listener without client ca", `{"gateway":{"tls_listen":":3130","tls":{"cert":"/tmp/c.pem","key":"/tmp/k.pem"}}}`},
+		{"tls client ca without cert", `{"tls":{"client_ca":"/tmp/ca.pem"}}`},
+		{"bad ops mode", `{"ops_mode":{"default":"yolo"}}`},
+		{"negative drain timeout", `{"timeouts":{"drain_s":-1}}`},
+		{"zero health interval", `{"timeouts":{"upstream_health_interval_s":0}}`},
 	}
 
 	for _, tc := range cases {
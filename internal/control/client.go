@@ -0,0 +1,113 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+)
+
+// Client calls the control API over the gateway's socket.
+type Client struct {
+	path string
+	hc   *http.Client
+}
+
+// NewClient returns a client for the socket at path. Nothing is dialed
+// until a call is made.
+func NewClient(path string) *Client {
+	return &Client{
+		path: path,
+		hc: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Reload asks the gateway to reload its state. A nil error means the
+// gateway answered; check the result's Err for failed components.
+func (c *Client) Reload(ctx context.Context) (ReloadResult, error) {
+	var res ReloadResult
+	err := c.call(ctx, http.MethodPost, "/v1/reload", nil, &res)
+	return res, err
+}
+
+// Status returns the gateway's status.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var st Status
+	err := c.call(ctx, http.MethodGet, "/v1/status", nil, &st)
+	return st, err
+}
+
+// Flows lists the gateway's open flows, oldest first.
+func (c *Client) Flows(ctx context.Context) ([]flow.Flow, error) {
+	var flows []flow.Flow
+	err := c.call(ctx, http.MethodGet, "/v1/flows", nil, &flows)
+	return flows, err
+}
+
+// Kill closes every open flow of agentID.
+func (c *Client) Kill(ctx context.Context, agentID string) (KillResult, error) {
+	var res KillResult
+	err := c.call(ctx, http.MethodPost, "/v1/flows/kill", killRequest{AgentID: agentID}, &res)
+	return res, err
+}
+
+// Drain starts a graceful shutdown of the gateway. timeout 0 uses the
+// gateway's configured drain timeout.
+func (c *Client) Drain(ctx context.Context, timeout time.Duration) (DrainResult, error) {
+	var res DrainResult
+	err := c.call(ctx, http.MethodPost, "/v1/drain", drainRequest{TimeoutS: int(timeout / time.Second)}, &res)
+	return res, err
+}
+
+// call sends body (if non-nil) as JSON and decodes a 2xx answer into out.
+func (c *Client) call(ctx context.Context, method, path string, body, out any) error {
+	if c.path == "" {
+		return ErrNoSocket
+	}
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://gateway"+path, rd)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("gateway control socket %s: %w", c.path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		return fmt.Errorf("gateway %s %s: %s", method, path, e.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("gateway %s %s: decode response: %w", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Package control is the gateway's local control API: JSON over HTTP on a
+// unix socket, for reloading state, reading status, listing and killing open
+// flows, and draining. The gateway serves it with NewHandler on a Listen socket; the
+// admin API and clawgressctl talk to it through Client.
+//
+// Access is governed by the socket's file permissions, so the API carries no
+// authentication of its own.
+package control
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+)
+
+// Component is the outcome of reloading one part of the gateway's state.
+type Component struct {
+	Name  string `json:"name"`            // config | audit | identity | policy | quotas | secrets | crl
+	Error string `json:"error,omitempty"` // empty = reloaded; otherwise the old state stays in force
+}
+
+// ReloadResult reports a reload component by component.
+type ReloadResult struct {
+	Components []Component `json:"components"`
+	// RestartRequired names changed config settings that only take effect
+	// on restart.
+	RestartRequired []string `json:"restart_required,omitempty"`
+	// Revoked lists the open flows the reloaded identity and policy no
+	// longer permit; the gateway closed them.
+	Revoked []flow.Flow `json:"revoked,omitempty"`
+}
+
+// Err joins the failed components' errors, or returns nil if all reloaded.
+func (r ReloadResult) Err() error {
+	var errs []error
+	for _, c := range r.Components {
+		if c.Error != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", c.Name, c.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Status is a snapshot of the running gateway.
+type Status struct {
+	PID       int       `json:"pid"`
+	Started   time.Time `json:"started"`
+	Flows     int       `json:"flows"`      // open tunnels and hijacked connections
+	Draining  bool      `json:"draining"`   // shutting down; no new connections accepted
+	AuditSink string    `json:"audit_sink"` // ok | failing, as of the last write
+	Agents    int       `json:"agents"`
+	Rules     int       `json:"rules"`
+	Quotas    int       `json:"quotas"`
+
+	// LastReload is when the last reload finished, and LastReloadError its
+	// joined component errors; both are empty before the first reload.
+	LastReload      *time.Time `json:"last_reload,omitempty"`
+	LastReloadError string     `json:"last_reload_error,omitempty"`
+}
+
+// DrainResult acknowledges a drain request. The gateway stops accepting
+// connections, waits up to Timeout for open flows to finish, force-closes
+// the rest and exits.
+type DrainResult struct {
+	Flows   int    `json:"flows"`   // open when the drain began
+	Timeout string `json:"timeout"` // e.g. "30s"
+}
+
+// KillResult lists the flows a kill closed.
+type KillResult struct {
+	Killed []flow.Flow `json:"killed"`
+}
+
+// killRequest is the body of POST /v1/flows/kill.
+type killRequest struct {
+	AgentID string `json:"agent_id"`
+}
+
+// drainRequest is the body of POST /v1/drain.
+type drainRequest struct {
+	TimeoutS int `json:"timeout_s"` // 0 = the gateway's timeouts.drain_s
+}
+
+// Gateway is what the control API operates on.
+type Gateway interface {
+	Reload() ReloadResult
+	Status() Status
+	Flows() []flow.Flow
+	// Kill closes every open flow of agentID.
+	Kill(agentID string) KillResult
+	// Drain starts a graceful shutdown; timeout 0 means the configured
+	// drain timeout. It returns ErrDraining if one is already under way.
+	Drain(timeout time.Duration) (DrainResult, error)
+}
+
+// ErrDraining is returned by Drain while a drain is already in progress.
+var ErrDraining = errors.New("gateway is already draining")
+
+// ErrNoSocket is returned by Client calls when no socket path is configured.
+var ErrNoSocket = errors.New("gateway control socket not configured (gateway.control_socket)")
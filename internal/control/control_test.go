@@ -0,0 +1,158 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/flow"
+)
+
+type fakeGateway struct {
+	drained  time.Duration
+	draining bool
+	killed   string
+}
+
+func (f *fakeGateway) Reload() ReloadResult {
+	return ReloadResult{
+		Components:      []Component{{Name: "identity"}, {Name: "policy", Error: "parse policy: bad"}},
+		RestartRequired: []string{"gateway.listen"},
+	}
+}
+
+func (f *fakeGateway) Status() Status {
+	return Status{PID: 42, Flows: 1, AuditSink: "ok"}
+}
+
+func (f *fakeGateway) Flows() []flow.Flow {
+	return []flow.Flow{{ID: "r1", AgentID: "a1", Destination: "example.com:443"}}
+}
+
+func (f *fakeGateway) Kill(agentID string) KillResult {
+	f.killed = agentID
+	return KillResult{Killed: []flow.Flow{{ID: "r1", AgentID: agentID}}}
+}
+
+func (f *fakeGateway) Drain(timeout time.Duration) (DrainResult, error) {
+	if f.draining {
+		return DrainResult{}, ErrDraining
+	}
+	f.draining, f.drained = true, timeout
+	return DrainResult{Flows: 1, Timeout: timeout.String()}, nil
+}
+
+// serve starts the control API for g on a socket in a temp dir.
+func serve(t *testing.T, g Gateway) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "run", "gateway.sock")
+	ln, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: NewHandler(g)}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return path
+}
+
+func TestClientServer(t *testing.T) {
+	g := &fakeGateway{}
+	c := NewClient(serve(t, g))
+	ctx := context.Background()
+
+	res, err := c.Reload(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Components) != 2 || res.RestartRequired[0] != "gateway.listen" {
+		t.Fatalf("reload result: %+v", res)
+	}
+	if err := res.Err(); err == nil || !strings.Contains(err.Error(), "policy: parse policy: bad") {
+		t.Fatalf("reload error: %v", err)
+	}
+
+	st, err := c.Status(ctx)
+	if err != nil || st.PID != 42 || st.AuditSink != "ok" {
+		t.Fatalf("status %+v, %v", st, err)
+	}
+
+	flows, err := c.Flows(ctx)
+	if err != nil || len(flows) != 1 || flows[0].AgentID != "a1" {
+		t.Fatalf("flows %+v, %v", flows, err)
+	}
+
+	kr, err := c.Kill(ctx, "a1")
+	if err != nil || len(kr.Killed) != 1 || g.killed != "a1" {
+		t.Fatalf("kill %+v, %v (gateway got %q)", kr, err, g.killed)
+	}
+	if _, err := c.Kill(ctx, ""); err == nil || !strings.Contains(err.Error(), "agent_id is required") {
+		t.Fatalf("kill without agent: %v", err)
+	}
+
+	dr, err := c.Drain(ctx, 5*time.Second)
+	if err != nil || dr.Flows != 1 || g.drained != 5*time.Second {
+		t.Fatalf("drain %+v, %v (gateway got %s)", dr, err, g.drained)
+	}
+	if _, err := c.Drain(ctx, 0); err == nil || !strings.Contains(err.Error(), ErrDraining.Error()) {
+		t.Fatalf("second drain: %v", err)
+	}
+}
+
+func TestReloadResultErr(t *testing.T) {
+	if err := (ReloadResult{Components: []Component{{Name: "config"}}}).Err(); err != nil {
+		t.Fatalf("clean reload: %v", err)
+	}
+}
+
+func TestClientNoGateway(t *testing.T) {
+	c := NewClient(filepath.Join(t.TempDir(), "missing.sock"))
+	_, err := c.Status(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "missing.sock") {
+		t.Fatalf("want error naming the socket, got %v", err)
+	}
+	if _, err := NewClient("").Reload(context.Background()); !errors.Is(err, ErrNoSocket) {
+		t.Fatalf("empty path: want ErrNoSocket, got %v", err)
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	path := serve(t, &fakeGateway{})
+
+	// A live socket is not taken over.
+	if _, err := Listen(path); err == nil {
+		t.Fatal("expected error for a socket in use")
+	}
+
+	// A stale one is.
+	stale := filepath.Join(t.TempDir(), "stale.sock")
+	ln, err := Listen(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul, ok := ln.(interface{ SetUnlinkOnClose(bool) }); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	ln.Close()
+	ln, err = Listen(stale)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	ln.Close()
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0o660 {
+		t.Fatalf("socket mode %v, %v", fi.Mode(), err)
+	}
+
+	// Anything else is left alone.
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o644)
+	if _, err := Listen(file); err == nil {
+		t.Fatal("expected error for a regular file")
+	}
+}
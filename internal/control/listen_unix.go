@@ -0,0 +1,49 @@
+//go:build unix
+
+package control
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// listenUnix binds the socket inside a fresh 0700 directory next to path,
+// sets its mode to 0660 there, and only then renames it into place, so it
+// is never reachable by other users. Unlike narrowing the umask this does
+// not touch process-wide state other goroutines depend on.
+func listenUnix(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// Close must unlink path, not the temporary name.
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unlinkListener{UnixListener: ln, path: path}, nil
+}
+
+// unlinkListener removes the renamed socket when closed.
+type unlinkListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unlinkListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
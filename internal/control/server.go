@@ -0,0 +1,106 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Listen creates the control socket at path, creating its directory and
+// replacing a socket left behind by an earlier run. The socket is
+// accessible to its owner and group only, from the moment it exists.
+// Listen refuses to replace a path that is not a socket, or a socket
+// another process is still serving.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("control socket dir: %w", err)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("control socket %s: exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("control socket %s: in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := listenUnix(path)
+	if err != nil {
+		return nil, fmt.Errorf("control socket: %w", err)
+	}
+	return ln, nil
+}
+
+// NewHandler returns the control API for g:
+//
+//	POST /v1/reload  reload state from disk          → ReloadResult
+//	GET  /v1/status  gateway status                  → Status
+//	GET  /v1/flows   open flows, oldest first        → []flow.Flow
+//	POST /v1/flows/kill {"agent_id": "..."}; close its flows → KillResult
+//	POST /v1/drain   {"timeout_s": N}; drain and exit → DrainResult (409 if already draining)
+//
+// Errors are answered as {"error": "..."}.
+func NewHandler(g Gateway) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/reload", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, g.Reload())
+	})
+	mux.HandleFunc("GET /v1/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, g.Status())
+	})
+	mux.HandleFunc("GET /v1/flows", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, g.Flows())
+	})
+	mux.HandleFunc("POST /v1/flows/kill", func(w http.ResponseWriter, r *http.Request) {
+		var req killRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.AgentID == "" {
+			writeError(w, http.StatusBadRequest, "agent_id is required")
+			return
+		}
+		writeJSON(w, http.StatusOK, g.Kill(req.AgentID))
+	})
+	mux.HandleFunc("POST /v1/drain", func(w http.ResponseWriter, r *http.Request) {
+		var req drainRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+		}
+		if req.TimeoutS < 0 {
+			writeError(w, http.StatusBadRequest, "timeout_s must not be negative")
+			return
+		}
+		res, err := g.Drain(time.Duration(req.TimeoutS) * time.Second)
+		if errors.Is(err, ErrDraining) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, res)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
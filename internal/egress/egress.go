@@ -0,0 +1,326 @@
+// Package egress chooses the local address upstream connections leave the
+// gateway from, and dials dual-stack destinations with happy eyeballs
+// (RFC 8305): the preferred address family gets a head start and the other
+// family is raced against it if it is slow or fails.
+//
+// Agents and policy rules carry a Source. Providers that allowlist traffic
+// by source IP then see a fixed address per team, agent or destination.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Address families for Source.Family.
+const (
+	FamilyIPv4       = "ipv4"        // IPv4 destinations only
+	FamilyIPv6       = "ipv6"        // IPv6 destinations only
+	FamilyPreferIPv4 = "prefer_ipv4" // both, IPv4 first
+	FamilyPreferIPv6 = "prefer_ipv6" // both, IPv6 first
+)
+
+// DefaultFallbackDelay is how long the preferred family is tried alone
+// before the other family is raced against it.
+const DefaultFallbackDelay = 300 * time.Millisecond
+
+// Source selects where upstream connections are dialed from. The zero
+// Source lets the kernel pick the address and dials both families in
+// resolver order. It is embedded in agents and rules, so it has no methods
+// that would be promoted onto them.
+type Source struct {
+	Address   string `json:"egress_address,omitempty"`   // local IP to bind, e.g. 203.0.113.10
+	Interface string `json:"egress_interface,omitempty"` // bind this interface's address of the dialed family
+	Family    string `json:"address_family,omitempty"`   // ipv4 | ipv6 | prefer_ipv4 | prefer_ipv6; empty = resolver order
+}
+
+// Validate checks that s names at most one of an address and an interface,
+// that the address is an IP literal, and that the family is known and does
+// not contradict the address.
+func Validate(s Source) error {
+	if s.Address != "" && s.Interface != "" {
+		return errors.New("egress_address and egress_interface are mutually exclusive")
+	}
+	if s.Address != "" {
+		a, err := netip.ParseAddr(s.Address)
+		if err != nil || a.Zone() != "" {
+			return fmt.Errorf("egress_address %q: must be an IP address", s.Address)
+		}
+		a = a.Unmap()
+		if (s.Family == FamilyIPv4 && !a.Is4()) || (s.Family == FamilyIPv6 && !a.Is6()) {
+			return fmt.Errorf("egress_address %s cannot dial address_family %s", s.Address, s.Family)
+		}
+	}
+	if s.Interface != "" && (len(s.Interface) > 15 || strings.ContainsAny(s.Interface, "/ \t")) {
+		return fmt.Errorf("egress_interface %q: invalid interface name", s.Interface)
+	}
+	switch s.Family {
+	case "", FamilyIPv4, FamilyIPv6, FamilyPreferIPv4, FamilyPreferIPv6:
+	default:
+		return fmt.Errorf("address_family must be %q, %q, %q or %q", FamilyIPv4, FamilyIPv6, FamilyPreferIPv4, FamilyPreferIPv6)
+	}
+	return nil
+}
+
+// Select combines an agent's Source with the matched rule's. The rule's
+// address or interface, if it names one, replaces the agent's, and so does
+// its family.
+func Select(agent, rule Source) Source {
+	s := agent
+	if rule.Address != "" || rule.Interface != "" {
+		s.Address, s.Interface = rule.Address, rule.Interface
+	}
+	if rule.Family != "" {
+		s.Family = rule.Family
+	}
+	return s
+}
+
+// Dialer dials TCP connections from a Source. All methods are safe for
+// concurrent use.
+type Dialer struct {
+	Dialer        net.Dialer    // timeouts and keep-alive; LocalAddr is set per attempt
+	FallbackDelay time.Duration // 0 = DefaultFallbackDelay
+	Source        Source
+
+	// interfaceAddrs lists an interface's addresses; nil = the system's.
+	interfaceAddrs func(name string) ([]netip.Addr, error)
+}
+
+// DialContext resolves addr (host:port) and dials it with DialAddrs.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	if a, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{a}
+	} else if ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+	return d.DialAddrs(ctx, network, ips, port)
+}
+
+// DialAddrs dials port on one of ips, which must already be vetted. Only
+// addresses of a family the source can dial from are tried. Those of the
+// preferred family go first, one after another; the other family starts
+// after the fallback delay, or as soon as the preferred family runs out of
+// addresses, and the first connection to succeed wins.
+func (d *Dialer) DialAddrs(ctx context.Context, network string, ips []netip.Addr, port string) (net.Conn, error) {
+	first, second, firstLocal, secondLocal, err := d.plan(ips)
+	if err != nil {
+		return nil, err
+	}
+	if len(second) == 0 {
+		return d.dialSerial(ctx, network, firstLocal, first, port)
+	}
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2)
+	race := func(local netip.Addr, addrs []netip.Addr) {
+		c, err := d.dialSerial(ctx, network, local, addrs, port)
+		results <- result{c, err}
+	}
+	go race(firstLocal, first)
+
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = DefaultFallbackDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	pending, fellBack := 1, false
+	for pending > 0 {
+		select {
+		case <-timer.C:
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close whatever the other family connects meanwhile.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}
+				}(pending)
+				return res.c, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+		}
+		if !fellBack {
+			fellBack = true
+			pending++
+			go race(secondLocal, second)
+		}
+	}
+	return nil, firstErr
+}
+
+// Pick returns the address of ips to send datagrams to and the local
+// address to send them from, following the same family rules as DialAddrs
+// without a race: the first address of the preferred family wins. An
+// unspecified local address leaves the choice to the kernel.
+func (d *Dialer) Pick(ips []netip.Addr) (local, remote netip.Addr, err error) {
+	first, _, firstLocal, _, err := d.plan(ips)
+	if err != nil {
+		return local, remote, err
+	}
+	return firstLocal, first[0], nil
+}
+
+// plan splits ips into the preferred family's addresses and the other's,
+// each with the local address to bind, dropping those the source cannot
+// dial. first is never empty.
+func (d *Dialer) plan(ips []netip.Addr) (first, second []netip.Addr, firstLocal, secondLocal netip.Addr, err error) {
+	local4, local6, err := d.locals()
+	if err != nil {
+		return nil, nil, firstLocal, secondLocal, err
+	}
+	var v4, v6 []netip.Addr
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if ip.Is4() && local4.IsValid() && d.Source.Family != FamilyIPv6 {
+			v4 = append(v4, ip)
+		} else if ip.Is6() && local6.IsValid() && d.Source.Family != FamilyIPv4 {
+			v6 = append(v6, ip)
+		}
+	}
+	if len(v4)+len(v6) == 0 {
+		return nil, nil, firstLocal, secondLocal, fmt.Errorf("egress: no address of %s can be dialed from %s", addrList(ips), describe(d.Source))
+	}
+
+	first, second = v4, v6
+	firstLocal, secondLocal = local4, local6
+	if d.Source.Family == FamilyPreferIPv6 || (d.Source.Family == "" && ips[0].Unmap().Is6()) {
+		first, second = v6, v4
+		firstLocal, secondLocal = local6, local4
+	}
+	if len(first) == 0 {
+		first, firstLocal, second = second, secondLocal, nil
+	}
+	return first, second, firstLocal, secondLocal, nil
+}
+
+// dialSerial dials addrs in order from local until one connects. An
+// unspecified local address leaves the choice to the kernel.
+func (d *Dialer) dialSerial(ctx context.Context, network string, local netip.Addr, addrs []netip.Addr, port string) (net.Conn, error) {
+	dialer := d.Dialer
+	if !local.IsUnspecified() {
+		dialer.LocalAddr = &net.TCPAddr{IP: local.AsSlice()}
+	}
+	var firstErr error
+	for _, ip := range addrs {
+		c, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// locals returns the address to bind for each family; an invalid Addr means
+// the family cannot be dialed. Without an address or interface both
+// families are dialable from the unspecified address.
+func (d *Dialer) locals() (v4, v6 netip.Addr, err error) {
+	switch {
+	case d.Source.Address != "":
+		a, err := netip.ParseAddr(d.Source.Address)
+		if err != nil {
+			return v4, v6, fmt.Errorf("egress_address: %w", err)
+		}
+		if a = a.Unmap(); a.Is4() {
+			return a, v6, nil
+		}
+		return v4, a, nil
+	case d.Source.Interface != "":
+		lookup := d.interfaceAddrs
+		if lookup == nil {
+			lookup = interfaceAddrs
+		}
+		addrs, err := lookup(d.Source.Interface)
+		if err != nil {
+			return v4, v6, fmt.Errorf("egress_interface %s: %w", d.Source.Interface, err)
+		}
+		for _, a := range addrs {
+			switch a = a.Unmap(); {
+			case a.IsLinkLocalUnicast(): // needs a zone; not routable anyway
+			case a.Is4() && !v4.IsValid():
+				v4 = a
+			case a.Is6() && !v6.IsValid():
+				v6 = a
+			}
+		}
+		if !v4.IsValid() && !v6.IsValid() {
+			return v4, v6, fmt.Errorf("egress_interface %s: no usable address", d.Source.Interface)
+		}
+		return v4, v6, nil
+	}
+	return netip.IPv4Unspecified(), netip.IPv6Unspecified(), nil
+}
+
+// interfaceAddrs lists the addresses configured on the named interface.
+func interfaceAddrs(name string) ([]netip.Addr, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var out []netip.Addr
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipn.IP); ok {
+				out = append(out, ip.Unmap())
+			}
+		}
+	}
+	return out, nil
+}
+
+// describe names s for errors, e.g. "203.0.113.10" or "interface eth1 (ipv6)".
+func describe(s Source) string {
+	var desc string
+	switch {
+	case s.Address != "":
+		desc = s.Address
+	case s.Interface != "":
+		desc = "interface " + s.Interface
+	default:
+		desc = "any address"
+	}
+	if s.Family != "" {
+		desc += " (" + s.Family + ")"
+	}
+	return desc
+}
+
+func addrList(ips []netip.Addr) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
@@ -0,0 +1,189 @@
+package egress
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		s   Source
+		err string
+	}{
+		{Source{}, ""},
+		{Source{Address: "203.0.113.10", Family: FamilyPreferIPv4}, ""},
+		{Source{Address: "2001:db8::10", Family: FamilyIPv6}, ""},
+		{Source{Interface: "eth1", Family: FamilyPreferIPv6}, ""},
+		{Source{Address: "203.0.113.10", Interface: "eth1"}, "mutually exclusive"},
+		{Source{Address: "egress.example.com"}, "must be an IP address"},
+		{Source{Address: "fe80::1%eth0"}, "must be an IP address"},
+		{Source{Address: "203.0.113.10", Family: FamilyIPv6}, "cannot dial address_family ipv6"},
+		{Source{Interface: "eth1/2"}, "invalid interface name"},
+		{Source{Interface: "averyveryverylongname"}, "invalid interface name"},
+		{Source{Family: "ipv5"}, "address_family must be"},
+	} {
+		err := Validate(tc.s)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: want %q, got %v", tc.s, tc.err, err)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	agent := Source{Address: "203.0.113.10", Family: FamilyPreferIPv4}
+	if got := Select(agent, Source{}); got != agent {
+		t.Fatalf("no rule source: %+v", got)
+	}
+	got := Select(agent, Source{Interface: "eth2"})
+	if got != (Source{Interface: "eth2", Family: FamilyPreferIPv4}) {
+		t.Fatalf("rule interface: %+v", got)
+	}
+	got = Select(agent, Source{Family: FamilyIPv4})
+	if got != (Source{Address: "203.0.113.10", Family: FamilyIPv4}) {
+		t.Fatalf("rule family: %+v", got)
+	}
+}
+
+// listen accepts and holds connections on a loopback address.
+func listen(t *testing.T, network, addr string) (port string) {
+	t.Helper()
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("listen %s: %v", addr, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	_, port, _ = net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestDialBindsSource(t *testing.T) {
+	port := listen(t, "tcp4", "127.0.0.1:0")
+	d := &Dialer{Source: Source{Address: "127.0.0.2"}}
+	c, err := d.DialAddrs(context.Background(), "tcp", []netip.Addr{netip.MustParseAddr("127.0.0.1")}, port)
+	if err != nil {
+		t.Skipf("cannot bind 127.0.0.2 here: %v", err)
+	}
+	defer c.Close()
+	if got := c.LocalAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.2" {
+		t.Fatalf("want local 127.0.0.2, got %s", got)
+	}
+
+	// An IPv4 source cannot reach an IPv6-only destination.
+	_, err = d.DialAddrs(context.Background(), "tcp", []netip.Addr{netip.MustParseAddr("::1")}, port)
+	if err == nil || !strings.Contains(err.Error(), "can be dialed from 127.0.0.2") {
+		t.Fatalf("want family mismatch error, got %v", err)
+	}
+}
+
+func TestDialInterface(t *testing.T) {
+	port := listen(t, "tcp4", "127.0.0.1:0")
+	d := &Dialer{Source: Source{Interface: "test0"}}
+	d.interfaceAddrs = func(name string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("fe80::1"), netip.MustParseAddr("127.0.0.3")}, nil
+	}
+	c, err := d.DialAddrs(context.Background(), "tcp", []netip.Addr{netip.MustParseAddr("127.0.0.1")}, port)
+	if err != nil {
+		t.Skipf("cannot bind 127.0.0.3 here: %v", err)
+	}
+	defer c.Close()
+	if got := c.LocalAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.3" {
+		t.Fatalf("want interface address 127.0.0.3, got %s", got)
+	}
+
+	d.interfaceAddrs = func(string) ([]netip.Addr, error) { return []netip.Addr{netip.MustParseAddr("fe80::1")}, nil }
+	if _, err := d.DialAddrs(context.Background(), "tcp", []netip.Addr{netip.MustParseAddr("127.0.0.1")}, port); err == nil ||
+		!strings.Contains(err.Error(), "no usable address") {
+		t.Fatalf("want no usable address, got %v", err)
+	}
+}
+
+func TestDialFamilies(t *testing.T) {
+	port := listen(t, "tcp4", "127.0.0.1:0")
+	v4, v6 := netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")
+	ctx := context.Background()
+
+	// IPv6 first in resolver order but refused: IPv4 is tried at once,
+	// without waiting out the fallback delay.
+	d := &Dialer{FallbackDelay: time.Minute}
+	start := time.Now()
+	c, err := d.DialAddrs(ctx, "tcp", []netip.Addr{v6, v4}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("fallback waited %s", time.Since(start))
+	}
+
+	// ipv6 only never tries the IPv4 address.
+	d = &Dialer{Source: Source{Family: FamilyIPv6}}
+	if c, err := d.DialAddrs(ctx, "tcp", []netip.Addr{v6, v4}, port); err == nil {
+		c.Close()
+		t.Fatal("ipv6-only dial reached the IPv4 listener")
+	}
+	d = &Dialer{Source: Source{Family: FamilyIPv6}}
+	if _, err := d.DialAddrs(ctx, "tcp", []netip.Addr{v4}, port); err == nil || !strings.Contains(err.Error(), "(ipv6)") {
+		t.Fatalf("want no dialable address, got %v", err)
+	}
+}
+
+func TestDialRacesSlowFamily(t *testing.T) {
+	port := listen(t, "tcp4", "127.0.0.1:0")
+	// A preferred IPv6 attempt that hangs: the IPv4 race wins after the delay.
+	d := &Dialer{Source: Source{Family: FamilyPreferIPv6}, FallbackDelay: 20 * time.Millisecond}
+	d.Dialer.Timeout = 5 * time.Second
+	hang := netip.MustParseAddr("2001:db8::1") // documentation prefix; never answers
+	start := time.Now()
+	c, err := d.DialAddrs(context.Background(), "tcp", []netip.Addr{netip.MustParseAddr("127.0.0.1"), hang}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.RemoteAddr().(*net.TCPAddr).IP.To4() == nil {
+		t.Fatalf("want the IPv4 address, got %s", c.RemoteAddr())
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("race took %s", time.Since(start))
+	}
+}
+
+func TestPick(t *testing.T) {
+	v4, v6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+	cases := []struct {
+		src           Source
+		local, remote string
+	}{
+		{Source{}, "::", "2001:db8::1"}, // resolver order
+		{Source{Family: FamilyPreferIPv4}, "0.0.0.0", "192.0.2.1"},
+		{Source{Address: "198.51.100.7"}, "198.51.100.7", "192.0.2.1"},
+		{Source{Interface: "test0", Family: FamilyPreferIPv6}, "2001:db8:1::3", "2001:db8::1"},
+	}
+	for _, tc := range cases {
+		d := &Dialer{Source: tc.src}
+		d.interfaceAddrs = func(string) ([]netip.Addr, error) {
+			return []netip.Addr{netip.MustParseAddr("203.0.113.3"), netip.MustParseAddr("2001:db8:1::3")}, nil
+		}
+		local, remote, err := d.Pick([]netip.Addr{v6, v4})
+		if err != nil || local.String() != tc.local || remote.String() != tc.remote {
+			t.Errorf("%+v: got %s -> %s, %v", tc.src, local, remote, err)
+		}
+	}
+
+	d := &Dialer{Source: Source{Family: FamilyIPv6}}
+	if _, _, err := d.Pick([]netip.Addr{v4}); err == nil {
+		t.Fatal("ipv6-only source picked an IPv4 destination")
+	}
+}
@@ -0,0 +1,258 @@
+// Package flow tracks long-lived client flows — CONNECT tunnels, inspected
+// TLS sessions and transparent connections — that http.Server no longer sees
+// once they are hijacked, so the gateway can drain and force-close them, and
+// close those that identity or policy changes no longer permit.
+package flow
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	cgmetrics "github.com/bufordtjustice2918/crispy-garbanzo/internal/metrics"
+)
+
+// Flow describes one tracked flow.
+type Flow struct {
+	ID          string    `json:"id"` // request ID of the flow's audit event
+	AgentID     string    `json:"agent_id"`
+	Destination string    `json:"destination"`
+	Started     time.Time `json:"started"`
+
+	// Check reports whether the flow is still permitted; Revoke closes flows
+	// whose Check fails. nil = never revoked.
+	Check func() bool `json:"-"`
+
+	conns  []io.Closer
+	handle *Handle
+}
+
+// Tracker is the set of open flows. The zero value is not usable; call NewTracker.
+type Tracker struct {
+	mu      sync.Mutex
+	next    uint64
+	flows   map[uint64]*Flow
+	closing string        // CloseAll reason; non-empty once force-closing
+	changed chan struct{} // closed and replaced whenever a flow is removed
+}
+
+// NewTracker returns an empty tracker.
+func NewTracker() *Tracker {
+	return &Tracker{flows: make(map[uint64]*Flow), changed: make(chan struct{})}
+}
+
+// Add registers f together with the conns that must be closed to end it.
+// The owner calls Done on the returned Handle once the flow has fully
+// finished (including its audit write). If CloseAll has already run, conns
+// are closed immediately so late flows cannot outlive a forced shutdown.
+func (t *Tracker) Add(f Flow, conns ...io.Closer) *Handle {
+	f.conns = conns
+	hd := &Handle{t: t}
+	t.mu.Lock()
+	if t.closing != "" {
+		reason := t.closing
+		t.mu.Unlock()
+		hd.setReason(reason)
+		hd.done = true
+		closeAll(conns)
+		return hd
+	}
+	hd.id = t.next
+	t.next++
+	f.handle = hd
+	t.flows[hd.id] = &f
+	t.mu.Unlock()
+	cgmetrics.ActiveTunnels.Inc()
+	return hd
+}
+
+// Handle is the owner's reference to a tracked flow.
+type Handle struct {
+	t  *Tracker
+	id uint64
+
+	mu     sync.Mutex
+	reason string
+	done   bool
+}
+
+// Done unregisters the flow. It is safe to call more than once.
+func (hd *Handle) Done() {
+	hd.mu.Lock()
+	if hd.done {
+		hd.mu.Unlock()
+		return
+	}
+	hd.done = true
+	hd.mu.Unlock()
+
+	t := hd.t
+	t.mu.Lock()
+	delete(t.flows, hd.id)
+	close(t.changed)
+	t.changed = make(chan struct{})
+	t.mu.Unlock()
+	cgmetrics.ActiveTunnels.Dec()
+}
+
+// SetCheck replaces the flow's Check, for owners that learn what governs the
+// flow only after adding it.
+func (hd *Handle) SetCheck(check func() bool) {
+	t := hd.t
+	t.mu.Lock()
+	if f := t.flows[hd.id]; f != nil && f.handle == hd {
+		f.Check = check
+	}
+	t.mu.Unlock()
+}
+
+// CloseReason reports why the tracker closed the flow, or "" if it ended on its own.
+func (hd *Handle) CloseReason() string {
+	hd.mu.Lock()
+	defer hd.mu.Unlock()
+	return hd.reason
+}
+
+func (hd *Handle) setReason(reason string) {
+	hd.mu.Lock()
+	if hd.reason == "" {
+		hd.reason = reason
+	}
+	hd.mu.Unlock()
+}
+
+// Len returns the number of open flows.
+func (t *Tracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
+
+// All returns a snapshot of open flows, oldest first.
+func (t *Tracker) All() []Flow {
+	t.mu.Lock()
+	out := make([]Flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		out = append(out, f.snapshot())
+	}
+	t.mu.Unlock()
+	sortFlows(out)
+	return out
+}
+
+// Revoke closes every open flow whose Check now fails, recording reason as
+// its CloseReason, and returns them oldest first. Checks run without the
+// tracker's lock held, so they may take as long as they need.
+func (t *Tracker) Revoke(reason string) []Flow {
+	type checked struct {
+		f     *Flow
+		check func() bool
+	}
+	t.mu.Lock()
+	open := make([]checked, 0, len(t.flows))
+	for _, f := range t.flows {
+		if f.Check != nil {
+			open = append(open, checked{f, f.Check})
+		}
+	}
+	t.mu.Unlock()
+
+	var denied []*Flow
+	for _, c := range open {
+		if !c.check() {
+			denied = append(denied, c.f)
+		}
+	}
+	return t.closeFlows(denied, reason)
+}
+
+// CloseAgent closes every open flow of agentID, recording reason as its
+// CloseReason, and returns them oldest first.
+func (t *Tracker) CloseAgent(agentID, reason string) []Flow {
+	t.mu.Lock()
+	var match []*Flow
+	for _, f := range t.flows {
+		if f.AgentID == agentID {
+			match = append(match, f)
+		}
+	}
+	t.mu.Unlock()
+	return t.closeFlows(match, reason)
+}
+
+// closeFlows closes those of fs that are still open. Like CloseAll, it
+// leaves them registered until their owners call Done.
+func (t *Tracker) closeFlows(fs []*Flow, reason string) []Flow {
+	var (
+		conns  []io.Closer
+		closed []Flow
+	)
+	t.mu.Lock()
+	for _, f := range fs {
+		if t.flows[f.handle.id] != f {
+			continue // finished meanwhile
+		}
+		f.handle.setReason(reason)
+		conns = append(conns, f.conns...)
+		closed = append(closed, f.snapshot())
+	}
+	t.mu.Unlock()
+	closeAll(conns)
+	sortFlows(closed)
+	return closed
+}
+
+// snapshot copies f without its conns, handle and check.
+func (f *Flow) snapshot() Flow {
+	c := *f
+	c.conns, c.handle, c.Check = nil, nil, nil
+	return c
+}
+
+func sortFlows(fs []Flow) {
+	sort.Slice(fs, func(i, j int) bool { return fs[i].Started.Before(fs[j].Started) })
+}
+
+// CloseAll closes the conns of every open flow, and of any flow added later,
+// recording reason as each flow's CloseReason. Flows stay registered until
+// their owners call Done, so Wait can still be used to let them finish
+// writing audit events. It returns the number of flows that were closed.
+func (t *Tracker) CloseAll(reason string) int {
+	t.mu.Lock()
+	t.closing = reason
+	var conns []io.Closer
+	for _, f := range t.flows {
+		f.handle.setReason(reason)
+		conns = append(conns, f.conns...)
+	}
+	n := len(t.flows)
+	t.mu.Unlock()
+	closeAll(conns)
+	return n
+}
+
+// Wait blocks until no flows are open or ctx is done.
+func (t *Tracker) Wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		if len(t.flows) == 0 {
+			t.mu.Unlock()
+			return nil
+		}
+		ch := t.changed
+		t.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func closeAll(conns []io.Closer) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
@@ -0,0 +1,149 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWaitReturnsWhenFlowsFinish(t *testing.T) {
+	tr := NewTracker()
+	hd := tr.Add(Flow{ID: "r1", AgentID: "a1", Destination: "example.com:443", Started: time.Now()})
+	if tr.Len() != 1 {
+		t.Fatalf("want 1 flow, got %d", tr.Len())
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- tr.Wait(context.Background()) }()
+	select {
+	case <-errc:
+		t.Fatal("Wait returned with a flow still open")
+	case <-time.After(20 * time.Millisecond):
+	}
+	hd.Done()
+	hd.Done() // idempotent
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitHonoursDeadline(t *testing.T) {
+	tr := NewTracker()
+	defer tr.Add(Flow{ID: "r1"}).Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tr.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+}
+
+func TestCloseAllClosesConns(t *testing.T) {
+	tr := NewTracker()
+	client, server := net.Pipe()
+	hd := tr.Add(Flow{ID: "r1"}, client)
+
+	// Simulate the flow owner: unblock on close, then unregister.
+	go func() {
+		buf := make([]byte, 1)
+		client.Read(buf)
+		hd.Done()
+	}()
+
+	if n := tr.CloseAll("shutdown"); n != 1 {
+		t.Fatalf("want 1 closed flow, got %d", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tr.Wait(ctx); err != nil {
+		t.Fatalf("closed flow should finish: %v", err)
+	}
+	if got := hd.CloseReason(); got != "shutdown" {
+		t.Fatalf("want close reason shutdown, got %q", got)
+	}
+	server.Close()
+
+	// Flows added after CloseAll are closed immediately.
+	c2, s2 := net.Pipe()
+	defer s2.Close()
+	late := tr.Add(Flow{ID: "r2"}, c2)
+	late.Done()
+	if _, err := c2.Write([]byte("x")); err == nil {
+		t.Fatal("late flow conn should already be closed")
+	}
+	if late.CloseReason() != "shutdown" || tr.Len() != 0 {
+		t.Fatalf("late flow: reason=%q len=%d", late.CloseReason(), tr.Len())
+	}
+}
+
+func TestAllOldestFirst(t *testing.T) {
+	tr := NewTracker()
+	now := time.Now()
+	defer tr.Add(Flow{ID: "new", Started: now}).Done()
+	defer tr.Add(Flow{ID: "old", Started: now.Add(-time.Minute)}).Done()
+
+	all := tr.All()
+	if len(all) != 2 || all[0].ID != "old" || all[1].ID != "new" {
+		t.Fatalf("unexpected order: %+v", all)
+	}
+}
+
+func TestRevokeClosesFailedChecks(t *testing.T) {
+	tr := NewTracker()
+	allowed := true
+	c1, s1 := net.Pipe()
+	defer s1.Close()
+	c2, s2 := net.Pipe()
+	defer s2.Close()
+	kept := tr.Add(Flow{ID: "kept", Check: func() bool { return true }}, c1)
+	defer kept.Done()
+	revoked := tr.Add(Flow{ID: "revoked", AgentID: "a1", Check: func() bool { return allowed }}, c2)
+	defer revoked.Done()
+	unchecked := tr.Add(Flow{ID: "unchecked"})
+	defer unchecked.Done()
+
+	if got := tr.Revoke("revoked"); len(got) != 0 {
+		t.Fatalf("nothing should be revoked yet, got %+v", got)
+	}
+	allowed = false
+	got := tr.Revoke("revoked")
+	if len(got) != 1 || got[0].ID != "revoked" || got[0].Check != nil {
+		t.Fatalf("want only flow revoked, without its check: %+v", got)
+	}
+	if _, err := c2.Write([]byte("x")); err == nil {
+		t.Fatal("revoked flow's conn should be closed")
+	}
+	if revoked.CloseReason() != "revoked" || kept.CloseReason() != "" || unchecked.CloseReason() != "" {
+		t.Fatalf("reasons: revoked=%q kept=%q unchecked=%q",
+			revoked.CloseReason(), kept.CloseReason(), unchecked.CloseReason())
+	}
+
+	// A check set after Add is honoured; a finished flow is not revoked.
+	kept.SetCheck(func() bool { return false })
+	revoked.Done()
+	if got := tr.Revoke("revoked"); len(got) != 1 || got[0].ID != "kept" {
+		t.Fatalf("want kept revoked via SetCheck, got %+v", got)
+	}
+}
+
+func TestCloseAgent(t *testing.T) {
+	tr := NewTracker()
+	now := time.Now()
+	defer tr.Add(Flow{ID: "a-new", AgentID: "a1", Started: now}).Done()
+	defer tr.Add(Flow{ID: "a-old", AgentID: "a1", Started: now.Add(-time.Minute)}).Done()
+	other := tr.Add(Flow{ID: "b", AgentID: "b1", Started: now})
+	defer other.Done()
+
+	got := tr.CloseAgent("a1", "killed")
+	if len(got) != 2 || got[0].ID != "a-old" || got[1].ID != "a-new" {
+		t.Fatalf("want a1's flows oldest first, got %+v", got)
+	}
+	if other.CloseReason() != "" {
+		t.Fatalf("other agent's flow closed: %q", other.CloseReason())
+	}
+	if got := tr.CloseAgent("nobody", "killed"); len(got) != 0 {
+		t.Fatalf("unknown agent: %+v", got)
+	}
+}
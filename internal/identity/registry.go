@@ -1,29 +1,49 @@
 package identity
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"net/netip"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/egress"
 )
 
 // Agent represents a registered agent identity.
 type Agent struct {
-	AgentID     string `json:"agent_id"`
-	TeamID      string `json:"team_id"`
-	ProjectID   string `json:"project_id"`
-	Environment string `json:"environment"`
-	APIKey      string `json:"api_key"`
-	Status      string `json:"status"` // "active" | "disabled"
+	AgentID     string   `json:"agent_id"`
+	TeamID      string   `json:"team_id"`
+	ProjectID   string   `json:"project_id"`
+	Environment string   `json:"environment"`
+	APIKey      string   `json:"api_key"`
+	Status      string   `json:"status"`               // "active" | "disabled"
+	SourceIPs   []string `json:"source_ips,omitempty"` // IPs/CIDRs bound to this agent for transparent mode
+	CertNames   []string `json:"cert_names,omitempty"` // client certificate SPIFFE IDs, DNS names or CNs bound to this agent
+
+	// Egress address or interface and address family for its upstream
+	// conns. Unlike SourceIPs, these are addresses of the gateway.
+	egress.Source
+}
+
+// sourceBinding maps a client address prefix to an agent.
+type sourceBinding struct {
+	prefix netip.Prefix
+	agent  *Agent
 }
 
 // Registry holds agent records indexed by API key and agent ID.
 // All methods are safe for concurrent use.
 type Registry struct {
-	mu    sync.RWMutex
-	byKey map[string]*Agent
-	byID  map[string]*Agent
-	path  string
+	mu       sync.RWMutex
+	byKey    map[string]*Agent
+	byID     map[string]*Agent
+	bySource []sourceBinding // longest prefix first
+	byCert   map[string]*Agent
+	path     string
 }
 
 // NewRegistry loads the registry from path. A missing file starts an empty registry.
@@ -43,6 +63,8 @@ func (r *Registry) Load() error {
 		r.mu.Lock()
 		r.byKey = make(map[string]*Agent)
 		r.byID = make(map[string]*Agent)
+		r.bySource = nil
+		r.byCert = make(map[string]*Agent)
 		r.mu.Unlock()
 		return nil
 	}
@@ -59,13 +81,32 @@ func (r *Registry) Load() error {
 	byID := make(map[string]*Agent, len(agents))
 	for i := range agents {
 		a := &agents[i]
+		if _, err := parseSourceIPs(a.SourceIPs); err != nil {
+			return fmt.Errorf("parse registry %s: agent %s: %w", r.path, a.AgentID, err)
+		}
+		if err := ValidateCertNames(a.CertNames); err != nil {
+			return fmt.Errorf("parse registry %s: agent %s: %w", r.path, a.AgentID, err)
+		}
+		if err := egress.Validate(a.Source); err != nil {
+			return fmt.Errorf("parse registry %s: agent %s: %w", r.path, a.AgentID, err)
+		}
 		byKey[a.APIKey] = a
 		byID[a.AgentID] = a
 	}
+	byCert := buildCertIndex(byID)
+	for _, a := range byID {
+		for _, n := range a.CertNames {
+			if other := byCert[certKey(n)]; other != a {
+				return fmt.Errorf("parse registry %s: cert name %q bound to agents %s and %s", r.path, n, a.AgentID, other.AgentID)
+			}
+		}
+	}
 
 	r.mu.Lock()
 	r.byKey = byKey
 	r.byID = byID
+	r.bySource = buildSourceIndex(byID)
+	r.byCert = byCert
 	r.mu.Unlock()
 	return nil
 }
@@ -82,6 +123,42 @@ func (r *Registry) LookupByKey(key string) *Agent {
 	return a
 }
 
+// LookupBySourceIP resolves an agent from a client address bound via
+// SourceIPs. The most specific matching prefix wins.
+// Returns nil if no binding matches or the agent is not active.
+func (r *Registry) LookupBySourceIP(addr netip.Addr) *Agent {
+	addr = addr.Unmap()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, b := range r.bySource {
+		if b.prefix.Contains(addr) {
+			if b.agent.Status != "active" {
+				return nil
+			}
+			return b.agent
+		}
+	}
+	return nil
+}
+
+// LookupByCert resolves an agent from a verified client certificate bound
+// via CertNames. The certificate's SPIFFE ID (a spiffe:// URI SAN) is tried
+// first, then its DNS SANs, then its subject CN; the first bound name
+// decides. Returns nil if no name is bound or the agent is not active.
+func (r *Registry) LookupByCert(cert *x509.Certificate) *Agent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, name := range certNames(cert) {
+		if a := r.byCert[certKey(name)]; a != nil {
+			if a.Status != "active" {
+				return nil
+			}
+			return a
+		}
+	}
+	return nil
+}
+
 // All returns a snapshot of all registered agents (any status).
 func (r *Registry) All() []Agent {
 	r.mu.RLock()
@@ -112,6 +189,8 @@ func (r *Registry) Add(a Agent) {
 	cp := a
 	r.byKey[cp.APIKey] = &cp
 	r.byID[cp.AgentID] = &cp
+	r.bySource = buildSourceIndex(r.byID)
+	r.byCert = buildCertIndex(r.byID)
 }
 
 // Remove deletes an agent by ID. Returns true if it existed. Call Save() to persist.
@@ -124,9 +203,112 @@ func (r *Registry) Remove(id string) bool {
 	}
 	delete(r.byID, id)
 	delete(r.byKey, a.APIKey)
+	r.bySource = buildSourceIndex(r.byID)
+	r.byCert = buildCertIndex(r.byID)
 	return true
 }
 
+// ValidateSourceIPs reports whether every entry is a valid IP or CIDR.
+func ValidateSourceIPs(entries []string) error {
+	_, err := parseSourceIPs(entries)
+	return err
+}
+
+func parseSourceIPs(entries []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if strings.Contains(e, "/") {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source_ips entry %q: %w", e, err)
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source_ips entry %q: %w", e, err)
+		}
+		a = a.Unmap()
+		out = append(out, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return out, nil
+}
+
+// buildSourceIndex flattens all agents' SourceIPs, most specific prefix first.
+// Invalid entries (possible only via Add) are skipped.
+func buildSourceIndex(byID map[string]*Agent) []sourceBinding {
+	var idx []sourceBinding
+	for _, a := range byID {
+		prefixes, err := parseSourceIPs(a.SourceIPs)
+		if err != nil {
+			continue
+		}
+		for _, p := range prefixes {
+			idx = append(idx, sourceBinding{prefix: p, agent: a})
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		if idx[i].prefix.Bits() != idx[j].prefix.Bits() {
+			return idx[i].prefix.Bits() > idx[j].prefix.Bits()
+		}
+		return idx[i].agent.AgentID < idx[j].agent.AgentID
+	})
+	return idx
+}
+
+// ValidateCertNames reports whether every entry is usable as a certificate
+// binding.
+func ValidateCertNames(names []string) error {
+	for _, n := range names {
+		if n == "" || strings.TrimSpace(n) != n {
+			return fmt.Errorf("invalid cert_names entry %q", n)
+		}
+	}
+	return nil
+}
+
+// certNames lists the names of cert that can bind it to an agent, in
+// lookup order.
+func certNames(cert *x509.Certificate) []string {
+	var out []string
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			out = append(out, u.String())
+		}
+	}
+	out = append(out, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		out = append(out, cert.Subject.CommonName)
+	}
+	return out
+}
+
+// certKey normalises a bound name. DNS names and CNs compare without case;
+// SPIFFE IDs are exact.
+func certKey(name string) string {
+	if strings.HasPrefix(name, "spiffe://") {
+		return name
+	}
+	return strings.ToLower(name)
+}
+
+// buildCertIndex maps every bound certificate name to its agent. When two
+// agents claim a name (possible only via Add), the lower agent ID wins.
+func buildCertIndex(byID map[string]*Agent) map[string]*Agent {
+	idx := make(map[string]*Agent)
+	for _, a := range byID {
+		for _, n := range a.CertNames {
+			k := certKey(n)
+			if prev := idx[k]; prev == nil || a.AgentID < prev.AgentID {
+				idx[k] = a
+			}
+		}
+	}
+	return idx
+}
+
 // Save writes the current agent list to disk atomically.
 func (r *Registry) Save() error {
 	r.mu.RLock()
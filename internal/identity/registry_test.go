@@ -1,6 +1,10 @@
 package identity
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
@@ -117,3 +121,128 @@ func TestMissingFile(t *testing.T) {
 		t.Fatal("missing file should give empty registry")
 	}
 }
+
+func TestLookupBySourceIP(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agents.json")
+	data := `[
+		{"agent_id":"subnet","api_key":"k1","status":"active","source_ips":["10.0.0.0/24"]},
+		{"agent_id":"host","api_key":"k2","status":"active","source_ips":["10.0.0.7","2001:db8::/64"]},
+		{"agent_id":"off","api_key":"k3","status":"disabled","source_ips":["10.0.1.5"]}
+	]`
+	os.WriteFile(path, []byte(data), 0o644)
+	reg, err := NewRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"10.0.0.9":         "subnet",
+		"10.0.0.7":         "host", // /32 beats /24
+		"::ffff:10.0.0.7":  "host", // v4-mapped
+		"2001:db8::42":     "host",
+		"10.0.1.5":         "", // disabled agent
+		"192.168.1.1":      "",
+		"2001:db8:0:1::42": "",
+	}
+	for ip, want := range cases {
+		a := reg.LookupBySourceIP(netip.MustParseAddr(ip))
+		got := ""
+		if a != nil {
+			got = a.AgentID
+		}
+		if got != want {
+			t.Errorf("LookupBySourceIP(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestSourceIPIndexFollowsMutations(t *testing.T) {
+	reg, _ := NewRegistry(filepath.Join(t.TempDir(), "agents.json"))
+	reg.Add(Agent{AgentID: "a1", APIKey: "k1", Status: "active", SourceIPs: []string{"192.0.2.10"}})
+	if reg.LookupBySourceIP(netip.MustParseAddr("192.0.2.10")) == nil {
+		t.Fatal("binding should be visible after Add")
+	}
+	reg.Remove("a1")
+	if reg.LookupBySourceIP(netip.MustParseAddr("192.0.2.10")) != nil {
+		t.Fatal("binding should be gone after Remove")
+	}
+}
+
+func TestLoadRejectsInvalidSourceIP(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agents.json")
+	os.WriteFile(path, []byte(`[{"agent_id":"a1","api_key":"k1","status":"active","source_ips":["not-an-ip"]}]`), 0o644)
+	if _, err := NewRegistry(path); err == nil {
+		t.Fatal("expected error for invalid source_ips entry")
+	}
+}
+
+func TestLoadEgressSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agents.json")
+	os.WriteFile(path, []byte(`[{"agent_id":"a1","api_key":"k1","status":"active","egress_interface":"eth1","address_family":"prefer_ipv6"}]`), 0o644)
+	reg, err := NewRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := reg.LookupByID("a1"); a.Interface != "eth1" || a.Family != "prefer_ipv6" {
+		t.Fatalf("got %+v", a.Source)
+	}
+	os.WriteFile(path, []byte(`[{"agent_id":"a1","api_key":"k1","status":"active","egress_address":"egress.example"}]`), 0o644)
+	if err := reg.Load(); err == nil {
+		t.Fatal("expected error for non-IP egress_address")
+	}
+}
+
+func TestLookupByCert(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agents.json")
+	data := `[
+		{"agent_id":"spiffe","api_key":"k1","status":"active","cert_names":["spiffe://corp.example/ns/prod/sa/crawler"]},
+		{"agent_id":"dns","api_key":"k2","status":"active","cert_names":["builder.agents.corp.example"]},
+		{"agent_id":"cn","api_key":"k3","status":"active","cert_names":["legacy-agent"]},
+		{"agent_id":"off","api_key":"k4","status":"disabled","cert_names":["retired-agent"]}
+	]`
+	os.WriteFile(path, []byte(data), 0o644)
+	reg, err := NewRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spiffeID, _ := url.Parse("spiffe://corp.example/ns/prod/sa/crawler")
+	cases := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"spiffe id", &x509.Certificate{URIs: []*url.URL{spiffeID}, DNSNames: []string{"builder.agents.corp.example"}}, "spiffe"},
+		{"dns san, any case", &x509.Certificate{DNSNames: []string{"other.example", "Builder.Agents.Corp.Example"}}, "dns"},
+		{"cn", &x509.Certificate{Subject: pkix.Name{CommonName: "legacy-agent"}}, "cn"},
+		{"san beats cn", &x509.Certificate{DNSNames: []string{"builder.agents.corp.example"}, Subject: pkix.Name{CommonName: "legacy-agent"}}, "dns"},
+		{"disabled", &x509.Certificate{Subject: pkix.Name{CommonName: "retired-agent"}}, ""},
+		{"unbound", &x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}}, ""},
+	}
+	for _, c := range cases {
+		a := reg.LookupByCert(c.cert)
+		got := ""
+		if a != nil {
+			got = a.AgentID
+		}
+		if got != c.want {
+			t.Errorf("%s: LookupByCert = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLoadRejectsDuplicateCertName(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agents.json")
+	os.WriteFile(path, []byte(`[
+		{"agent_id":"a1","api_key":"k1","status":"active","cert_names":["agent.example"]},
+		{"agent_id":"a2","api_key":"k2","status":"active","cert_names":["AGENT.example"]}
+	]`), 0o644)
+	if _, err := NewRegistry(path); err == nil {
+		t.Fatal("expected error for a cert name bound to two agents")
+	}
+}
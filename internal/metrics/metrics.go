@@ -35,6 +35,14 @@ var (
 		Help:      "Total bytes forwarded outbound by agent.",
 	}, []string{"agent_id"})
 
+	// BytesIn tracks bytes returned from upstreams to agents.
+	BytesIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clawgress",
+		Subsystem: "gateway",
+		Name:      "bytes_in_total",
+		Help:      "Total bytes returned from upstreams by agent.",
+	}, []string{"agent_id"})
+
 	// QuotaUsage tracks current quota utilization (0-1 scale).
 	QuotaUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "clawgress",
@@ -43,6 +51,24 @@ var (
 		Help:      "Current quota utilization ratio (0=empty, 1=full).",
 	}, []string{"agent_id", "limit_type"})
 
+	// ConcurrentFlows tracks open requests and tunnels per agent, as counted
+	// against quota max_concurrent.
+	ConcurrentFlows = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clawgress",
+		Subsystem: "quota",
+		Name:      "concurrent_flows",
+		Help:      "Open requests and tunnels by agent, as counted against max_concurrent.",
+	}, []string{"agent_id"})
+
+	// ShapingDelay accumulates the time copy loops spent waiting for
+	// bytes_per_sec limits.
+	ShapingDelay = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clawgress",
+		Subsystem: "quota",
+		Name:      "shaping_delay_seconds_total",
+		Help:      "Total time flows were held back by bandwidth limits, by agent.",
+	}, []string{"agent_id"})
+
 	// ActiveAgents tracks the number of registered agents.
 	ActiveAgents = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: "clawgress",
@@ -67,6 +93,62 @@ var (
 		Help:      "Total audit events written.",
 	})
 
+	// AuditWriteErrors counts audit events the sink failed to write.
+	AuditWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "clawgress",
+		Subsystem: "audit",
+		Name:      "write_errors_total",
+		Help:      "Total audit events that could not be written.",
+	})
+
+	// AuditSinkUp reports whether the last audit write succeeded (1 = up).
+	AuditSinkUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clawgress",
+		Subsystem: "audit",
+		Name:      "sink_up",
+		Help:      "Audit sink health from the last write (1 = up, 0 = failing).",
+	})
+
+	// ActiveTunnels tracks open hijacked flows (CONNECT, inspected, transparent).
+	ActiveTunnels = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clawgress",
+		Subsystem: "gateway",
+		Name:      "active_tunnels",
+		Help:      "Currently open tunnels and hijacked client connections.",
+	})
+
+	// UpstreamConnsOpen tracks open connections held by the shared upstream transport.
+	UpstreamConnsOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clawgress",
+		Subsystem: "upstream",
+		Name:      "conns_open",
+		Help:      "Open upstream connections (active and idle) in the shared transport pool.",
+	})
+
+	// UpstreamDialsTotal counts new upstream connections by result.
+	UpstreamDialsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clawgress",
+		Subsystem: "upstream",
+		Name:      "dials_total",
+		Help:      "Total upstream dials by result (ok, error).",
+	}, []string{"result"})
+
+	// UpstreamRequestsTotal counts forwarded requests by whether a pooled conn was reused.
+	UpstreamRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clawgress",
+		Subsystem: "upstream",
+		Name:      "requests_total",
+		Help:      "Total forwarded upstream requests by connection reuse.",
+	}, []string{"reused"})
+
+	// UpstreamRouteUp reports parent-proxy route health (1 = up, 0 = down).
+	UpstreamRouteUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clawgress",
+		Subsystem: "upstream",
+		Name:      "route_up",
+		Help:      "Parent proxy route health from the last dial or check (1 = up).",
+	}, []string{"route"})
+
 	// DenyTotal counts denied requests (convenience counter).
 	DenyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "clawgress",
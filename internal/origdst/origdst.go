@@ -0,0 +1,37 @@
+// Package origdst recovers the pre-NAT destination of a TCP connection that
+// was redirected to a local listener by netfilter (nft "redirect"/DNAT).
+package origdst
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrUnsupported is returned on platforms without SO_ORIGINAL_DST.
+var ErrUnsupported = errors.New("origdst: SO_ORIGINAL_DST not supported on this platform")
+
+// ErrNotRedirected is returned when the original destination equals the
+// local listener address, i.e. the client connected to the proxy directly.
+var ErrNotRedirected = errors.New("origdst: connection was not redirected")
+
+// Lookup returns the original destination of c, which must be a *net.TCPConn
+// (or wrap one via a NetConn() method, as *tls.Conn does).
+func Lookup(c net.Conn) (*net.TCPAddr, error) {
+	for {
+		if tc, ok := c.(*net.TCPConn); ok {
+			addr, err := lookup(tc)
+			if err != nil {
+				return nil, err
+			}
+			if local, ok := tc.LocalAddr().(*net.TCPAddr); ok && local.IP.Equal(addr.IP) && local.Port == addr.Port {
+				return nil, ErrNotRedirected
+			}
+			return addr, nil
+		}
+		u, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, errors.New("origdst: not a TCP connection")
+		}
+		c = u.NetConn()
+	}
+}
@@ -0,0 +1,72 @@
+//go:build linux
+
+package origdst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST share the value 80 (linux/netfilter_ipv4.h).
+const soOriginalDst = 80
+
+func lookup(tc *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("origdst: %w", err)
+	}
+	local, _ := tc.LocalAddr().(*net.TCPAddr)
+	v6 := local != nil && local.IP.To4() == nil
+
+	var addr *net.TCPAddr
+	var serr error
+	cerr := raw.Control(func(fd uintptr) {
+		if v6 {
+			addr, serr = getOriginalDst6(int(fd))
+		} else {
+			addr, serr = getOriginalDst4(int(fd))
+		}
+	})
+	if cerr != nil {
+		return nil, fmt.Errorf("origdst: %w", cerr)
+	}
+	if serr != nil {
+		return nil, fmt.Errorf("origdst: getsockopt SO_ORIGINAL_DST: %w", serr)
+	}
+	return addr, nil
+}
+
+func getOriginalDst4(fd int) (*net.TCPAddr, error) {
+	var sa syscall.RawSockaddrInet4
+	size := uint32(unsafe.Sizeof(sa))
+	if err := getsockopt(fd, syscall.SOL_IP, soOriginalDst, unsafe.Pointer(&sa), &size); err != nil {
+		return nil, err
+	}
+	port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+	return &net.TCPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: int(port)}, nil
+}
+
+func getOriginalDst6(fd int) (*net.TCPAddr, error) {
+	var sa syscall.RawSockaddrInet6
+	size := uint32(unsafe.Sizeof(sa))
+	if err := getsockopt(fd, syscall.SOL_IPV6, soOriginalDst, unsafe.Pointer(&sa), &size); err != nil {
+		return nil, err
+	}
+	port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, sa.Addr[:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func getsockopt(fd, level, name int, val unsafe.Pointer, size *uint32) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT,
+		uintptr(fd), uintptr(level), uintptr(name),
+		uintptr(val), uintptr(unsafe.Pointer(size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package origdst
+
+import "net"
+
+func lookup(*net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
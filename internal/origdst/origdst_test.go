@@ -0,0 +1,43 @@
+package origdst
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLookupDirectConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			defer c.Close()
+			buf := make([]byte, 1)
+			c.Read(buf)
+		}
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Without a netfilter redirect the lookup either fails (no conntrack
+	// entry / unsupported platform) or reports the listener itself.
+	if addr, err := Lookup(c); err == nil {
+		t.Fatalf("direct connection should not yield an original destination, got %v", addr)
+	}
+}
+
+func TestLookupRejectsNonTCP(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := Lookup(a); err == nil {
+		t.Fatal("pipe conn should be rejected")
+	}
+}
@@ -1,9 +1,13 @@
 package policy
 
-import "fmt"
+import (
+	"fmt"
+	"net/netip"
+)
 
-// Conflict describes two rules that match the same (agent, domain) pair
-// but produce different actions.
+// Conflict describes two rules that match the same (agent, destination) pair
+// but produce different actions. Domain names the overlapping domain, CIDR or
+// ip_literal selectors of the two rules.
 type Conflict struct {
 	RuleA    Rule   `json:"rule_a"`
 	RuleB    Rule   `json:"rule_b"`
@@ -28,10 +32,14 @@ func DetectConflicts(rules []Rule) []Conflict {
 			if !agentOverlaps(a.AgentID, b.AgentID) {
 				continue
 			}
-			// Check domain overlap.
-			for _, da := range a.Domains {
-				for _, db := range b.Domains {
-					if domainOverlaps(da, db) {
+			// Rules restricted to disjoint ports never see the same request.
+			if !portsOverlap(a.Ports, b.Ports) {
+				continue
+			}
+			// Check destination overlap.
+			for _, sa := range selectors(a) {
+				for _, sb := range selectors(b) {
+					if sa.overlaps(sb) {
 						agentDesc := a.AgentID
 						if agentDesc == "*" || b.AgentID == "*" {
 							agentDesc = "*"
@@ -39,7 +47,7 @@ func DetectConflicts(rules []Rule) []Conflict {
 						conflicts = append(conflicts, Conflict{
 							RuleA:    a,
 							RuleB:    b,
-							Domain:   fmt.Sprintf("%s / %s", da, db),
+							Domain:   fmt.Sprintf("%s / %s", sa.desc, sb.desc),
 							AgentID:  agentDesc,
 							Severity: "shadowed",
 						})
@@ -68,3 +76,80 @@ func domainOverlaps(a, b string) bool {
 	}
 	return false
 }
+
+// selector is one destination selector of a rule: a domain pattern, a CIDR,
+// or the ip_literal flag (any IP address).
+type selector struct {
+	desc   string
+	domain string
+	prefix netip.Prefix
+	anyIP  bool
+}
+
+// selectors lists a rule's destination selectors. Malformed CIDRs are skipped;
+// they never match at evaluation time either.
+func selectors(r Rule) []selector {
+	var out []selector
+	for _, d := range r.Domains {
+		out = append(out, selector{desc: d, domain: d})
+	}
+	for _, c := range r.CIDRs {
+		if pfx, err := parseCIDR(c); err == nil {
+			out = append(out, selector{desc: c, prefix: pfx})
+		}
+	}
+	if r.IPLiteral {
+		out = append(out, selector{desc: "ip_literal", anyIP: true})
+	}
+	return out
+}
+
+func (a selector) overlaps(b selector) bool {
+	switch {
+	case a.domain != "" && b.domain != "":
+		return domainOverlaps(a.domain, b.domain)
+	case a.domain != "":
+		return domainCoversIPs(a.domain, b)
+	case b.domain != "":
+		return domainCoversIPs(b.domain, a)
+	case a.anyIP || b.anyIP:
+		return true
+	default:
+		return a.prefix.Overlaps(b.prefix)
+	}
+}
+
+// domainCoversIPs reports whether a domain pattern can match any address the
+// IP selector s matches: "*" matches every host, and a pattern may itself be
+// an IP literal.
+func domainCoversIPs(pattern string, s selector) bool {
+	if pattern == "*" {
+		return true
+	}
+	ip, err := netip.ParseAddr(pattern)
+	if err != nil {
+		return false
+	}
+	return s.anyIP || s.prefix.Contains(ip.Unmap())
+}
+
+// portsOverlap reports whether two Ports lists share a port; an empty list is
+// every port.
+func portsOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, pa := range a {
+		loA, hiA, err := parsePortRange(pa)
+		if err != nil {
+			continue
+		}
+		for _, pb := range b {
+			loB, hiB, err := parsePortRange(pb)
+			if err == nil && loA <= hiB && loB <= hiA {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -109,3 +109,43 @@ func TestDeterministicOrdering(t *testing.T) {
 		t.Fatal("different ordering should produce different results")
 	}
 }
+
+func TestDetectConflictsCIDR(t *testing.T) {
+	rules := []Rule{
+		{PolicyID: "p1", AgentID: "*", CIDRs: []string{"10.0.0.0/8"}, Action: "deny"},
+		{PolicyID: "p2", AgentID: "*", CIDRs: []string{"10.1.0.0/16"}, Action: "allow"},
+		{PolicyID: "p3", AgentID: "*", CIDRs: []string{"192.168.0.0/16"}, Action: "allow"},
+		{PolicyID: "p4", AgentID: "*", Domains: []string{"10.9.9.9"}, Action: "allow"},
+	}
+	conflicts := DetectConflicts(rules)
+	if len(conflicts) != 2 {
+		t.Fatalf("expected 2 conflicts (p1/p2, p1/p4), got %d: %+v", len(conflicts), conflicts)
+	}
+	if conflicts[0].Domain != "10.0.0.0/8 / 10.1.0.0/16" {
+		t.Fatalf("unexpected description %q", conflicts[0].Domain)
+	}
+}
+
+func TestDetectConflictsIPLiteral(t *testing.T) {
+	rules := []Rule{
+		{PolicyID: "p1", AgentID: "*", IPLiteral: true, Action: "deny"},
+		{PolicyID: "p2", AgentID: "*", CIDRs: []string{"2001:db8::/32"}, Action: "allow"},
+		{PolicyID: "p3", AgentID: "*", Domains: []string{"example.com"}, Action: "allow"},
+	}
+	conflicts := DetectConflicts(rules)
+	if len(conflicts) != 1 || conflicts[0].RuleB.PolicyID != "p2" {
+		t.Fatalf("expected only ip_literal / CIDR conflict, got %+v", conflicts)
+	}
+}
+
+func TestDetectConflictsPorts(t *testing.T) {
+	rules := []Rule{
+		{PolicyID: "p1", AgentID: "*", Domains: []string{"api.internal"}, Ports: []string{"8443"}, Action: "allow"},
+		{PolicyID: "p2", AgentID: "*", Domains: []string{"api.internal"}, Ports: []string{"80", "443"}, Action: "deny"},
+		{PolicyID: "p3", AgentID: "*", Domains: []string{"api.internal"}, Ports: []string{"8000-8999"}, Action: "deny"},
+	}
+	conflicts := DetectConflicts(rules)
+	if len(conflicts) != 1 || conflicts[0].RuleB.PolicyID != "p3" {
+		t.Fatalf("expected only the overlapping port range to conflict, got %+v", conflicts)
+	}
+}
@@ -3,40 +3,70 @@ package policy
 import (
 	"encoding/json"
 	"fmt"
-	"net"
 	"os"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/egress"
 )
 
 // Rule defines a policy entry. Rules are evaluated in slice order; first match wins.
-// All match fields are optional — empty/nil means "match any".
+// All match fields are optional — empty/nil means "match any". Domains, CIDRs
+// and IPLiteral select the destination host together: any one of them matching
+// is enough.
 type Rule struct {
 	PolicyID     string            `json:"policy_id"`
 	AgentID      string            `json:"agent_id"`                // "*" or empty matches any agent
 	Domains      []string          `json:"domains"`                 // domain patterns; see matchDomain
+	CIDRs        []string          `json:"cidrs,omitempty"`         // IP-literal destinations inside these prefixes (v4 or v6)
+	IPLiteral    bool              `json:"ip_literal,omitempty"`    // match any IP-literal destination
+	Ports        []string          `json:"ports,omitempty"`         // destination ports or ranges ("443", "8000-8999"); empty = any
 	Methods      []string          `json:"methods,omitempty"`       // HTTP methods (GET, CONNECT, etc); empty = any
 	PathPrefixes []string          `json:"path_prefixes,omitempty"` // path prefix match; empty = any
 	Conditions   map[string]string `json:"conditions,omitempty"`    // key-value conditions (e.g. "environment":"prod")
 	Action       string            `json:"action"`                  // "allow" | "deny"
+	Inspect      bool              `json:"inspect,omitempty"`       // terminate TLS on CONNECT so Methods/PathPrefixes apply
+	Upstreams    []Route           `json:"upstreams,omitempty"`     // egress routes in fallback order; empty = direct
+	Headers      []HeaderRule      `json:"headers,omitempty"`       // request header rewrites and credential brokering
+	BodyLimits                     // request/response size and content-type limits
+	IdleTimeout  int               `json:"idle_timeout_s,omitempty"` // close tunnels with no traffic for this long; 0 = gateway default
+	MaxDuration  int               `json:"max_duration_s,omitempty"` // close tunnels open this long; 0 = gateway default
+
+	// Egress address or interface and address family for upstream conns;
+	// set fields override the agent's.
+	egress.Source
 }
 
 // RequestContext carries per-request metadata for rich policy evaluation.
 type RequestContext struct {
 	AgentID     string
-	Destination string // host or host:port
+	Destination string // host or host:port; a bare host is port 80 (443 for CONNECT)
 	Method      string // HTTP method
 	Path        string // request path (for plain HTTP)
 	Environment string // from identity
 	TeamID      string // from identity
 	ProjectID   string // from identity
+	Protocol    string // payload protocol once seen: "tls" | "http" | "unknown"; empty = not yet known
+	Upgrade     string // protocol named by an HTTP Upgrade request (e.g. "websocket"); empty = not an upgrade
 }
 
 // Decision is the result of evaluating a single request.
 type Decision struct {
-	Action   string // "allow" | "deny"
-	PolicyID string
-	Reason   string
+	Action    string // "allow" | "deny"
+	PolicyID  string
+	Reason    string
+	Inspect   bool         // matched rule requests TLS inspection
+	Upstreams []Route      // egress routes of the matched rule, in fallback order
+	Explicit  bool         // matched rule names the request's method in Methods (not a catch-all)
+	Headers   []HeaderRule // request header rewrites of the matched rule
+	Limits    BodyLimits   // body and content-type limits of the matched rule
+
+	// Tunnel lifetime limits of the matched rule; 0 = gateway default.
+	IdleTimeout time.Duration
+	MaxDuration time.Duration
+
+	Egress egress.Source // egress source of the matched rule; see egress.Select
 }
 
 // Engine evaluates policy rules against (agentID, destHost) pairs.
@@ -72,12 +102,39 @@ func (e *Engine) Load() error {
 	if err := json.Unmarshal(data, &rules); err != nil {
 		return fmt.Errorf("parse policy %s: %w", e.path, err)
 	}
+	for _, r := range rules {
+		if err := ValidateRule(r); err != nil {
+			return fmt.Errorf("policy %s: rule %s: %w", e.path, r.PolicyID, err)
+		}
+	}
 	e.mu.Lock()
 	e.rules = rules
 	e.mu.Unlock()
 	return nil
 }
 
+// ValidateRule checks the parts of a rule that must parse before it can be
+// evaluated: destination CIDRs, ports, upstream routes, header rewrites, body
+// limits, tunnel timeouts and the egress source.
+func ValidateRule(r Rule) error {
+	if err := ValidateMatch(r); err != nil {
+		return err
+	}
+	if err := ValidateHeaders(r.Headers); err != nil {
+		return err
+	}
+	if err := ValidateLimits(r.BodyLimits); err != nil {
+		return err
+	}
+	if r.IdleTimeout < 0 || r.MaxDuration < 0 {
+		return fmt.Errorf("idle_timeout_s and max_duration_s must be >= 0")
+	}
+	if err := egress.Validate(r.Source); err != nil {
+		return err
+	}
+	return ValidateRoutes(r.Upstreams)
+}
+
 // Rules returns a snapshot of the loaded rules.
 func (e *Engine) Rules() []Rule {
 	e.mu.RLock()
@@ -161,17 +218,18 @@ func (e *Engine) Evaluate(agentID, destHost string) Decision {
 // path, and identity conditions. Empty context fields match any rule field.
 // Rules are evaluated in order; first match wins. Default action is deny.
 func (e *Engine) EvaluateRich(ctx RequestContext) Decision {
-	host := sanitizeHost(stripPort(ctx.Destination))
+	dest := parseDestination(ctx.Destination, ctx.Method)
 
 	e.mu.RLock()
 	rules := e.rules
 	e.mu.RUnlock()
 
-	for _, r := range rules {
+	for i := range rules {
+		r := &rules[i]
 		if r.AgentID != "*" && r.AgentID != "" && r.AgentID != ctx.AgentID {
 			continue
 		}
-		if !matchDomainList(host, r.Domains) {
+		if !r.matchHost(dest) || !r.matchPorts(dest.port) {
 			continue
 		}
 		if len(r.Methods) > 0 && ctx.Method != "" && !containsIgnoreCase(r.Methods, ctx.Method) {
@@ -183,10 +241,22 @@ func (e *Engine) EvaluateRich(ctx RequestContext) Decision {
 		if len(r.Conditions) > 0 && !matchConditions(r.Conditions, ctx) {
 			continue
 		}
+		if r.brokersSecret() && !identityKnown(r.Conditions, ctx) {
+			continue
+		}
 		return Decision{
-			Action:   r.Action,
-			PolicyID: r.PolicyID,
-			Reason:   "matched rule " + r.PolicyID,
+			Action:    r.Action,
+			PolicyID:  r.PolicyID,
+			Reason:    "matched rule " + r.PolicyID,
+			Inspect:   r.Inspect,
+			Upstreams: r.Upstreams,
+			Explicit:  len(r.Methods) > 0 && ctx.Method != "",
+			Headers:   r.Headers,
+			Limits:    r.BodyLimits,
+			Egress:    r.Source,
+
+			IdleTimeout: time.Duration(r.IdleTimeout) * time.Second,
+			MaxDuration: time.Duration(r.MaxDuration) * time.Second,
 		}
 	}
 	return Decision{
@@ -196,6 +266,77 @@ func (e *Engine) EvaluateRich(ctx RequestContext) Decision {
 	}
 }
 
+// InspectRequired reports whether a CONNECT to ctx.Destination must be
+// TLS-intercepted so that method/path rules can be evaluated per inner request.
+// Rules are scanned in order ignoring Methods and PathPrefixes: the first
+// matching rule with Inspect set, header rewrites or body limits returns true, while a matching rule without
+// method/path constraints decides the whole host and returns false.
+func (e *Engine) InspectRequired(ctx RequestContext) bool {
+	dest := parseDestination(ctx.Destination, ctx.Method)
+
+	e.mu.RLock()
+	rules := e.rules
+	e.mu.RUnlock()
+
+	for i := range rules {
+		r := &rules[i]
+		if r.AgentID != "*" && r.AgentID != "" && r.AgentID != ctx.AgentID {
+			continue
+		}
+		if !r.matchHost(dest) || !r.matchPorts(dest.port) {
+			continue
+		}
+		if len(r.Conditions) > 0 && !matchConditions(r.Conditions, ctx) {
+			continue
+		}
+		if r.brokersSecret() && !identityKnown(r.Conditions, ctx) {
+			continue
+		}
+		if r.Inspect || len(r.Headers) > 0 || r.BodyLimits.any() {
+			return true
+		}
+		if len(r.Methods) == 0 && len(r.PathPrefixes) == 0 {
+			return false
+		}
+	}
+	return false
+}
+
+// ExplicitlyAllowsMethod reports whether some allow rule that applies to ctx's
+// agent and identity conditions names ctx.Method in its Methods, whatever its
+// destination. It is a coarse gate for requests whose destinations are not
+// known yet (a SOCKS5 UDP ASSOCIATE); each destination must still be evaluated.
+func (e *Engine) ExplicitlyAllowsMethod(ctx RequestContext) bool {
+	e.mu.RLock()
+	rules := e.rules
+	e.mu.RUnlock()
+
+	for i := range rules {
+		r := &rules[i]
+		if r.Action != "allow" || !containsIgnoreCase(r.Methods, ctx.Method) {
+			continue
+		}
+		if r.AgentID != "*" && r.AgentID != "" && r.AgentID != ctx.AgentID {
+			continue
+		}
+		if len(r.Conditions) > 0 && !matchConditions(r.Conditions, ctx) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// MatchesDomain reports whether destination (host or host:port) matches any
+// of the domain patterns, using the same normalization as rule evaluation.
+// An empty pattern list matches nothing.
+func MatchesDomain(destination string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	return matchDomainList(parseDestination(destination, "").host, patterns)
+}
+
 func matchDomainList(host string, domains []string) bool {
 	if len(domains) == 0 {
 		return true
@@ -242,6 +383,18 @@ func matchConditions(conds map[string]string, ctx RequestContext) bool {
 			if ctx.ProjectID != "" && ctx.ProjectID != v {
 				return false
 			}
+		case "protocol":
+			// Unlike identity conditions, an unknown protocol never matches:
+			// CONNECTs are evaluated once before and once after the first
+			// payload bytes, and only the second evaluation knows it.
+			if ctx.Protocol != v {
+				return false
+			}
+		case "upgrade":
+			// Likewise strict: a plain request never matches an upgrade rule.
+			if !strings.EqualFold(ctx.Upgrade, v) {
+				return false
+			}
 		}
 	}
 	return true
@@ -279,11 +432,3 @@ func sanitizeHost(host string) string {
 	host = strings.ToLower(host)
 	return host
 }
-
-func stripPort(hostport string) string {
-	host, _, err := net.SplitHostPort(hostport)
-	if err != nil {
-		return hostport
-	}
-	return host
-}
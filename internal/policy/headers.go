@@ -0,0 +1,126 @@
+package policy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header rule actions.
+const (
+	HeaderSet     = "set"     // set Name to Value (replacing any the agent sent)
+	HeaderRemove  = "remove"  // drop Name
+	HeaderReplace = "replace" // swap Placeholder for the secret inside the agent's value
+)
+
+// SecretToken marks where a set rule's Value takes the secret, e.g.
+// "Bearer {secret}".
+const SecretToken = "{secret}"
+
+// HeaderRule rewrites one request header before the gateway forwards it, on
+// plain HTTP and TLS-inspected requests. Rules naming a Secret broker a
+// credential from the gateway's secret store, so the agent only ever holds a
+// placeholder.
+type HeaderRule struct {
+	Name        string `json:"name"`
+	Action      string `json:"action"`                // HeaderSet | HeaderRemove | HeaderReplace
+	Value       string `json:"value,omitempty"`       // set: literal value; SecretToken is replaced by the secret
+	Secret      string `json:"secret,omitempty"`      // secret store entry; set with no Value sends the secret as is
+	Placeholder string `json:"placeholder,omitempty"` // replace: text the agent sends in place of the secret
+}
+
+// ValidateHeaders checks a rule's header rewrites.
+func ValidateHeaders(rules []HeaderRule) error {
+	for _, hr := range rules {
+		name := http.CanonicalHeaderKey(hr.Name)
+		if !validHeaderName(hr.Name) {
+			return fmt.Errorf("invalid header name %q", hr.Name)
+		}
+		switch name {
+		case "Host", "Connection", "Upgrade", "Transfer-Encoding", "Content-Length",
+			"Proxy-Authorization", "Proxy-Connection":
+			return fmt.Errorf("header %s cannot be rewritten", name)
+		}
+		switch hr.Action {
+		case HeaderRemove:
+		case HeaderSet:
+			if hr.Secret != "" && hr.Value != "" && !strings.Contains(hr.Value, SecretToken) {
+				return fmt.Errorf("header %s: value must contain %s to use secret %q", name, SecretToken, hr.Secret)
+			}
+			if hr.Secret == "" && strings.Contains(hr.Value, SecretToken) {
+				return fmt.Errorf("header %s: value uses %s but names no secret", name, SecretToken)
+			}
+			if !ValidHeaderValue(hr.Value) {
+				return fmt.Errorf("header %s: invalid value", name)
+			}
+		case HeaderReplace:
+			if hr.Secret == "" || hr.Placeholder == "" {
+				return fmt.Errorf("header %s: replace needs secret and placeholder", name)
+			}
+		default:
+			return fmt.Errorf("header %s: unknown action %q", name, hr.Action)
+		}
+	}
+	return nil
+}
+
+// validHeaderName reports whether s is an RFC 9110 token.
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidHeaderValue reports whether s can be sent as a header value: no
+// control characters other than tab.
+func ValidHeaderValue(s string) bool {
+	for _, c := range []byte(s) {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// brokersSecret reports whether the rule injects a credential.
+func (r *Rule) brokersSecret() bool {
+	for _, hr := range r.Headers {
+		if hr.Secret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// identityKnown reports whether ctx carries every identity attribute conds
+// names. Identity conditions normally match an agent that lacks the
+// attribute; a rule that hands out a credential must not, or an agent with no
+// team_id would receive every team's key.
+func identityKnown(conds map[string]string, ctx RequestContext) bool {
+	for k := range conds {
+		switch k {
+		case "environment":
+			if ctx.Environment == "" {
+				return false
+			}
+		case "team_id":
+			if ctx.TeamID == "" {
+				return false
+			}
+		case "project_id":
+			if ctx.ProjectID == "" {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package policy
+
+import "testing"
+
+func TestValidateHeaders(t *testing.T) {
+	cases := []struct {
+		name string
+		hr   HeaderRule
+		ok   bool
+	}{
+		{"set secret", HeaderRule{Name: "Authorization", Action: HeaderSet, Value: "Bearer {secret}", Secret: "openai"}, true},
+		{"set bare secret", HeaderRule{Name: "X-Api-Key", Action: HeaderSet, Secret: "anthropic"}, true},
+		{"set literal", HeaderRule{Name: "OpenAI-Organization", Action: HeaderSet, Value: "org-1"}, true},
+		{"remove", HeaderRule{Name: "Cookie", Action: HeaderRemove}, true},
+		{"replace", HeaderRule{Name: "Authorization", Action: HeaderReplace, Secret: "openai", Placeholder: "CLAWGRESS_OPENAI"}, true},
+		{"value without token", HeaderRule{Name: "Authorization", Action: HeaderSet, Value: "Bearer x", Secret: "openai"}, false},
+		{"token without secret", HeaderRule{Name: "Authorization", Action: HeaderSet, Value: "Bearer {secret}"}, false},
+		{"replace without placeholder", HeaderRule{Name: "Authorization", Action: HeaderReplace, Secret: "openai"}, false},
+		{"hop-by-hop", HeaderRule{Name: "connection", Action: HeaderRemove}, false},
+		{"proxy credentials", HeaderRule{Name: "Proxy-Authorization", Action: HeaderSet, Value: "x"}, false},
+		{"bad name", HeaderRule{Name: "X Api", Action: HeaderRemove}, false},
+		{"bad value", HeaderRule{Name: "X-Api", Action: HeaderSet, Value: "a\r\nb"}, false},
+		{"unknown action", HeaderRule{Name: "X-Api", Action: "append"}, false},
+	}
+	for _, c := range cases {
+		err := ValidateHeaders([]HeaderRule{c.hr})
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
+
+func TestEvaluateRichHeaders(t *testing.T) {
+	hdrs := []HeaderRule{{Name: "Authorization", Action: HeaderSet, Value: "Bearer {secret}", Secret: "team-a-openai"}}
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "openai-team-a", AgentID: "*", Domains: []string{"api.openai.com"}, Conditions: map[string]string{"team_id": "team-a"}, Headers: hdrs, Action: "allow"},
+		{PolicyID: "openai", AgentID: "*", Domains: []string{"api.openai.com"}, Action: "allow"},
+	}
+
+	dec := eng.EvaluateRich(RequestContext{AgentID: "a1", TeamID: "team-a", Destination: "api.openai.com"})
+	if dec.PolicyID != "openai-team-a" || len(dec.Headers) != 1 {
+		t.Fatalf("team-a: got %s with %d header rules", dec.PolicyID, len(dec.Headers))
+	}
+	if !eng.InspectRequired(RequestContext{AgentID: "a1", TeamID: "team-a", Destination: "api.openai.com:443", Method: "CONNECT"}) {
+		t.Fatal("header rewrites need inspection")
+	}
+
+	// An agent with no team matches ordinary team rules, but must not be
+	// handed the team's credential.
+	dec = eng.EvaluateRich(RequestContext{AgentID: "a2", Destination: "api.openai.com"})
+	if dec.PolicyID != "openai" || len(dec.Headers) != 0 {
+		t.Fatalf("no team: got %s with %d header rules", dec.PolicyID, len(dec.Headers))
+	}
+	if eng.InspectRequired(RequestContext{AgentID: "a2", Destination: "api.openai.com:443", Method: "CONNECT"}) {
+		t.Fatal("no team: plain allow should not be inspected")
+	}
+}
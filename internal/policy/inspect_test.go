@@ -0,0 +1,65 @@
+package policy
+
+import "testing"
+
+func TestInspectRequired(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "block-evil", AgentID: "*", Domains: []string{"*.evil.com"}, Action: "deny"},
+		{PolicyID: "gh-read", AgentID: "*", Domains: []string{"api.github.com"}, Methods: []string{"GET"}, Inspect: true, Action: "allow"},
+		{PolicyID: "openai", AgentID: "*", Domains: []string{"api.openai.com"}, Action: "allow"},
+		{PolicyID: "default-deny", AgentID: "*", Domains: []string{"*"}, Action: "deny"},
+	}
+
+	cases := []struct {
+		dest string
+		want bool
+	}{
+		{"api.github.com:443", true},  // inspect rule matches despite GET-only methods
+		{"api.openai.com:443", false}, // plain allow decides the whole host
+		{"x.evil.com:443", false},     // earlier catch-all deny wins
+		{"unknown.com:443", false},
+	}
+	for _, c := range cases {
+		if got := eng.InspectRequired(RequestContext{AgentID: "a1", Destination: c.dest, Method: "CONNECT"}); got != c.want {
+			t.Errorf("InspectRequired(%s) = %v, want %v", c.dest, got, c.want)
+		}
+	}
+}
+
+func TestInspectRequiredSkipsUnconstrainedLaterRules(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "api-get", AgentID: "*", Domains: []string{"example.com"}, Methods: []string{"GET"}, Action: "allow"},
+		{PolicyID: "api-inspect", AgentID: "*", Domains: []string{"example.com"}, PathPrefixes: []string{"/v1/"}, Inspect: true, Action: "allow"},
+	}
+	if !eng.InspectRequired(RequestContext{AgentID: "a1", Destination: "example.com"}) {
+		t.Fatal("constrained non-inspect rule should not stop the scan")
+	}
+}
+
+func TestEvaluateRichReportsInspect(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "p1", AgentID: "*", Domains: []string{"example.com"}, Inspect: true, Action: "allow"},
+	}
+	if d := eng.Evaluate("a1", "example.com"); !d.Inspect {
+		t.Fatal("decision should carry the rule's inspect flag")
+	}
+}
+
+func TestMatchesDomain(t *testing.T) {
+	patterns := []string{"*.pinned.example", "bank.com"}
+	if !MatchesDomain("api.pinned.example:443", patterns) {
+		t.Fatal("wildcard with port should match")
+	}
+	if !MatchesDomain("BANK.com.", patterns) {
+		t.Fatal("match should be case-insensitive and ignore trailing dot")
+	}
+	if MatchesDomain("other.com", patterns) {
+		t.Fatal("unrelated host should not match")
+	}
+	if MatchesDomain("bank.com", nil) {
+		t.Fatal("empty pattern list should match nothing")
+	}
+}
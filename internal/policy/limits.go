@@ -0,0 +1,74 @@
+package policy
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// BodyLimits cap what one HTTP exchange may carry. They apply to plain HTTP
+// and TLS-inspected requests; spliced tunnels are opaque and not limited.
+// Zero values mean no limit.
+type BodyLimits struct {
+	MaxRequestBytes  int64 `json:"max_request_bytes,omitempty"`  // request body
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"` // response body
+
+	// Response media types, e.g. "application/json" or "image/*". A non-empty
+	// allow list refuses every other type, including responses that declare
+	// none; the deny list is checked first.
+	AllowContentTypes []string `json:"allow_content_types,omitempty"`
+	DenyContentTypes  []string `json:"deny_content_types,omitempty"`
+}
+
+// ValidateLimits checks that limits are non-negative and that content type
+// patterns are "type/subtype" or "type/*".
+func ValidateLimits(l BodyLimits) error {
+	if l.MaxRequestBytes < 0 || l.MaxResponseBytes < 0 {
+		return fmt.Errorf("body limits must be >= 0")
+	}
+	for _, list := range [][]string{l.AllowContentTypes, l.DenyContentTypes} {
+		for _, p := range list {
+			typ, sub, ok := strings.Cut(p, "/")
+			if !ok || typ == "" || typ == "*" || sub == "" || strings.ContainsAny(p, " ;") {
+				return fmt.Errorf("invalid content type pattern %q", p)
+			}
+		}
+	}
+	return nil
+}
+
+// any reports whether l limits anything.
+func (l BodyLimits) any() bool {
+	return l.MaxRequestBytes > 0 || l.MaxResponseBytes > 0 ||
+		len(l.AllowContentTypes) > 0 || len(l.DenyContentTypes) > 0
+}
+
+// ContentTypeAllowed reports whether a response with the given Content-Type
+// header value may be relayed.
+func (l BodyLimits) ContentTypeAllowed(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt = "" // undeclared or unparsable: only an empty allow list passes it
+	}
+	if mt != "" && matchMediaTypes(mt, l.DenyContentTypes) {
+		return false
+	}
+	if len(l.AllowContentTypes) > 0 {
+		return mt != "" && matchMediaTypes(mt, l.AllowContentTypes)
+	}
+	return true
+}
+
+func matchMediaTypes(mt string, patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if typ, ok := strings.CutSuffix(p, "/*"); ok {
+			if strings.HasPrefix(mt, typ+"/") {
+				return true
+			}
+		} else if mt == p {
+			return true
+		}
+	}
+	return false
+}
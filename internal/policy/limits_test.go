@@ -0,0 +1,74 @@
+package policy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateLimits(t *testing.T) {
+	good := []BodyLimits{
+		{},
+		{MaxRequestBytes: 1 << 20, MaxResponseBytes: 10 << 20},
+		{AllowContentTypes: []string{"application/json", "text/*"}, DenyContentTypes: []string{"application/x-msdownload"}},
+	}
+	for _, l := range good {
+		if err := ValidateLimits(l); err != nil {
+			t.Errorf("%+v: %v", l, err)
+		}
+	}
+	bad := []BodyLimits{
+		{MaxRequestBytes: -1},
+		{AllowContentTypes: []string{"json"}},
+		{DenyContentTypes: []string{"*/*"}},
+		{DenyContentTypes: []string{"text/html; charset=utf-8"}},
+	}
+	for _, l := range bad {
+		if err := ValidateLimits(l); err == nil {
+			t.Errorf("%+v: expected error", l)
+		}
+	}
+}
+
+func TestContentTypeAllowed(t *testing.T) {
+	deny := BodyLimits{DenyContentTypes: []string{"application/x-msdownload", "application/vnd.microsoft.*"}}
+	allow := BodyLimits{AllowContentTypes: []string{"application/json", "text/*"}, DenyContentTypes: []string{"text/html"}}
+	cases := []struct {
+		l    BodyLimits
+		ct   string
+		want bool
+	}{
+		{BodyLimits{}, "", true},
+		{BodyLimits{}, "application/x-msdownload", true},
+		{deny, "application/x-msdownload", false},
+		{deny, "Application/X-MSDownload; name=a.exe", false},
+		{deny, "application/json", true},
+		{deny, "", true},
+		{allow, "application/json; charset=utf-8", true},
+		{allow, "text/plain", true},
+		{allow, "text/html", false}, // deny list wins
+		{allow, "image/png", false},
+		{allow, "", false}, // undeclared type fails an allow list
+	}
+	for _, c := range cases {
+		if got := c.l.ContentTypeAllowed(c.ct); got != c.want {
+			t.Errorf("%+v ContentTypeAllowed(%q) = %v, want %v", c.l, c.ct, got, c.want)
+		}
+	}
+}
+
+func TestEvaluateRichLimits(t *testing.T) {
+	var r Rule
+	if err := json.Unmarshal([]byte(`{"policy_id":"dl","agent_id":"*","domains":["files.example.com"],"action":"allow",
+		"max_response_bytes":1048576,"deny_content_types":["application/x-msdownload"]}`), &r); err != nil {
+		t.Fatal(err)
+	}
+	eng := &Engine{}
+	eng.rules = []Rule{r}
+	dec := eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "files.example.com", Method: "GET"})
+	if dec.Limits.MaxResponseBytes != 1<<20 || len(dec.Limits.DenyContentTypes) != 1 {
+		t.Fatalf("limits = %+v", dec.Limits)
+	}
+	if !eng.InspectRequired(RequestContext{AgentID: "a1", Destination: "files.example.com:443", Method: "CONNECT"}) {
+		t.Fatal("limits on HTTPS need inspection")
+	}
+}
@@ -0,0 +1,146 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// destination is a RequestContext.Destination split for matching.
+type destination struct {
+	host string     // sanitized host; canonical text form for IP literals
+	ip   netip.Addr // valid only when the host is an IP literal
+	port int        // 0 when unknown
+}
+
+// parseDestination splits dest (host, host:port, or a bracketed IPv6 literal)
+// for matching. A destination without a port is a plain-HTTP absolute URL, so
+// it is taken as port 80, except for CONNECT, whose default is 443.
+func parseDestination(dest, method string) destination {
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(dest, "["), "]")
+		portStr = "80"
+		if strings.EqualFold(method, "CONNECT") {
+			portStr = "443"
+		}
+	}
+	d := destination{host: sanitizeHost(host)}
+	if p, err := strconv.Atoi(portStr); err == nil && p > 0 && p <= 65535 {
+		d.port = p
+	}
+	if ip, err := netip.ParseAddr(d.host); err == nil {
+		// Zones are link-local scoping, not part of the address being
+		// allowed; v4-mapped v6 is the v4 address.
+		d.ip = ip.WithZone("").Unmap()
+		d.host = d.ip.String()
+	}
+	return d
+}
+
+// matchHost reports whether d satisfies the rule's destination selectors.
+// Domains, CIDRs and IPLiteral are alternatives: a host matching any of them
+// matches, and a rule with none of them matches every host. CIDRs and
+// IPLiteral only match IP-literal destinations; names are never resolved.
+func (r *Rule) matchHost(d destination) bool {
+	if len(r.Domains) == 0 && len(r.CIDRs) == 0 && !r.IPLiteral {
+		return true
+	}
+	for _, p := range r.Domains {
+		if matchDomain(d.host, p) {
+			return true
+		}
+	}
+	if !d.ip.IsValid() {
+		return false
+	}
+	if r.IPLiteral {
+		return true
+	}
+	for _, c := range r.CIDRs {
+		if pfx, err := parseCIDR(c); err == nil && pfx.Contains(d.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPorts reports whether port is in one of the rule's Ports entries. An
+// empty list matches any port; an unknown port matches none.
+func (r *Rule) matchPorts(port int) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, s := range r.Ports {
+		if lo, hi, err := parsePortRange(s); err == nil && port >= lo && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDR parses a CIDR prefix or a bare address (a single-host prefix).
+// IPv4-mapped IPv6 prefixes are rewritten as IPv4 so they compare against the
+// unmapped addresses parseDestination produces.
+func parseCIDR(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	pfx, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if pfx.Addr().Is4In6() && pfx.Bits() >= 96 {
+		pfx = netip.PrefixFrom(pfx.Addr().Unmap(), pfx.Bits()-96)
+	}
+	return pfx.Masked(), nil
+}
+
+// parsePortRange parses "443" or an inclusive range "8000-8999".
+func parsePortRange(s string) (lo, hi int, err error) {
+	a, b, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if lo, err = parsePort(a); err != nil {
+		return 0, 0, err
+	}
+	hi = lo
+	if isRange {
+		if hi, err = parsePort(b); err != nil {
+			return 0, 0, err
+		}
+		if hi < lo {
+			return 0, 0, fmt.Errorf("port range %q is reversed", s)
+		}
+	}
+	return lo, hi, nil
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return p, nil
+}
+
+// ValidateMatch checks that a rule's CIDRs and Ports parse.
+func ValidateMatch(r Rule) error {
+	for _, c := range r.CIDRs {
+		if _, err := parseCIDR(c); err != nil {
+			return fmt.Errorf("invalid cidr %q", c)
+		}
+	}
+	for _, p := range r.Ports {
+		if _, _, err := parsePortRange(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEvaluateRichPorts(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "api-8443", AgentID: "*", Domains: []string{"api.internal"}, Ports: []string{"8443"}, Action: "allow"},
+		{PolicyID: "dev-range", AgentID: "*", Domains: []string{"dev.internal"}, Ports: []string{"8000-8999"}, Action: "allow"},
+		{PolicyID: "web", AgentID: "*", Domains: []string{"web.internal"}, Ports: []string{"80"}, Action: "allow"},
+	}
+
+	cases := []struct {
+		dest, method, want string
+	}{
+		{"api.internal:8443", "CONNECT", "api-8443"},
+		{"api.internal:443", "CONNECT", "default-deny"},
+		{"api.internal", "CONNECT", "default-deny"}, // bare CONNECT authority is 443
+		{"dev.internal:8000", "CONNECT", "dev-range"},
+		{"dev.internal:8999", "GET", "dev-range"},
+		{"dev.internal:9000", "GET", "default-deny"},
+		{"web.internal", "GET", "web"}, // bare plain-HTTP host is 80
+		{"web.internal:8080", "GET", "default-deny"},
+	}
+	for _, c := range cases {
+		d := eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: c.dest, Method: c.method})
+		if d.PolicyID != c.want {
+			t.Errorf("%s %s: got %s, want %s", c.method, c.dest, d.PolicyID, c.want)
+		}
+	}
+}
+
+func TestEvaluateRichCIDR(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "deny-10", AgentID: "*", CIDRs: []string{"10.0.0.0/8"}, Action: "deny"},
+		{PolicyID: "doc-v6", AgentID: "*", CIDRs: []string{"2001:db8::/32"}, Ports: []string{"443"}, Action: "allow"},
+		{PolicyID: "host", AgentID: "*", CIDRs: []string{"192.0.2.7"}, Action: "allow"},
+		{PolicyID: "names", AgentID: "*", Domains: []string{"*"}, Action: "allow"},
+	}
+
+	cases := []struct {
+		dest, want string
+	}{
+		{"10.1.2.3:443", "deny-10"},
+		{"[::ffff:10.1.2.3]:443", "deny-10"}, // v4-mapped is the v4 address
+		{"[2001:db8::1]:443", "doc-v6"},
+		{"[2001:DB8:0::1%eth0]:443", "doc-v6"}, // case, zero runs and zones normalize
+		{"[2001:db8::1]", "doc-v6"},            // bare CONNECT host is port 443
+		{"192.0.2.7:22", "host"},
+		{"192.0.2.8:22", "names"},
+		{"ten.example:443", "names"}, // names never match CIDRs
+	}
+	for _, c := range cases {
+		d := eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: c.dest, Method: "CONNECT"})
+		if d.PolicyID != c.want {
+			t.Errorf("%s: got %s, want %s", c.dest, d.PolicyID, c.want)
+		}
+	}
+}
+
+func TestEvaluateRichIPLiteral(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "no-raw-ip", AgentID: "*", IPLiteral: true, Action: "deny"},
+		{PolicyID: "allow-all", AgentID: "*", Domains: []string{"*"}, Action: "allow"},
+	}
+	for _, dest := range []string{"203.0.113.9:443", "[2001:db8::1]:443", "127.0.0.1"} {
+		if d := eng.Evaluate("a1", dest); d.PolicyID != "no-raw-ip" {
+			t.Errorf("%s: got %s, want no-raw-ip", dest, d.PolicyID)
+		}
+	}
+	if d := eng.Evaluate("a1", "example.com:443"); d.PolicyID != "allow-all" {
+		t.Errorf("name should not match ip_literal, got %s", d.PolicyID)
+	}
+}
+
+func TestInspectRequiredPorts(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "inspect-8443", AgentID: "*", Domains: []string{"api.example.com"}, Ports: []string{"8443"}, Inspect: true, Methods: []string{"GET"}, Action: "allow"},
+		{PolicyID: "api", AgentID: "*", Domains: []string{"api.example.com"}, Action: "allow"},
+	}
+	if !eng.InspectRequired(RequestContext{AgentID: "a1", Destination: "api.example.com:8443", Method: "CONNECT"}) {
+		t.Fatal("port 8443 should be inspected")
+	}
+	if eng.InspectRequired(RequestContext{AgentID: "a1", Destination: "api.example.com:443", Method: "CONNECT"}) {
+		t.Fatal("port 443 should not be inspected")
+	}
+}
+
+func TestValidateMatch(t *testing.T) {
+	good := Rule{CIDRs: []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.1"}, Ports: []string{"443", "8000-8999"}}
+	if err := ValidateMatch(good); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Rule{
+		{CIDRs: []string{"10.0.0.0/33"}},
+		{CIDRs: []string{"example.com"}},
+		{Ports: []string{"0"}},
+		{Ports: []string{"65536"}},
+		{Ports: []string{"9000-8000"}},
+		{Ports: []string{"https"}},
+	} {
+		if ValidateMatch(r) == nil {
+			t.Errorf("expected error for cidrs=%v ports=%v", r.CIDRs, r.Ports)
+		}
+	}
+}
+
+func TestLoadRejectsBadPorts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(path, []byte(`[{"policy_id":"p1","domains":["*"],"ports":["80-"],"action":"allow"}]`), 0o644)
+	if _, err := NewEngine(path); err == nil {
+		t.Fatal("expected load error for invalid port range")
+	}
+}
@@ -1,6 +1,12 @@
 package policy
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/egress"
+)
 
 func TestEvaluateRichMethodFilter(t *testing.T) {
 	eng := &Engine{}
@@ -166,3 +172,114 @@ func TestEvaluateRichEmptyMethodMatchesAll(t *testing.T) {
 		t.Fatalf("empty Methods should match all methods")
 	}
 }
+
+func TestEvaluateRichProtocolCondition(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "no-raw-tcp", AgentID: "*", Domains: []string{"*"}, Conditions: map[string]string{"protocol": "unknown"}, Action: "deny"},
+		{PolicyID: "allow-all", AgentID: "*", Domains: []string{"*"}, Action: "allow"},
+	}
+
+	// Before the payload is seen the protocol rule must not fire.
+	d := eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "example.com:443", Method: "CONNECT"})
+	if d.PolicyID != "allow-all" {
+		t.Fatalf("unknown-yet protocol should skip protocol rules, got %s", d.PolicyID)
+	}
+	d = eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "example.com:443", Method: "CONNECT", Protocol: "unknown"})
+	if d.Action != "deny" || d.PolicyID != "no-raw-tcp" {
+		t.Fatalf("non-TLS payload should be denied, got %s/%s", d.Action, d.PolicyID)
+	}
+	d = eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "example.com:443", Method: "CONNECT", Protocol: "tls"})
+	if d.Action != "allow" {
+		t.Fatalf("TLS payload should be allowed, got %s", d.Action)
+	}
+}
+
+func TestEvaluateRichUpgradeCondition(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "ws-tools", AgentID: "*", Domains: []string{"tools.internal"}, PathPrefixes: []string{"/ws/"}, Conditions: map[string]string{"upgrade": "websocket"}, Action: "allow"},
+		{PolicyID: "default-deny", AgentID: "*", Domains: []string{"*"}, Action: "deny"},
+	}
+
+	d := eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "tools.internal", Method: "GET", Path: "/ws/chat", Upgrade: "websocket"})
+	if d.PolicyID != "ws-tools" {
+		t.Fatalf("websocket upgrade should match, got %s", d.PolicyID)
+	}
+	// A plain GET to the same path is not an upgrade.
+	d = eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "tools.internal", Method: "GET", Path: "/ws/chat"})
+	if d.PolicyID != "default-deny" {
+		t.Fatalf("plain request must not match upgrade rule, got %s", d.PolicyID)
+	}
+	d = eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "tools.internal", Method: "GET", Path: "/ws/chat", Upgrade: "h2c"})
+	if d.PolicyID != "default-deny" {
+		t.Fatalf("other upgrade protocols must not match, got %s", d.PolicyID)
+	}
+}
+
+func TestExplicitMethod(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "ntp", AgentID: "a1", Domains: []string{"ntp.example.com"}, Ports: []string{"123"}, Methods: []string{"UDP"}, Action: "allow"},
+		{PolicyID: "allow-all", AgentID: "*", Domains: []string{"*"}, Action: "allow"},
+	}
+
+	d := eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "ntp.example.com:123", Method: "UDP"})
+	if d.PolicyID != "ntp" || !d.Explicit {
+		t.Fatalf("want explicit match on ntp, got %s explicit=%v", d.PolicyID, d.Explicit)
+	}
+	// The catch-all allows, but does not name the method.
+	d = eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "dns.example.com:53", Method: "UDP"})
+	if d.Action != "allow" || d.Explicit {
+		t.Fatalf("catch-all should not be explicit, got %s explicit=%v", d.PolicyID, d.Explicit)
+	}
+
+	if !eng.ExplicitlyAllowsMethod(RequestContext{AgentID: "a1", Method: "udp"}) {
+		t.Fatal("a1 has an explicit UDP rule")
+	}
+	if eng.ExplicitlyAllowsMethod(RequestContext{AgentID: "a2", Method: "UDP"}) {
+		t.Fatal("a2 has no explicit UDP rule")
+	}
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "stream", AgentID: "*", Domains: []string{"stream.example.com"}, IdleTimeout: 300, MaxDuration: 3600, Action: "allow"},
+		{PolicyID: "allow-all", AgentID: "*", Domains: []string{"*"}, Action: "allow"},
+	}
+	d := eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "stream.example.com:443", Method: "CONNECT"})
+	if d.IdleTimeout != 5*time.Minute || d.MaxDuration != time.Hour {
+		t.Fatalf("got idle %s max %s", d.IdleTimeout, d.MaxDuration)
+	}
+	d = eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "other.example.com:443", Method: "CONNECT"})
+	if d.IdleTimeout != 0 || d.MaxDuration != 0 {
+		t.Fatalf("rule without timeouts: got idle %s max %s", d.IdleTimeout, d.MaxDuration)
+	}
+	if err := ValidateRule(Rule{PolicyID: "x", Domains: []string{"*"}, Action: "allow", IdleTimeout: -1}); err == nil {
+		t.Fatal("negative idle_timeout_s should be rejected")
+	}
+}
+
+func TestEgressSourceDecision(t *testing.T) {
+	var rules []Rule
+	if err := json.Unmarshal([]byte(`[
+		{"policy_id":"pinned","agent_id":"*","domains":["api.partner.example"],"action":"allow","egress_address":"203.0.113.10","address_family":"ipv4"},
+		{"policy_id":"allow-all","agent_id":"*","domains":["*"],"action":"allow"}
+	]`), &rules); err != nil {
+		t.Fatal(err)
+	}
+	eng := &Engine{rules: rules}
+	d := eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "api.partner.example:443", Method: "CONNECT"})
+	if d.Egress != (egress.Source{Address: "203.0.113.10", Family: egress.FamilyIPv4}) {
+		t.Fatalf("got egress %+v", d.Egress)
+	}
+	if d = eng.EvaluateRich(RequestContext{AgentID: "a1", Destination: "other.example:443", Method: "CONNECT"}); d.Egress != (egress.Source{}) {
+		t.Fatalf("rule without egress: got %+v", d.Egress)
+	}
+	bad := Rule{PolicyID: "x", Domains: []string{"*"}, Action: "allow"}
+	bad.Address, bad.Family = "203.0.113.10", egress.FamilyIPv6
+	if err := ValidateRule(bad); err == nil {
+		t.Fatal("egress_address contradicting address_family should be rejected")
+	}
+}
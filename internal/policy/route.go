@@ -0,0 +1,59 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Route types for Rule.Upstreams.
+const (
+	RouteDirect = "direct"
+	RouteHTTP   = "http"   // parent proxy reached with HTTP CONNECT (or absolute-form for plain HTTP)
+	RouteSOCKS5 = "socks5" // parent proxy reached with SOCKS5 CONNECT
+)
+
+// Route is one egress path for traffic a rule allows. A rule's Upstreams are
+// tried in order, so later entries are fallbacks; an empty list dials directly.
+type Route struct {
+	Type     string `json:"type"`              // direct | http | socks5
+	Address  string `json:"address,omitempty"` // parent proxy host:port; unused for direct
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// String names the route without credentials, e.g. "socks5://parent:1080".
+// It is what audit events and metrics record.
+func (r Route) String() string {
+	if r.Type == RouteDirect || r.Type == "" {
+		return RouteDirect
+	}
+	return r.Type + "://" + r.Address
+}
+
+// ValidateRoutes checks that every route has a known type and, for parent
+// proxies, a host:port address.
+func ValidateRoutes(routes []Route) error {
+	for i, r := range routes {
+		switch r.Type {
+		case RouteDirect:
+			if r.Address != "" {
+				return fmt.Errorf("upstreams[%d]: direct route takes no address", i)
+			}
+		case RouteHTTP, RouteSOCKS5:
+			host, port, err := net.SplitHostPort(r.Address)
+			if err != nil || host == "" {
+				return fmt.Errorf("upstreams[%d]: address %q must be host:port", i, r.Address)
+			}
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("upstreams[%d]: invalid port %q", i, port)
+			}
+		default:
+			return fmt.Errorf("upstreams[%d]: type must be %q, %q or %q", i, RouteDirect, RouteHTTP, RouteSOCKS5)
+		}
+		if r.Password != "" && r.Username == "" {
+			return fmt.Errorf("upstreams[%d]: password without username", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	good := []Route{
+		{Type: RouteHTTP, Address: "parent.corp:3128", Username: "u", Password: "p"},
+		{Type: RouteSOCKS5, Address: "[2001:db8::1]:1080"},
+		{Type: RouteDirect},
+	}
+	if err := ValidateRoutes(good); err != nil {
+		t.Fatalf("valid routes rejected: %v", err)
+	}
+
+	bad := []Route{
+		{Type: "ftp", Address: "x:21"},
+		{Type: RouteHTTP},
+		{Type: RouteHTTP, Address: "parent.corp"},
+		{Type: RouteSOCKS5, Address: "parent.corp:0"},
+		{Type: RouteDirect, Address: "parent.corp:3128"},
+		{Type: RouteHTTP, Address: "parent.corp:3128", Password: "p"},
+	}
+	for _, r := range bad {
+		if err := ValidateRoutes([]Route{r}); err == nil {
+			t.Errorf("route %+v should be rejected", r)
+		}
+	}
+}
+
+func TestRouteStringOmitsCredentials(t *testing.T) {
+	r := Route{Type: RouteSOCKS5, Address: "parent:1080", Username: "u", Password: "secret"}
+	if got := r.String(); got != "socks5://parent:1080" {
+		t.Fatalf("got %q", got)
+	}
+	if got := (Route{}).String(); got != RouteDirect {
+		t.Fatalf("zero route should be direct, got %q", got)
+	}
+}
+
+func TestEvaluateReturnsUpstreams(t *testing.T) {
+	eng := &Engine{}
+	eng.rules = []Rule{
+		{PolicyID: "corp", AgentID: "*", Domains: []string{"*.corp.example"}, Action: "allow",
+			Upstreams: []Route{{Type: RouteHTTP, Address: "parent:3128"}, {Type: RouteDirect}}},
+		{PolicyID: "rest", AgentID: "*", Domains: []string{"*"}, Action: "allow"},
+	}
+	d := eng.Evaluate("a1", "api.corp.example:443")
+	if len(d.Upstreams) != 2 || d.Upstreams[0].Address != "parent:3128" {
+		t.Fatalf("want rule upstreams, got %+v", d.Upstreams)
+	}
+	if d := eng.Evaluate("a1", "example.org"); len(d.Upstreams) != 0 {
+		t.Fatalf("rule without upstreams should dial direct, got %+v", d.Upstreams)
+	}
+}
+
+func TestLoadRejectsInvalidRoute(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(path, []byte(`[{"policy_id":"p1","domains":["*"],"action":"allow",
+		"upstreams":[{"type":"socks5","address":"no-port"}]}]`), 0o644)
+	if _, err := NewEngine(path); err == nil {
+		t.Fatal("invalid upstream route should fail Load")
+	}
+}
@@ -0,0 +1,295 @@
+// Package proxyproto reads HAProxy PROXY protocol headers (v1 text and v2
+// binary) so that a listener behind a load balancer sees the real client
+// address. Only connections from trusted balancer addresses are parsed; a
+// header from anyone else would let clients forge their source address.
+//
+// Spec: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds how long a trusted peer may take to send its header.
+const DefaultTimeout = 5 * time.Second
+
+var (
+	sigV1 = []byte("PROXY ")
+	sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ErrNoHeader is returned when a trusted peer's stream does not start with a
+// PROXY protocol header.
+var ErrNoHeader = errors.New("proxyproto: missing PROXY protocol header")
+
+// Header is a parsed PROXY protocol header. Source and Destination are zero
+// for v1 "UNKNOWN" and v2 LOCAL headers (balancer health checks), in which
+// case the connection's own addresses stand.
+type Header struct {
+	Version     int
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// ReadHeader reads one PROXY protocol header from r.
+func ReadHeader(r *bufio.Reader) (Header, error) {
+	sig, err := r.Peek(len(sigV1))
+	if err != nil {
+		return Header{}, fmt.Errorf("proxyproto: header: %w", err)
+	}
+	if bytes.Equal(sig, sigV1) {
+		return readV1(r)
+	}
+	sig, err = r.Peek(len(sigV2))
+	if err == nil && bytes.Equal(sig, sigV2) {
+		return readV2(r)
+	}
+	return Header{}, ErrNoHeader
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n" (at most 107 bytes).
+func readV1(r *bufio.Reader) (Header, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return Header{}, fmt.Errorf("proxyproto: v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return Header{}, errors.New("proxyproto: v1 header not terminated by CRLF")
+	}
+	f := strings.Split(s, " ")
+	h := Header{Version: 1}
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return Header{}, fmt.Errorf("proxyproto: malformed v1 header %q", s)
+	}
+	src, err1 := parseAddrPort(f[2], f[4])
+	dst, err2 := parseAddrPort(f[3], f[5])
+	if err := errors.Join(err1, err2); err != nil {
+		return Header{}, fmt.Errorf("proxyproto: v1 header: %w", err)
+	}
+	if (f[1] == "TCP4") != src.Addr().Is4() || src.Addr().Is4() != dst.Addr().Is4() {
+		return Header{}, fmt.Errorf("proxyproto: v1 address family mismatch in %q", s)
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseAddrPort(ip, port string) (netip.AddrPort, error) {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", port)
+	}
+	return netip.AddrPortFrom(a, uint16(p)), nil
+}
+
+// readV2 parses the binary header: signature, version/command, family,
+// length, addresses and TLVs (which are skipped).
+func readV2(r *bufio.Reader) (Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return Header{}, fmt.Errorf("proxyproto: v2 header: %w", err)
+	}
+	if fixed[12]>>4 != 2 {
+		return Header{}, fmt.Errorf("proxyproto: unsupported v2 version %d", fixed[12]>>4)
+	}
+	cmd, fam := fixed[12]&0x0f, fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Header{}, fmt.Errorf("proxyproto: v2 header: %w", err)
+	}
+	h := Header{Version: 2}
+	switch cmd {
+	case 0x0: // LOCAL: the balancer's own connection
+		return h, nil
+	case 0x1: // PROXY
+	default:
+		return Header{}, fmt.Errorf("proxyproto: unsupported v2 command %d", cmd)
+	}
+	var n int
+	switch fam >> 4 {
+	case 0x1: // AF_INET
+		n = 4
+	case 0x2: // AF_INET6
+		n = 16
+	default: // AF_UNSPEC, AF_UNIX: no usable address
+		return h, nil
+	}
+	if fam&0x0f != 0x1 {
+		// Only a STREAM address describes the TCP connection we accepted.
+		return Header{}, fmt.Errorf("proxyproto: unsupported v2 transport %d", fam&0x0f)
+	}
+	if len(body) < 2*n+4 {
+		return Header{}, errors.New("proxyproto: v2 address block too short")
+	}
+	src, _ := netip.AddrFromSlice(body[:n])
+	dst, _ := netip.AddrFromSlice(body[n : 2*n])
+	h.Source = netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[2*n:]))
+	h.Destination = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(body[2*n+2:]))
+	return h, nil
+}
+
+// Listener accepts connections and, for peers inside Trusted, reads a PROXY
+// protocol header before any data. Peers outside Trusted are returned as is.
+type Listener struct {
+	net.Listener
+	Trusted []netip.Prefix
+	Timeout time.Duration // header read deadline; 0 = DefaultTimeout
+}
+
+// Accept returns the next connection. The header is read lazily, on the
+// connection's first Read or RemoteAddr call, so a slow balancer cannot
+// stall the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Conn{Conn: c, timeout: timeout}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	a, ok := netip.AddrFromSlice(ta.IP)
+	if !ok {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range l.Trusted {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted peer. RemoteAddr reports the client
+// named by its PROXY header.
+type Conn struct {
+	net.Conn
+	timeout time.Duration
+
+	once sync.Once
+	br   *bufio.Reader
+	hdr  Header
+	err  error
+
+	mu       sync.Mutex
+	deadline time.Time // the owner's read deadline, restored after the header
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.br = bufio.NewReader(c.Conn)
+		c.hdr, c.err = ReadHeader(c.br)
+		if c.hdr.Source.IsValid() {
+			c.hdr.Source = netip.AddrPortFrom(c.hdr.Source.Addr().Unmap(), c.hdr.Source.Port())
+		}
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+	})
+}
+
+// SetDeadline sets the read and write deadlines. A read deadline set before
+// the header arrives takes effect once it has been read.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline; see SetDeadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Header returns the parsed PROXY header, reading it if necessary.
+func (c *Conn) Header() (Header, error) {
+	c.init()
+	return c.hdr, c.err
+}
+
+// Read reads data following the header. It fails if the header was invalid.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+// RemoteAddr returns the client address from the header, or the peer's own
+// address for LOCAL/UNKNOWN headers and unreadable ones.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.err == nil && c.hdr.Source.IsValid() {
+		return net.TCPAddrFromAddrPort(c.hdr.Source)
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection, e.g. for SO_ORIGINAL_DST.
+func (c *Conn) NetConn() net.Conn { return c.Conn }
+
+// ParseTrusted parses a list of IPs and CIDRs.
+func ParseTrusted(entries []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if strings.Contains(e, "/") {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", e, err)
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", e, err)
+		}
+		a = a.Unmap()
+		out = append(out, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return out, nil
+}
@@ -0,0 +1,164 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	b := append([]byte{}, sigV2...)
+	b = append(b, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 10, 10, 0, 0, 1, 0x30, 0x39, 0x0c, 0x38} // 192.0.2.10:12345 -> 10.0.0.1:3128
+	v6 := make([]byte, 36)
+	copy(v6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	copy(v6[16:], netip.MustParseAddr("2001:db8::2").AsSlice())
+	binary.BigEndian.PutUint16(v6[32:], 443)
+	binary.BigEndian.PutUint16(v6[34:], 3128)
+	withTLV := append(append([]byte{}, v4...), 0x04, 0x00, 0x01, 0xff) // PP2_TYPE_NOOP
+
+	cases := []struct {
+		name    string
+		in      string
+		version int
+		src     string
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.10 10.0.0.1 12345 3128\r\n", 1, "192.0.2.10:12345"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 443 3128\r\n", 1, "[2001:db8::1]:443"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", 1, ""},
+		{"v2 tcp4", string(v2Header(1, 0x11, v4)), 2, "192.0.2.10:12345"},
+		{"v2 tcp6", string(v2Header(1, 0x21, v6)), 2, "[2001:db8::1]:443"},
+		{"v2 tlv", string(v2Header(1, 0x11, withTLV)), 2, "192.0.2.10:12345"},
+		{"v2 local", string(v2Header(0, 0x00, nil)), 2, ""},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.in + "GET / HTTP/1.1\r\n"))
+		h, err := ReadHeader(r)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		src := ""
+		if h.Source.IsValid() {
+			src = h.Source.String()
+		}
+		if h.Version != c.version || src != c.src {
+			t.Errorf("%s: got v%d %q, want v%d %q", c.name, h.Version, src, c.version, c.src)
+		}
+		if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: header consumed payload, rest %q", c.name, rest)
+		}
+	}
+}
+
+func TestReadHeaderRejects(t *testing.T) {
+	for _, in := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 192.0.2.10 10.0.0.1 12345\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n",
+		"PROXY TCP4 192.0.2.10 10.0.0.1 99999 3128\r\n",
+		"PROXY TCP4 192.0.2.10 10.0.0.1 1 2\n",
+		"PROXY " + strings.Repeat("x", 200),
+		string(v2Header(1, 0x11, []byte{1, 2, 3})),
+		string(v2Header(2, 0x11, nil)),
+		string(v2Header(1, 0x12, make([]byte, 12))), // UDP over IPv4
+		string(v2Header(1, 0x20, make([]byte, 36))), // IPv6, unspecified transport
+	} {
+		if _, err := ReadHeader(bufio.NewReader(strings.NewReader(in))); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trusted string
+		want    string
+	}{
+		{"trusted", "127.0.0.0/8", "192.0.2.10"},
+		{"untrusted", "10.0.0.0/8", "127.0.0.1"},
+	} {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted, _ := ParseTrusted([]string{tc.trusted})
+		ln := &Listener{Listener: inner, Trusted: trusted, Timeout: time.Second}
+
+		go func() {
+			c, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			io.WriteString(c, "PROXY TCP4 192.0.2.10 10.0.0.1 12345 3128\r\nhello")
+		}()
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		if host != tc.want {
+			t.Errorf("%s: RemoteAddr = %s, want %s", tc.name, host, tc.want)
+		}
+		if tc.name == "trusted" {
+			b, _ := io.ReadAll(c)
+			if string(b) != "hello" {
+				t.Errorf("payload = %q", b)
+			}
+		}
+		c.Close()
+		ln.Close()
+	}
+}
+
+func TestListenerRequiresHeader(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	ln := &Listener{Listener: inner, Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}, Timeout: time.Second}
+	go func() {
+		c, _ := net.Dial("tcp", inner.Addr().String())
+		io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+		time.Sleep(100 * time.Millisecond)
+		c.Close()
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Read(make([]byte, 16)); !errors.Is(err, ErrNoHeader) {
+		t.Fatalf("Read err = %v, want ErrNoHeader", err)
+	}
+	if host, _, _ := net.SplitHostPort(c.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Fatalf("RemoteAddr = %s", host)
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	p, err := ParseTrusted([]string{"10.0.0.0/8", " 192.0.2.1 ", "::ffff:198.51.100.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != 4 || p[1].Bits() != 32 || !p[2].Addr().Is4() {
+		t.Fatalf("got %v", p)
+	}
+	if _, err := ParseTrusted([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
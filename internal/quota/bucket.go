@@ -5,22 +5,66 @@
 //
 //   - "hard_stop": reject the request with 429 when the bucket is empty
 //   - "alert_only": log the overage but allow the request through
+//
+// Agents and teams can also be limited to a number of concurrently open
+// requests and tunnels (see Acquire) and to a bandwidth (see Shaper).
 package quota
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
-// Limit defines rate limits for a single agent.
+// Limit defines limits for a single agent or, with TeamID set instead of
+// AgentID, for all of a team's agents together.
 type Limit struct {
-	AgentID string  `json:"agent_id"`
-	RPS     float64 `json:"rps"`  // requests per second (0 = unlimited)
-	RPM     float64 `json:"rpm"`  // requests per minute (0 = unlimited)
-	Mode    string  `json:"mode"` // "hard_stop" | "alert_only"
+	AgentID       string  `json:"agent_id,omitempty"`
+	TeamID        string  `json:"team_id,omitempty"`
+	RPS           float64 `json:"rps"`                      // requests per second (0 = unlimited)
+	RPM           float64 `json:"rpm"`                      // requests per minute (0 = unlimited)
+	MaxConcurrent int     `json:"max_concurrent,omitempty"` // open requests and tunnels (0 = unlimited)
+	BytesPerSec   int64   `json:"bytes_per_sec,omitempty"`  // both directions combined (0 = unlimited)
+	Mode          string  `json:"mode"`                     // "hard_stop" | "alert_only"
+}
+
+// teamPrefix starts the key of a team-wide limit.
+const teamPrefix = "team:"
+
+// TeamKey returns the key a team-wide limit is stored under.
+func TeamKey(teamID string) string { return teamPrefix + teamID }
+
+// Key returns the ID the limiter stores lim under: the agent ID, or
+// TeamKey(TeamID) for a team-wide limit. LookupByID and Remove take it.
+func (lim Limit) Key() string {
+	if lim.TeamID != "" {
+		return TeamKey(lim.TeamID)
+	}
+	return lim.AgentID
+}
+
+// Validate checks that lim names exactly one agent or team and sets at
+// least one non-negative limit. Request rates are per agent only.
+func (lim Limit) Validate() error {
+	switch {
+	case (lim.AgentID == "") == (lim.TeamID == ""):
+		return errors.New("exactly one of agent_id or team_id is required")
+	case strings.HasPrefix(lim.AgentID, teamPrefix):
+		return fmt.Errorf("agent_id must not start with %q", teamPrefix)
+	case lim.RPS < 0 || lim.RPM < 0 || lim.MaxConcurrent < 0 || lim.BytesPerSec < 0:
+		return errors.New("limits must not be negative")
+	case lim.TeamID != "" && (lim.RPS > 0 || lim.RPM > 0):
+		return errors.New("rps and rpm are per agent; a team limit sets max_concurrent or bytes_per_sec")
+	case lim.RPS == 0 && lim.RPM == 0 && lim.MaxConcurrent == 0 && lim.BytesPerSec == 0:
+		return errors.New("at least one of rps, rpm, max_concurrent or bytes_per_sec must be > 0")
+	case lim.Mode != "" && lim.Mode != "hard_stop" && lim.Mode != "alert_only":
+		return errors.New("mode must be 'hard_stop' or 'alert_only'")
+	}
+	return nil
 }
 
 // Decision is the result of a quota check.
@@ -28,6 +72,9 @@ type Decision struct {
 	Allowed bool
 	Mode    string // "hard_stop" | "alert_only" | "" (no limit)
 	Reason  string
+	// RetryAfter is how long until the exhausted bucket admits another
+	// request. Set whenever a limit was exceeded.
+	RetryAfter time.Duration
 }
 
 // bucket is an internal token bucket.
@@ -52,19 +99,69 @@ func (b *bucket) allow(now time.Time) bool {
 	return false
 }
 
-// agentBuckets holds per-second and per-minute buckets for one agent.
+// wait returns how long until the bucket holds a whole token.
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1.0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration((1.0 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take removes n tokens, going into debt if the bucket holds fewer, and
+// returns how long until the debt is repaid.
+func (b *bucket) take(now time.Time, n float64) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund returns n tokens taken but not used, up to the capacity.
+func (b *bucket) refund(n float64) {
+	b.tokens = min(b.tokens+n, b.capacity)
+}
+
+// agentBuckets holds the buckets for one agent or team.
 type agentBuckets struct {
-	rps *bucket
-	rpm *bucket
+	rps   *bucket
+	rpm   *bucket
+	bytes *bucket // bytes_per_sec, holding one second's worth
 }
 
-// Limiter enforces per-agent rate limits.
+// bucketsFor returns full buckets for lim's rates.
+func bucketsFor(lim *Limit, now time.Time) *agentBuckets {
+	ab := &agentBuckets{}
+	if lim.RPS > 0 {
+		ab.rps = &bucket{tokens: lim.RPS, capacity: lim.RPS, rate: lim.RPS, last: now}
+	}
+	if lim.RPM > 0 {
+		rpmRate := lim.RPM / 60.0
+		ab.rpm = &bucket{tokens: lim.RPM, capacity: lim.RPM, rate: rpmRate, last: now}
+	}
+	if lim.BytesPerSec > 0 {
+		bps := float64(lim.BytesPerSec)
+		ab.bytes = &bucket{tokens: bps, capacity: bps, rate: bps, last: now}
+	}
+	return ab
+}
+
+// Limiter enforces per-agent and per-team limits.
 // All methods are safe for concurrent use.
 type Limiter struct {
 	mu      sync.Mutex
-	limits  map[string]*Limit        // agent_id -> Limit
-	buckets map[string]*agentBuckets // agent_id -> buckets
+	limits  map[string]*Limit        // Limit.Key() -> Limit
+	buckets map[string]*agentBuckets // Limit.Key() -> buckets
 	path    string
+
+	// active counts open flows by agent ID and team key, whether or not a
+	// limit applies, so a limit added by a reload sees flows already open.
+	active map[string]int
 }
 
 // NewLimiter loads quota config from path. A missing file means no limits.
@@ -73,6 +170,7 @@ func NewLimiter(path string) (*Limiter, error) {
 		path:    path,
 		limits:  make(map[string]*Limit),
 		buckets: make(map[string]*agentBuckets),
+		active:  make(map[string]int),
 	}
 	if err := l.Load(); err != nil {
 		return nil, err
@@ -105,19 +203,14 @@ func (l *Limiter) Load() error {
 
 	for i := range limits {
 		lim := &limits[i]
+		if err := lim.Validate(); err != nil {
+			return fmt.Errorf("quotas %s: entry %d: %w", l.path, i, err)
+		}
 		if lim.Mode == "" {
 			lim.Mode = "hard_stop"
 		}
-		newLimits[lim.AgentID] = lim
-		ab := &agentBuckets{}
-		if lim.RPS > 0 {
-			ab.rps = &bucket{tokens: lim.RPS, capacity: lim.RPS, rate: lim.RPS, last: now}
-		}
-		if lim.RPM > 0 {
-			rpmRate := lim.RPM / 60.0
-			ab.rpm = &bucket{tokens: lim.RPM, capacity: lim.RPM, rate: rpmRate, last: now}
-		}
-		newBuckets[lim.AgentID] = ab
+		newLimits[lim.Key()] = lim
+		newBuckets[lim.Key()] = bucketsFor(lim, now)
 	}
 
 	l.mu.Lock()
@@ -146,16 +239,18 @@ func (l *Limiter) Check(agentID string) Decision {
 
 	if ab.rps != nil && !ab.rps.allow(now) {
 		return Decision{
-			Allowed: lim.Mode == "alert_only",
-			Mode:    lim.Mode,
-			Reason:  fmt.Sprintf("RPS limit exceeded (%.0f rps)", lim.RPS),
+			Allowed:    lim.Mode == "alert_only",
+			Mode:       lim.Mode,
+			Reason:     fmt.Sprintf("RPS limit exceeded (%.0f rps)", lim.RPS),
+			RetryAfter: ab.rps.wait(),
 		}
 	}
 	if ab.rpm != nil && !ab.rpm.allow(now) {
 		return Decision{
-			Allowed: lim.Mode == "alert_only",
-			Mode:    lim.Mode,
-			Reason:  fmt.Sprintf("RPM limit exceeded (%.0f rpm)", lim.RPM),
+			Allowed:    lim.Mode == "alert_only",
+			Mode:       lim.Mode,
+			Reason:     fmt.Sprintf("RPM limit exceeded (%.0f rpm)", lim.RPM),
+			RetryAfter: ab.rpm.wait(),
 		}
 	}
 
@@ -173,11 +268,12 @@ func (l *Limiter) All() []Limit {
 	return out
 }
 
-// LookupByID returns the limit for the given agent, or nil if not found.
-func (l *Limiter) LookupByID(agentID string) *Limit {
+// LookupByID returns the limit stored under key (an agent ID or a
+// TeamKey), or nil if not found.
+func (l *Limiter) LookupByID(key string) *Limit {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	lim, ok := l.limits[agentID]
+	lim, ok := l.limits[key]
 	if !ok {
 		return nil
 	}
@@ -185,39 +281,32 @@ func (l *Limiter) LookupByID(agentID string) *Limit {
 	return &cp
 }
 
-// Set adds or replaces a limit for an agent. Call Save() to persist.
-// Resets the token buckets for this agent.
+// Set adds or replaces a limit for an agent or team. Call Save() to persist.
+// Resets its token buckets.
 func (l *Limiter) Set(lim Limit) {
 	if lim.Mode == "" {
 		lim.Mode = "hard_stop"
 	}
-	now := time.Now()
-	ab := &agentBuckets{}
-	if lim.RPS > 0 {
-		ab.rps = &bucket{tokens: lim.RPS, capacity: lim.RPS, rate: lim.RPS, last: now}
-	}
-	if lim.RPM > 0 {
-		rpmRate := lim.RPM / 60.0
-		ab.rpm = &bucket{tokens: lim.RPM, capacity: lim.RPM, rate: rpmRate, last: now}
-	}
+	ab := bucketsFor(&lim, time.Now())
 
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	cp := lim
-	l.limits[lim.AgentID] = &cp
-	l.buckets[lim.AgentID] = ab
+	l.limits[lim.Key()] = &cp
+	l.buckets[lim.Key()] = ab
 }
 
-// Remove deletes a limit for an agent. Returns true if it existed.
-func (l *Limiter) Remove(agentID string) bool {
+// Remove deletes the limit stored under key (an agent ID or a TeamKey).
+// Returns true if it existed.
+func (l *Limiter) Remove(key string) bool {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	_, ok := l.limits[agentID]
+	_, ok := l.limits[key]
 	if !ok {
 		return false
 	}
-	delete(l.limits, agentID)
-	delete(l.buckets, agentID)
+	delete(l.limits, key)
+	delete(l.buckets, key)
 	return true
 }
 
@@ -62,6 +62,26 @@ func TestCheckAlertOnly(t *testing.T) {
 	}
 }
 
+func TestCheckRetryAfter(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	lim.Set(Limit{AgentID: "a1", RPM: 6, Mode: "hard_stop"})
+
+	for range 6 {
+		lim.Check("a1")
+	}
+	d := lim.Check("a1")
+	if d.Allowed {
+		t.Fatal("should be denied after exhausting 6 tokens")
+	}
+	// 6 rpm refills one token every 10s.
+	if d.RetryAfter <= 9*time.Second || d.RetryAfter > 10*time.Second {
+		t.Fatalf("want retry after ~10s, got %s", d.RetryAfter)
+	}
+	if ok := lim.Check("unlimited"); ok.RetryAfter != 0 {
+		t.Fatalf("allowed request should have no retry hint, got %s", ok.RetryAfter)
+	}
+}
+
 func TestCheckRecovery(t *testing.T) {
 	lim, _ := NewLimiter("/nonexistent")
 	lim.Set(Limit{AgentID: "a1", RPS: 100, Mode: "hard_stop"})
@@ -110,3 +130,59 @@ func TestSetRemoveSave(t *testing.T) {
 		t.Fatal("remove failed")
 	}
 }
+
+func TestValidate(t *testing.T) {
+	valid := []Limit{
+		{AgentID: "a1", RPS: 1},
+		{AgentID: "a1", MaxConcurrent: 10, Mode: "alert_only"},
+		{TeamID: "ml", BytesPerSec: 1 << 20},
+	}
+	for _, l := range valid {
+		if err := l.Validate(); err != nil {
+			t.Errorf("%+v: %v", l, err)
+		}
+	}
+	invalid := []Limit{
+		{RPS: 1},                                   // no agent or team
+		{AgentID: "a1", TeamID: "ml", RPS: 1},      // both
+		{AgentID: "team:ml", RPS: 1},               // reserved prefix
+		{AgentID: "a1"},                            // no limit
+		{AgentID: "a1", MaxConcurrent: -1, RPS: 1}, // negative
+		{TeamID: "ml", RPS: 1},                     // rates are per agent
+		{AgentID: "a1", RPS: 1, Mode: "soft"},
+	}
+	for _, l := range invalid {
+		if l.Validate() == nil {
+			t.Errorf("%+v: expected error", l)
+		}
+	}
+}
+
+func TestLoadTeamLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	os.WriteFile(path, []byte(`[
+		{"agent_id":"a1","rps":5,"max_concurrent":3},
+		{"team_id":"ml","max_concurrent":10,"bytes_per_sec":1048576}
+	]`), 0o644)
+
+	lim, err := NewLimiter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lim.LookupByID("a1"); got == nil || got.MaxConcurrent != 3 {
+		t.Fatalf("agent limit: %+v", got)
+	}
+	got := lim.LookupByID(TeamKey("ml"))
+	if got == nil || got.BytesPerSec != 1<<20 || got.Mode != "hard_stop" {
+		t.Fatalf("team limit: %+v", got)
+	}
+
+	// An invalid entry fails the load and keeps the limits in force.
+	os.WriteFile(path, []byte(`[{"team_id":"ml","rps":1}]`), 0o644)
+	if lim.Load() == nil {
+		t.Fatal("expected error for a team request rate")
+	}
+	if lim.LookupByID(TeamKey("ml")) == nil {
+		t.Fatal("failed load dropped limits")
+	}
+}
@@ -0,0 +1,83 @@
+package quota
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConcurrencyRetry is the Retry-After suggested when a concurrency limit
+// refuses a flow. Slots free up when other flows end, which the limiter
+// cannot predict.
+const ConcurrencyRetry = time.Second
+
+// flowKeys returns the keys a flow from agentID in teamID is counted under.
+func flowKeys(agentID, teamID string) []string {
+	if teamID == "" {
+		return []string{agentID}
+	}
+	return []string{agentID, TeamKey(teamID)}
+}
+
+// Acquire counts a new request or tunnel from agentID, a member of teamID,
+// against the agent's and the team's max_concurrent. If the decision allows
+// the flow, release must be called once it ends; it is safe to call more
+// than once. A refused flow is not counted and its release does nothing.
+// An alert_only limit allows and counts the flow but reports the overage.
+func (l *Limiter) Acquire(agentID, teamID string) (d Decision, release func()) {
+	keys := flowKeys(agentID, teamID)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d = Decision{Allowed: true}
+	for _, k := range keys {
+		lim := l.limits[k]
+		if lim == nil || lim.MaxConcurrent <= 0 {
+			continue
+		}
+		if l.active[k] < lim.MaxConcurrent {
+			if d.Mode == "" {
+				d.Mode = lim.Mode
+			}
+			continue
+		}
+		scope := "concurrency"
+		if lim.TeamID != "" {
+			scope = "team concurrency"
+		}
+		over := Decision{
+			Allowed:    lim.Mode == "alert_only",
+			Mode:       lim.Mode,
+			Reason:     fmt.Sprintf("%s limit exceeded (%d open)", scope, l.active[k]),
+			RetryAfter: ConcurrencyRetry,
+		}
+		if !over.Allowed {
+			return over, func() {}
+		}
+		if d.Reason == "" {
+			d = over
+		}
+	}
+
+	for _, k := range keys {
+		l.active[k]++
+	}
+	return d, sync.OnceFunc(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, k := range keys {
+			if l.active[k]--; l.active[k] <= 0 {
+				delete(l.active, k)
+			}
+		}
+	})
+}
+
+// Active returns the number of open flows counted under key (an agent ID or
+// a TeamKey).
+func (l *Limiter) Active(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active[key]
+}
@@ -0,0 +1,88 @@
+package quota
+
+import "testing"
+
+func TestAcquireAgentLimit(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	lim.Set(Limit{AgentID: "a1", MaxConcurrent: 2})
+
+	_, r1 := lim.Acquire("a1", "")
+	_, r2 := lim.Acquire("a1", "")
+	d, r3 := lim.Acquire("a1", "")
+	if d.Allowed || d.Mode != "hard_stop" || d.Reason == "" || d.RetryAfter != ConcurrencyRetry {
+		t.Fatalf("third flow should be refused: %+v", d)
+	}
+	r3() // a refused flow's release is a no-op
+	if n := lim.Active("a1"); n != 2 {
+		t.Fatalf("active = %d, want 2", n)
+	}
+
+	r1()
+	r1() // idempotent
+	if d, _ := lim.Acquire("a1", ""); !d.Allowed {
+		t.Fatalf("slot should be free after release: %+v", d)
+	}
+	r2()
+	if n := lim.Active("a1"); n != 1 {
+		t.Fatalf("active = %d, want 1", n)
+	}
+
+	// Other agents are unaffected and still counted.
+	if d, _ := lim.Acquire("a2", ""); !d.Allowed || d.Mode != "" {
+		t.Fatalf("unlimited agent: %+v", d)
+	}
+	if n := lim.Active("a2"); n != 1 {
+		t.Fatalf("unlimited agent active = %d, want 1", n)
+	}
+}
+
+func TestAcquireTeamLimit(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	lim.Set(Limit{TeamID: "ml", MaxConcurrent: 2})
+	lim.Set(Limit{AgentID: "a3", MaxConcurrent: 5, Mode: "alert_only"})
+
+	lim.Acquire("a1", "ml")
+	_, r := lim.Acquire("a2", "ml")
+	if d, _ := lim.Acquire("a3", "ml"); d.Allowed {
+		t.Fatalf("team limit should refuse a third member flow: %+v", d)
+	}
+	if n := lim.Active(TeamKey("ml")); n != 2 {
+		t.Fatalf("team active = %d, want 2", n)
+	}
+	if d, _ := lim.Acquire("a3", "other"); !d.Allowed {
+		t.Fatalf("another team is unaffected: %+v", d)
+	}
+	r()
+	if d, _ := lim.Acquire("a3", "ml"); !d.Allowed {
+		t.Fatalf("team slot should be free after release: %+v", d)
+	}
+}
+
+func TestAcquireAlertOnly(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	lim.Set(Limit{AgentID: "a1", MaxConcurrent: 1, Mode: "alert_only"})
+
+	lim.Acquire("a1", "")
+	d, _ := lim.Acquire("a1", "")
+	if !d.Allowed || d.Reason == "" {
+		t.Fatalf("alert_only should allow with a reason: %+v", d)
+	}
+	if n := lim.Active("a1"); n != 2 {
+		t.Fatalf("alert_only flows should be counted: active = %d", n)
+	}
+}
+
+func TestAcquireSurvivesReload(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	_, release := lim.Acquire("a1", "")
+
+	// A limit added while a flow is open counts that flow.
+	lim.Set(Limit{AgentID: "a1", MaxConcurrent: 1})
+	if d, _ := lim.Acquire("a1", ""); d.Allowed {
+		t.Fatalf("open flow should fill the new limit: %+v", d)
+	}
+	release()
+	if d, _ := lim.Acquire("a1", ""); !d.Allowed {
+		t.Fatalf("%+v", d)
+	}
+}
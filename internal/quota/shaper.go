@@ -0,0 +1,87 @@
+package quota
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Shaper paces one flow's bytes through its agent's and team's
+// bytes_per_sec buckets. The limits are looked up on every call, so a
+// reload applies to flows already open. Shaping delays bytes rather than
+// refusing them, so it applies in both modes. A nil Shaper never waits.
+type Shaper struct {
+	l    *Limiter
+	keys []string
+}
+
+// Shaper returns the shaper for a flow from agentID, a member of teamID.
+func (l *Limiter) Shaper(agentID, teamID string) *Shaper {
+	return &Shaper{l: l, keys: flowKeys(agentID, teamID)}
+}
+
+// Burst returns the most bytes one Wait should cover: one second at the
+// tightest applicable rate, or 0 if no bandwidth limit applies. Copy loops
+// move at most this much at a time so a slow flow trickles rather than
+// stalling and then bursting.
+func (s *Shaper) Burst() int {
+	if s == nil {
+		return 0
+	}
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+	burst := 0
+	for _, k := range s.keys {
+		if ab := s.l.buckets[k]; ab != nil && ab.bytes != nil {
+			c := int(min(ab.bytes.capacity, math.MaxInt32))
+			if burst == 0 || c < burst {
+				burst = c
+			}
+		}
+	}
+	return burst
+}
+
+// Wait charges n bytes to the buckets and waits until they are paid for,
+// returning how long it waited. Flows sharing a bucket queue behind each
+// other's debt, so together they keep to the rate. If ctx ends first the
+// caller will not send the bytes, so Wait refunds them and returns ctx's
+// error.
+func (s *Shaper) Wait(ctx context.Context, n int) (time.Duration, error) {
+	if s == nil || n <= 0 {
+		return 0, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var (
+		d       time.Duration
+		charged []*bucket
+	)
+	s.l.mu.Lock()
+	for _, k := range s.keys {
+		if ab := s.l.buckets[k]; ab != nil && ab.bytes != nil {
+			d = max(d, ab.bytes.take(now, float64(n)))
+			charged = append(charged, ab.bytes)
+		}
+	}
+	s.l.mu.Unlock()
+	if d <= 0 {
+		return 0, nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return d, nil
+	case <-ctx.Done():
+		s.l.mu.Lock()
+		for _, b := range charged {
+			b.refund(float64(n))
+		}
+		s.l.mu.Unlock()
+		return time.Since(now), ctx.Err()
+	}
+}
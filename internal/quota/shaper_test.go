@@ -0,0 +1,106 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// wait calls s.Wait without a deadline.
+func wait(s *Shaper, n int) time.Duration {
+	d, _ := s.Wait(context.Background(), n)
+	return d
+}
+
+func TestShaperUnlimited(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	s := lim.Shaper("a1", "ml")
+	if s.Burst() != 0 || wait(s, 1<<20) != 0 {
+		t.Fatal("no bandwidth limit should never wait")
+	}
+	var nilShaper *Shaper
+	if nilShaper.Burst() != 0 || wait(nilShaper, 10) != 0 {
+		t.Fatal("nil shaper should never wait")
+	}
+}
+
+func TestShaperPaces(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	lim.Set(Limit{AgentID: "a1", BytesPerSec: 10000})
+	s := lim.Shaper("a1", "")
+	if b := s.Burst(); b != 10000 {
+		t.Fatalf("burst = %d, want one second's worth", b)
+	}
+
+	// The bucket starts full: one burst passes, the next 1000 bytes owe 100ms.
+	start := time.Now()
+	if d := wait(s, 10000); d != 0 {
+		t.Fatalf("first burst waited %s", d)
+	}
+	d := wait(s, 1000)
+	if d < 90*time.Millisecond || d > 110*time.Millisecond {
+		t.Fatalf("waited %s, want ~100ms", d)
+	}
+	if el := time.Since(start); el < d {
+		t.Fatalf("returned after %s, before the %s wait", el, d)
+	}
+}
+
+func TestShaperTeamShared(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	lim.Set(Limit{AgentID: "a1", BytesPerSec: 1 << 20})
+	lim.Set(Limit{TeamID: "ml", BytesPerSec: 5000})
+	a, b := lim.Shaper("a1", "ml"), lim.Shaper("a2", "ml")
+	if a.Burst() != 5000 {
+		t.Fatalf("burst should follow the tighter team rate, got %d", a.Burst())
+	}
+
+	// Two members drain the same team bucket.
+	wait(a, 5000)
+	if d := wait(b, 500); d < 90*time.Millisecond {
+		t.Fatalf("second member should owe the team bucket, waited %s", d)
+	}
+	if d := wait(lim.Shaper("a3", "other"), 500); d != 0 {
+		t.Fatalf("another team waited %s", d)
+	}
+}
+
+func TestShaperFollowsReload(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	s := lim.Shaper("a1", "")
+	lim.Set(Limit{AgentID: "a1", BytesPerSec: 2000})
+	if s.Burst() != 2000 {
+		t.Fatal("open flow did not pick up the new limit")
+	}
+	lim.Remove("a1")
+	if s.Burst() != 0 || wait(s, 1<<20) != 0 {
+		t.Fatal("open flow still shaped after the limit was removed")
+	}
+}
+
+func TestShaperWaitCanceled(t *testing.T) {
+	lim, _ := NewLimiter("/nonexistent")
+	lim.Set(Limit{AgentID: "a1", BytesPerSec: 10000})
+	s := lim.Shaper("a1", "")
+	wait(s, 10000)
+
+	// A second burst owes a second; the flow ends long before that.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.Wait(ctx, 10000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the context's error, got %v", err)
+	}
+	if el := time.Since(start); el > 500*time.Millisecond {
+		t.Fatalf("canceled wait returned after %s", el)
+	}
+
+	// The unsent bytes were refunded: 1000 more owe ~100ms, not ~1.1s.
+	if d := wait(s, 1000); d > 200*time.Millisecond {
+		t.Fatalf("waited %s after a refunded wait", d)
+	}
+	if _, err := s.Wait(ctx, 1); err == nil {
+		t.Fatal("an ended context should not be charged")
+	}
+}
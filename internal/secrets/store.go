@@ -0,0 +1,166 @@
+// Package secrets holds the upstream credentials the gateway brokers on an
+// agent's behalf. Agents are given placeholders; the real values live only in
+// the gateway's secret file and are injected by policy header rules.
+//
+// Secret values must never reach audit events, metrics or logs: errors from
+// this package name the secret, not its value.
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+)
+
+// ErrNotFound is returned for a secret that is not in the store.
+var ErrNotFound = errors.New("secret not found")
+
+// Secret is one entry of the secret file. The value is given inline or read
+// from File (one trailing newline is trimmed), so it can live in a separate
+// file with tighter permissions.
+type Secret struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	File  string `json:"file,omitempty"`
+}
+
+// Store holds secret values by name.
+// All methods are safe for concurrent use.
+type Store struct {
+	mu     sync.RWMutex
+	values map[string]string
+	path   string
+}
+
+// NewStore loads the store from path. A missing file starts an empty store.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads the secret file atomically; on error the previous secrets stay
+// in use. Safe to call from a SIGHUP handler while the proxy is running.
+func (s *Store) Load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.mu.Lock()
+		s.values = make(map[string]string)
+		s.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read secrets %s: %w", s.path, err)
+	}
+
+	var entries []Secret
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("parse secrets %s: %w", s.path, err)
+	}
+	values := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if e.Name == "" {
+			return fmt.Errorf("parse secrets %s: entry without name", s.path)
+		}
+		if _, dup := values[e.Name]; dup {
+			return fmt.Errorf("parse secrets %s: duplicate secret %q", s.path, e.Name)
+		}
+		v := e.Value
+		if e.File != "" {
+			if v != "" {
+				return fmt.Errorf("parse secrets %s: secret %q sets both value and file", s.path, e.Name)
+			}
+			b, err := os.ReadFile(e.File)
+			if err != nil {
+				return fmt.Errorf("secret %q: %w", e.Name, err)
+			}
+			v = strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+		}
+		if v == "" {
+			return fmt.Errorf("parse secrets %s: secret %q is empty", s.path, e.Name)
+		}
+		if !policy.ValidHeaderValue(v) {
+			return fmt.Errorf("parse secrets %s: secret %q contains control characters", s.path, e.Name)
+		}
+		values[e.Name] = v
+	}
+
+	s.mu.Lock()
+	s.values = values
+	s.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the value of the named secret. A nil store has no secrets.
+func (s *Store) Lookup(name string) (string, error) {
+	if s == nil {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	s.mu.RLock()
+	v, ok := s.values[name]
+	s.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return v, nil
+}
+
+// Apply rewrites h by rules in order. A replace rule only needs its secret
+// when the agent actually sent the placeholder. On error h may be partly
+// rewritten and must not be forwarded.
+func (s *Store) Apply(h http.Header, rules []policy.HeaderRule) error {
+	for _, hr := range rules {
+		switch hr.Action {
+		case policy.HeaderRemove:
+			h.Del(hr.Name)
+		case policy.HeaderSet:
+			v := hr.Value
+			if hr.Secret != "" {
+				secret, err := s.Lookup(hr.Secret)
+				if err != nil {
+					return err
+				}
+				if v == "" {
+					v = secret
+				} else {
+					v = strings.ReplaceAll(v, policy.SecretToken, secret)
+				}
+			}
+			h.Set(hr.Name, v)
+		case policy.HeaderReplace:
+			vals := h.Values(hr.Name)
+			if !containsAny(vals, hr.Placeholder) {
+				continue
+			}
+			secret, err := s.Lookup(hr.Secret)
+			if err != nil {
+				return err
+			}
+			out := make([]string, len(vals))
+			for i, v := range vals {
+				out[i] = strings.ReplaceAll(v, hr.Placeholder, secret)
+			}
+			h[http.CanonicalHeaderKey(hr.Name)] = out
+		default:
+			return fmt.Errorf("header %s: unknown action %q", hr.Name, hr.Action)
+		}
+	}
+	return nil
+}
+
+func containsAny(vals []string, sub string) bool {
+	for _, v := range vals {
+		if strings.Contains(v, sub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package secrets
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+)
+
+func writeStore(t *testing.T, body string) *Store {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "anthropic.key")
+	if err := os.WriteFile(keyFile, []byte("sk-ant-real\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := writeStore(t, `[{"name":"openai","value":"sk-real"},{"name":"anthropic","file":"`+keyFile+`"}]`)
+	if v, err := s.Lookup("openai"); err != nil || v != "sk-real" {
+		t.Fatalf("openai = %q, %v", v, err)
+	}
+	if v, err := s.Lookup("anthropic"); err != nil || v != "sk-ant-real" {
+		t.Fatalf("anthropic = %q, %v", v, err)
+	}
+	if _, err := s.Lookup("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing: err = %v", err)
+	}
+
+	missing, err := NewStore(filepath.Join(dir, "none.json"))
+	if err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	if _, err := missing.Lookup("openai"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("empty store: err = %v", err)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	for _, body := range []string{
+		`[{"value":"x"}]`,
+		`[{"name":"a","value":"x"},{"name":"a","value":"y"}]`,
+		`[{"name":"a"}]`,
+		`[{"name":"a","value":"x","file":"/etc/hostname"}]`,
+		`[{"name":"a","value":"sk-real\r\nX-Evil: 1"}]`,
+	} {
+		path := filepath.Join(t.TempDir(), "secrets.json")
+		os.WriteFile(path, []byte(body), 0o600)
+		_, err := NewStore(path)
+		if err == nil {
+			t.Errorf("%s: expected error", body)
+			continue
+		}
+		if strings.Contains(err.Error(), "sk-real") {
+			t.Errorf("error leaks secret value: %v", err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	s := writeStore(t, `[{"name":"openai","value":"sk-real"}]`)
+	h := http.Header{}
+	h.Set("Authorization", "Bearer CLAWGRESS_OPENAI")
+	h.Set("X-Api-Key", "agent-supplied")
+	h.Set("Cookie", "a=b")
+
+	err := s.Apply(h, []policy.HeaderRule{
+		{Name: "Authorization", Action: policy.HeaderReplace, Secret: "openai", Placeholder: "CLAWGRESS_OPENAI"},
+		{Name: "X-Api-Key", Action: policy.HeaderSet, Secret: "openai"},
+		{Name: "OpenAI-Project", Action: policy.HeaderSet, Value: "proj-{secret}", Secret: "openai"},
+		{Name: "Cookie", Action: policy.HeaderRemove},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Authorization":  "Bearer sk-real",
+		"X-Api-Key":      "sk-real",
+		"Openai-Project": "proj-sk-real",
+		"Cookie":         "",
+	}
+	for k, v := range want {
+		if got := h.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestApplyMissingSecret(t *testing.T) {
+	s := writeStore(t, `[]`)
+	replace := []policy.HeaderRule{{Name: "Authorization", Action: policy.HeaderReplace, Secret: "openai", Placeholder: "PLACEHOLDER"}}
+
+	// Without the placeholder there is nothing to broker.
+	h := http.Header{"Authorization": {"Bearer own-key"}}
+	if err := s.Apply(h, replace); err != nil {
+		t.Fatalf("no placeholder: %v", err)
+	}
+
+	h = http.Header{"Authorization": {"Bearer PLACEHOLDER"}}
+	if err := s.Apply(h, replace); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("placeholder: err = %v", err)
+	}
+	var nilStore *Store
+	if err := nilStore.Apply(http.Header{}, []policy.HeaderRule{{Name: "X-Api-Key", Action: policy.HeaderSet, Secret: "openai"}}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("nil store: err = %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package security
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CRL checks client certificates against a certificate revocation list
+// issued by the client CA. Load re-reads both files; it is safe to call from
+// a SIGHUP handler while handshakes are in progress.
+type CRL struct {
+	path   string
+	caFile string
+
+	mu         sync.RWMutex
+	issuer     []byte              // raw subject of the CA that signed the list
+	revoked    map[string]struct{} // serial numbers, decimal
+	nextUpdate time.Time
+}
+
+// NewCRL loads the revocation list at path, which must be signed by a CA
+// in caFile. The list may be PEM ("X509 CRL") or DER.
+func NewCRL(path, caFile string) (*CRL, error) {
+	c := &CRL{path: path, caFile: caFile}
+	if err := c.Load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load re-reads the revocation list. On error the previous list stays in
+// force.
+func (c *CRL) Load() error {
+	cas, err := readCerts(c.caFile)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("read CRL: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return fmt.Errorf("%s: unexpected PEM block %q", c.path, block.Type)
+		}
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("parse CRL %s: %w", c.path, err)
+	}
+	signed := false
+	for _, ca := range cas {
+		if list.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("%s: not signed by a CA in %s", c.path, c.caFile)
+	}
+
+	revoked := make(map[string]struct{}, len(list.RevokedCertificateEntries))
+	for _, e := range list.RevokedCertificateEntries {
+		revoked[e.SerialNumber.String()] = struct{}{}
+	}
+	c.mu.Lock()
+	c.issuer = list.RawIssuer
+	c.revoked = revoked
+	c.nextUpdate = list.NextUpdate
+	c.mu.Unlock()
+	return nil
+}
+
+// Revoked reports whether the list revokes cert. Certificates from another
+// issuer are never revoked by it.
+func (c *CRL) Revoked(cert *x509.Certificate) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !bytes.Equal(cert.RawIssuer, c.issuer) {
+		return false
+	}
+	_, ok := c.revoked[cert.SerialNumber.String()]
+	return ok
+}
+
+// NextUpdate returns when the list's issuer promised a newer one; zero if
+// it did not say. A list past this time is still enforced.
+func (c *CRL) NextUpdate() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nextUpdate
+}
+
+// VerifyConnection rejects a handshake whose client certificate is revoked.
+// Use it as tls.Config.VerifyConnection; it runs after chain verification
+// and on resumed sessions too.
+func (c *CRL) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	if leaf := cs.PeerCertificates[0]; c.Revoked(leaf) {
+		return fmt.Errorf("client certificate %s is revoked", leaf.SerialNumber)
+	}
+	return nil
+}
+
+// Fingerprint returns the hex SHA-256 of cert's DER encoding.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// readCerts parses every certificate in a PEM file.
+func readCerts(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA cert: %w", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse CA cert %s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no valid certs in CA file")
+	}
+	return certs, nil
+}
@@ -0,0 +1,160 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string
+}
+
+func newTestCA(t *testing.T, dir, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	path := filepath.Join(dir, name+".crt")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	return testCA{cert: cert, key: key, path: path}
+}
+
+func (ca testCA) leaf(t *testing.T, serial int64) *x509.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func (ca testCA) writeCRL(t *testing.T, path string, serials ...int64) {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, s := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o644)
+}
+
+func TestCRL(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	crlPath := filepath.Join(dir, "ca.crl")
+	ca.writeCRL(t, crlPath, 2)
+
+	crl, err := NewCRL(crlPath, ca.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, good := ca.leaf(t, 2), ca.leaf(t, 3)
+	if !crl.Revoked(revoked) || crl.Revoked(good) {
+		t.Fatal("serial 2 should be revoked, 3 not")
+	}
+	if crl.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{revoked}}) == nil {
+		t.Fatal("handshake with a revoked certificate accepted")
+	}
+	if err := crl.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{good}}); err != nil {
+		t.Fatalf("good certificate: %v", err)
+	}
+	if crl.NextUpdate().IsZero() {
+		t.Fatal("next update not recorded")
+	}
+
+	// A certificate with the same serial from another CA is unaffected.
+	other := newTestCA(t, dir, "other")
+	if crl.Revoked(other.leaf(t, 2)) {
+		t.Fatal("revocation applied across issuers")
+	}
+
+	// Reload picks up new revocations.
+	ca.writeCRL(t, crlPath, 2, 3)
+	if err := crl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !crl.Revoked(good) {
+		t.Fatal("reload did not revoke serial 3")
+	}
+}
+
+func TestCRLRejectsForeignSigner(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	other := newTestCA(t, dir, "other")
+	crlPath := filepath.Join(dir, "other.crl")
+	other.writeCRL(t, crlPath, 2)
+
+	if _, err := NewCRL(crlPath, ca.path); err == nil {
+		t.Fatal("expected error for a CRL signed by another CA")
+	}
+
+	// A failed reload keeps the list in force.
+	ca.writeCRL(t, crlPath, 2)
+	crl, err := NewCRL(crlPath, ca.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.writeCRL(t, crlPath)
+	if crl.Load() == nil {
+		t.Fatal("expected reload error")
+	}
+	if !crl.Revoked(ca.leaf(t, 2)) {
+		t.Fatal("failed reload dropped revocations")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	ca := newTestCA(t, t.TempDir(), "ca")
+	fp := Fingerprint(ca.cert)
+	if len(fp) != 64 || fp != Fingerprint(ca.cert) {
+		t.Fatalf("fingerprint %q", fp)
+	}
+	if fp == Fingerprint(ca.leaf(t, 2)) {
+		t.Fatal("distinct certificates share a fingerprint")
+	}
+}
@@ -0,0 +1,16 @@
+package sniff
+
+import "testing"
+
+// FuzzParseClientHello throws random handshake bytes at the SNI parser.
+// Must never panic.
+func FuzzParseClientHello(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x01, 0x00, 0x00, 0x04, 0x03, 0x03, 0x00, 0x00})
+	f.Add([]byte{0x01, 0xff, 0xff, 0xff})
+	f.Add(make([]byte, 600))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, _ = ParseClientHello(b)
+	})
+}
@@ -0,0 +1,273 @@
+// Package sniff inspects the first bytes of a client stream without consuming
+// them. It recognizes a TLS ClientHello (extracting SNI) or a plain HTTP/1.x
+// request (extracting Host), and returns a conn that replays the peeked bytes.
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// Protocol values reported in Info.Protocol.
+const (
+	ProtoTLS     = "tls"
+	ProtoHTTP    = "http"
+	ProtoUnknown = "unknown"
+)
+
+const (
+	// maxTLSRecord is the largest TLS plaintext record (2^14) plus header slack.
+	maxTLSRecord = 5 + 16384 + 2048
+	// maxHTTPHead bounds how far we look for the end of request headers.
+	maxHTTPHead = 16 * 1024
+)
+
+// ErrNoServerName is returned by ParseClientHello when the hello carries no SNI.
+var ErrNoServerName = errors.New("sniff: no server_name extension")
+
+// Info describes what was recognized at the start of a stream.
+type Info struct {
+	Protocol   string // ProtoTLS | ProtoHTTP | ProtoUnknown
+	ServerName string // TLS SNI or HTTP Host (without port); empty if absent
+}
+
+// Conn is a net.Conn whose first reads replay the bytes consumed while sniffing.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *Conn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// Peek reads enough of conn to classify it, waiting at most timeout for the
+// client to speak. The returned Conn must be used in place of conn. A read
+// error (including timeout) is returned together with whatever was classified.
+func Peek(conn net.Conn, timeout time.Duration) (*Conn, Info, error) {
+	br := bufio.NewReaderSize(conn, maxTLSRecord)
+	c := &Conn{Conn: conn, r: br}
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	first, err := br.Peek(1)
+	if err != nil {
+		return c, Info{Protocol: ProtoUnknown}, err
+	}
+	if first[0] == 0x16 {
+		return c, peekTLS(br), nil
+	}
+	if looksLikeHTTP(br) {
+		return c, peekHTTP(br), nil
+	}
+	return c, Info{Protocol: ProtoUnknown}, nil
+}
+
+func peekTLS(br *bufio.Reader) Info {
+	info := Info{Protocol: ProtoUnknown}
+	hdr, err := br.Peek(5)
+	if err != nil || hdr[1] != 0x03 {
+		return info
+	}
+	n := int(binary.BigEndian.Uint16(hdr[3:5]))
+	if n == 0 || 5+n > maxTLSRecord {
+		return info
+	}
+	info.Protocol = ProtoTLS
+	// A hello that cannot be reassembled still counts as TLS, just without SNI.
+	if hello := peekHandshake(br); hello != nil {
+		info.ServerName, _ = ParseClientHello(hello)
+	}
+	return info
+}
+
+// peekHandshake reassembles the first handshake message from as many
+// handshake records as it spans, so a ClientHello fragmented across records
+// is parsed like an unfragmented one. It returns nil if the records stop
+// short of the message or it does not fit in the peek buffer.
+func peekHandshake(br *bufio.Reader) []byte {
+	var msg []byte
+	for off := 0; ; {
+		hdr, err := br.Peek(off + 5)
+		if err != nil || hdr[off] != 0x16 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(hdr[off+3 : off+5]))
+		if off+5+n > maxTLSRecord {
+			return nil
+		}
+		rec, err := br.Peek(off + 5 + n)
+		if err != nil {
+			return nil
+		}
+		msg = append(msg, rec[off+5:]...)
+		off += 5 + n
+		if len(msg) >= 4 {
+			if need := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])); len(msg) >= need {
+				return msg[:need]
+			}
+		}
+	}
+}
+
+var httpMethods = []string{"GET ", "POST ", "PUT ", "DELETE ", "HEAD ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+func looksLikeHTTP(br *bufio.Reader) bool {
+	// Peek as much as is already buffered (at least one byte is).
+	b, _ := br.Peek(min(br.Buffered(), 8))
+	for _, m := range httpMethods {
+		if len(b) >= len(m) && string(b[:len(m)]) == m {
+			return true
+		}
+		if len(b) < len(m) && strings.HasPrefix(m, string(b)) {
+			// Short read; fetch the full method token before deciding.
+			if full, err := br.Peek(len(m)); err == nil && string(full) == m {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func peekHTTP(br *bufio.Reader) Info {
+	info := Info{Protocol: ProtoHTTP}
+	// Grow the peek window one fill at a time until the header block is
+	// complete, the client stalls, or the cap is hit.
+	for {
+		b, err := br.Peek(br.Buffered())
+		if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+			info.ServerName = hostHeader(b[:i])
+			return info
+		}
+		if err != nil || len(b) >= maxHTTPHead {
+			info.ServerName = hostHeader(b)
+			return info
+		}
+		if _, err := br.Peek(len(b) + 1); err != nil {
+			b, _ = br.Peek(br.Buffered())
+			info.ServerName = hostHeader(b)
+			return info
+		}
+	}
+}
+
+func hostHeader(head []byte) string {
+	lines := strings.Split(string(head), "\r\n")
+	for _, l := range lines[1:] {
+		k, v, ok := strings.Cut(l, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), "host") {
+			return stripPort(strings.TrimSpace(v))
+		}
+	}
+	return ""
+}
+
+func stripPort(hostport string) string {
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+}
+
+// ParseClientHello extracts the SNI host name from a TLS handshake message
+// (the payload of the first handshake record, starting at the handshake type).
+func ParseClientHello(b []byte) (string, error) {
+	p := parser{b: b}
+	if t := p.u8(); t != 0x01 { // client_hello
+		return "", errors.New("sniff: not a ClientHello")
+	}
+	body := p.vec(3)
+	if p.err != nil {
+		return "", errors.New("sniff: truncated ClientHello")
+	}
+	p = parser{b: body}
+	p.skip(2 + 32) // legacy_version + random
+	p.vec(1)       // session_id
+	p.vec(2)       // cipher_suites
+	p.vec(1)       // compression_methods
+	if p.err != nil {
+		return "", errors.New("sniff: truncated ClientHello")
+	}
+	if len(p.b) == 0 {
+		return "", ErrNoServerName // no extensions at all
+	}
+	exts := parser{b: p.vec(2)}
+	if p.err != nil {
+		return "", errors.New("sniff: truncated extensions")
+	}
+	for len(exts.b) > 0 && exts.err == nil {
+		typ := exts.u16()
+		data := exts.vec(2)
+		if exts.err != nil || typ != 0x0000 { // server_name
+			continue
+		}
+		list := parser{b: data}
+		names := parser{b: list.vec(2)}
+		for len(names.b) > 0 && names.err == nil {
+			nameType := names.u8()
+			name := names.vec(2)
+			if names.err == nil && nameType == 0 { // host_name
+				return strings.ToLower(strings.TrimRight(string(name), ".")), nil
+			}
+		}
+		return "", errors.New("sniff: malformed server_name extension")
+	}
+	if exts.err != nil {
+		return "", errors.New("sniff: truncated extensions")
+	}
+	return "", ErrNoServerName
+}
+
+// parser is a bounds-checked big-endian reader; after the first short read
+// every accessor returns zero values and err is set.
+type parser struct {
+	b   []byte
+	err error
+}
+
+func (p *parser) take(n int) []byte {
+	if p.err != nil || n > len(p.b) {
+		p.err = errors.New("short")
+		p.b = nil
+		return nil
+	}
+	out := p.b[:n]
+	p.b = p.b[n:]
+	return out
+}
+
+func (p *parser) skip(n int) { p.take(n) }
+
+func (p *parser) u8() int {
+	b := p.take(1)
+	if b == nil {
+		return -1
+	}
+	return int(b[0])
+}
+
+func (p *parser) u16() int {
+	b := p.take(2)
+	if b == nil {
+		return -1
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+// vec reads a length-prefixed vector whose length field is lenBytes wide.
+func (p *parser) vec(lenBytes int) []byte {
+	lb := p.take(lenBytes)
+	if lb == nil {
+		return nil
+	}
+	n := 0
+	for _, c := range lb {
+		n = n<<8 | int(c)
+	}
+	return p.take(n)
+}
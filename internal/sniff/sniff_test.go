@@ -0,0 +1,170 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// captureClientHello returns the first TLS record a Go client sends for sni.
+func captureClientHello(t *testing.T, sni string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+	}()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(server, hdr); err != nil {
+		t.Fatal(err)
+	}
+	n := int(hdr[3])<<8 | int(hdr[4])
+	body := make([]byte, n)
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	return append(hdr, body...)
+}
+
+// pipeWith returns the server side of a pipe whose client writes payload.
+func pipeWith(t *testing.T, payload []byte) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		client.Write(payload)
+	}()
+	return server
+}
+
+func TestParseClientHello(t *testing.T) {
+	rec := captureClientHello(t, "API.Example.com")
+	name, err := ParseClientHello(rec[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "api.example.com" {
+		t.Fatalf("want api.example.com, got %q", name)
+	}
+}
+
+func TestParseClientHelloNoSNI(t *testing.T) {
+	// Go omits SNI for IP-literal server names.
+	rec := captureClientHello(t, "192.0.2.1")
+	if _, err := ParseClientHello(rec[5:]); err != ErrNoServerName {
+		t.Fatalf("want ErrNoServerName, got %v", err)
+	}
+}
+
+func TestParseClientHelloTruncated(t *testing.T) {
+	rec := captureClientHello(t, "example.com")
+	for _, n := range []int{0, 1, 4, 40, len(rec) / 2} {
+		if _, err := ParseClientHello(rec[5 : 5+n]); err == nil {
+			t.Fatalf("truncated hello (%d bytes) should fail", n)
+		}
+	}
+}
+
+func TestPeekTLSReplaysBytes(t *testing.T) {
+	rec := captureClientHello(t, "svc.example.com")
+	c, info, err := Peek(pipeWith(t, rec), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Protocol != ProtoTLS || info.ServerName != "svc.example.com" {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	got := make([]byte, len(rec))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(rec) {
+		t.Fatal("peeked bytes must be replayed unchanged")
+	}
+}
+
+func TestPeekHTTPHost(t *testing.T) {
+	req := "GET /x HTTP/1.1\r\nUser-Agent: t\r\nhost: Example.com:8080\r\n\r\n"
+	c, info, err := Peek(pipeWith(t, []byte(req)), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Protocol != ProtoHTTP || info.ServerName != "Example.com" {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	got := make([]byte, len(req))
+	io.ReadFull(c, got)
+	if string(got) != req {
+		t.Fatal("request must be replayed unchanged")
+	}
+}
+
+func TestPeekUnknown(t *testing.T) {
+	_, info, err := Peek(pipeWith(t, []byte("SSH-2.0-OpenSSH_9.6\r\n")), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Protocol != ProtoUnknown {
+		t.Fatalf("want unknown, got %+v", info)
+	}
+}
+
+func TestPeekTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, _, err := Peek(server, 50*time.Millisecond); err == nil {
+		t.Fatal("silent client should time out")
+	}
+}
+
+// fragment splits a single-record TLS hello into records of at most size
+// payload bytes each.
+func fragment(rec []byte, size int) []byte {
+	var out []byte
+	for body := rec[5:]; len(body) > 0; {
+		n := min(size, len(body))
+		out = append(out, rec[0], rec[1], rec[2], byte(n>>8), byte(n))
+		out = append(out, body[:n]...)
+		body = body[n:]
+	}
+	return out
+}
+
+func TestPeekTLSFragmentedHello(t *testing.T) {
+	frag := fragment(captureClientHello(t, "svc.example.com"), 40)
+	c, info, err := Peek(pipeWith(t, frag), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Protocol != ProtoTLS || info.ServerName != "svc.example.com" {
+		t.Fatalf("fragmented hello: %+v", info)
+	}
+	got := make([]byte, len(frag))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(frag) {
+		t.Fatal("peeked records must be replayed unchanged")
+	}
+}
+
+func TestPeekTLSIncompleteHello(t *testing.T) {
+	frag := fragment(captureClientHello(t, "svc.example.com"), 40)
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(frag[:45]) // first record only
+		client.Close()
+	}()
+	_, info, err := Peek(server, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Protocol != ProtoTLS || info.ServerName != "" {
+		t.Fatalf("incomplete hello: %+v", info)
+	}
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Request is a client command read by ReadRequest.
+type Request struct {
+	Cmd  byte   // CmdConnect, CmdUDPAssociate, ...
+	Addr string // DST.ADDR:DST.PORT as sent; domain names are not resolved
+}
+
+// Handshake runs the server side of method selection and RFC 1929
+// username/password sub-negotiation, returning the client's credentials.
+// Only username/password is accepted: a client that does not offer it is
+// told no method is acceptable and ErrAuthRejected is returned. The caller
+// must answer with WriteAuthStatus once it has checked the credentials.
+func Handshake(rw io.ReadWriter) (username, password string, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != Version {
+		return "", "", fmt.Errorf("socks5: unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", "", err
+	}
+	if !bytes.Contains(methods, []byte{AuthPassword}) {
+		rw.Write([]byte{Version, AuthNoAcceptable})
+		return "", "", ErrAuthRejected
+	}
+	if _, err := rw.Write([]byte{Version, AuthPassword}); err != nil {
+		return "", "", err
+	}
+
+	var ver [1]byte
+	if _, err := io.ReadFull(rw, ver[:]); err != nil {
+		return "", "", err
+	}
+	if ver[0] != authPasswordVersion {
+		return "", "", fmt.Errorf("socks5: unsupported auth version %d", ver[0])
+	}
+	user, err := readString(rw)
+	if err != nil {
+		return "", "", err
+	}
+	pass, err := readString(rw)
+	if err != nil {
+		return "", "", err
+	}
+	return user, pass, nil
+}
+
+// WriteAuthStatus answers the RFC 1929 sub-negotiation.
+func WriteAuthStatus(w io.Writer, ok bool) error {
+	status := byte(0x01)
+	if ok {
+		status = 0x00
+	}
+	_, err := w.Write([]byte{authPasswordVersion, status})
+	return err
+}
+
+// ReadRequest reads a client command. An unknown address type is returned as
+// ReplyError(ReplyAddrNotSupported) so the caller can reply with it.
+func ReadRequest(r io.Reader) (Request, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Request{}, err
+	}
+	if hdr[0] != Version {
+		return Request{}, fmt.Errorf("socks5: unsupported version %d", hdr[0])
+	}
+	addr, err := ReadAddr(r)
+	if err != nil {
+		return Request{}, err
+	}
+	return Request{Cmd: hdr[1], Addr: addr}, nil
+}
+
+// WriteReply sends a reply with the given code. bound is the BND.ADDR to
+// report; nil reports 0.0.0.0:0.
+func WriteReply(w io.Writer, code byte, bound net.Addr) error {
+	b := []byte{Version, code, 0x00}
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+	b, err := AppendAddr(b, addr)
+	if err != nil {
+		b, _ = AppendAddr(b[:3], "0.0.0.0:0")
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ParseUDP splits a UDP ASSOCIATE datagram into its destination and payload.
+// Fragmented datagrams (FRAG != 0) are rejected; few clients send them and
+// reassembly is optional in RFC 1928.
+func ParseUDP(b []byte) (addr string, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("socks5: short UDP datagram")
+	}
+	if b[2] != 0 {
+		return "", nil, errors.New("socks5: fragmented UDP datagram")
+	}
+	r := bytes.NewReader(b[3:])
+	addr, err = ReadAddr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
+
+// AppendUDP appends a UDP ASSOCIATE header for source addr followed by payload.
+func AppendUDP(b []byte, addr string, payload []byte) ([]byte, error) {
+	b, err := AppendAddr(append(b, 0, 0, 0), addr)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
+
+func readString(r io.Reader) (string, error) {
+	var l [1]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, l[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
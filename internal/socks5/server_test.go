@@ -0,0 +1,112 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestServerAgainstClient drives the server helpers with the package's own client.
+func TestServerAgainstClient(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	type result struct {
+		user, pass string
+		req        Request
+		err        error
+	}
+	got := make(chan result, 1)
+	go func() {
+		var r result
+		defer func() { got <- r }()
+		if r.user, r.pass, r.err = Handshake(server); r.err != nil {
+			return
+		}
+		if r.err = WriteAuthStatus(server, true); r.err != nil {
+			return
+		}
+		if r.req, r.err = ReadRequest(server); r.err != nil {
+			return
+		}
+		r.err = WriteReply(server, ReplySucceeded, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000})
+	}()
+
+	if err := Connect(client, "api.example.com:443", "agent", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	r := <-got
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.user != "agent" || r.pass != "s3cret" {
+		t.Fatalf("credentials %q/%q", r.user, r.pass)
+	}
+	if r.req.Cmd != CmdConnect || r.req.Addr != "api.example.com:443" {
+		t.Fatalf("request %+v", r.req)
+	}
+}
+
+func TestServerRefusesNoAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := Handshake(server)
+		errc <- err
+	}()
+	if err := Connect(client, "example.com:80", "", ""); !errors.Is(err, ErrAuthRejected) {
+		t.Fatalf("client: want ErrAuthRejected, got %v", err)
+	}
+	if err := <-errc; !errors.Is(err, ErrAuthRejected) {
+		t.Fatalf("server: want ErrAuthRejected, got %v", err)
+	}
+}
+
+func TestServerBadPassword(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		if _, _, err := Handshake(server); err == nil {
+			WriteAuthStatus(server, false)
+		}
+	}()
+	if err := Connect(client, "example.com:80", "agent", "wrong"); !errors.Is(err, ErrAuthRejected) {
+		t.Fatalf("want ErrAuthRejected, got %v", err)
+	}
+}
+
+func TestReadRequestBadAddrType(t *testing.T) {
+	_, err := ReadRequest(bytes.NewReader([]byte{Version, CmdConnect, 0, 0x09}))
+	var re ReplyError
+	if !errors.As(err, &re) || byte(re) != ReplyAddrNotSupported {
+		t.Fatalf("want ReplyAddrNotSupported, got %v", err)
+	}
+}
+
+func TestUDPRoundTrip(t *testing.T) {
+	for _, addr := range []string{"198.51.100.7:53", "[2001:db8::53]:53", "ntp.example.com:123"} {
+		b, err := AppendUDP(nil, addr, []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotAddr, payload, err := ParseUDP(b)
+		if err != nil || gotAddr != addr || string(payload) != "payload" {
+			t.Fatalf("%s: got %q %q %v", addr, gotAddr, payload, err)
+		}
+	}
+	frag, _ := AppendUDP(nil, "198.51.100.7:53", []byte("x"))
+	frag[2] = 1
+	if _, _, err := ParseUDP(frag); err == nil {
+		t.Fatal("fragmented datagram should be rejected")
+	}
+	if _, _, err := ParseUDP([]byte{0, 0}); err == nil {
+		t.Fatal("short datagram should be rejected")
+	}
+}
@@ -0,0 +1,204 @@
+// Package socks5 implements the SOCKS5 wire format (RFC 1928) with
+// username/password authentication (RFC 1929): the client side used to reach
+// parent proxies, and the server side of the gateway's SOCKS5 listener.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// Protocol constants.
+const (
+	Version = 0x05
+
+	AuthNone         = 0x00
+	AuthPassword     = 0x02
+	AuthNoAcceptable = 0xff
+
+	authPasswordVersion = 0x01
+
+	CmdConnect      = 0x01
+	CmdUDPAssociate = 0x03
+
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+)
+
+// Reply codes.
+const (
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyNotAllowed          = 0x02
+	ReplyNetworkUnreachable  = 0x03
+	ReplyHostUnreachable     = 0x04
+	ReplyConnectionRefused   = 0x05
+	ReplyTTLExpired          = 0x06
+	ReplyCommandNotSupported = 0x07
+	ReplyAddrNotSupported    = 0x08
+)
+
+var replyText = map[byte]string{
+	ReplyGeneralFailure:      "general failure",
+	ReplyNotAllowed:          "connection not allowed by ruleset",
+	ReplyNetworkUnreachable:  "network unreachable",
+	ReplyHostUnreachable:     "host unreachable",
+	ReplyConnectionRefused:   "connection refused",
+	ReplyTTLExpired:          "TTL expired",
+	ReplyCommandNotSupported: "command not supported",
+	ReplyAddrNotSupported:    "address type not supported",
+}
+
+// ReplyError is a non-success reply from a SOCKS5 server.
+type ReplyError byte
+
+func (e ReplyError) Error() string {
+	if s, ok := replyText[byte(e)]; ok {
+		return "socks5: " + s
+	}
+	return fmt.Sprintf("socks5: reply code %d", byte(e))
+}
+
+// ErrAuthRejected is returned when the server refuses every offered
+// authentication method or the supplied credentials.
+var ErrAuthRejected = errors.New("socks5: authentication rejected")
+
+// Connect runs the client side of a SOCKS5 CONNECT for target (host:port) over
+// an already-dialed conn to the proxy. Domain names are sent unresolved so
+// the proxy performs the lookup. Username/password auth is offered when
+// username is non-empty.
+func Connect(conn io.ReadWriter, target, username, password string) error {
+	methods := []byte{AuthNone}
+	if username != "" {
+		methods = []byte{AuthPassword}
+	}
+	if _, err := conn.Write(append([]byte{Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var sel [2]byte
+	if _, err := io.ReadFull(conn, sel[:]); err != nil {
+		return err
+	}
+	if sel[0] != Version {
+		return fmt.Errorf("socks5: unexpected server version %d", sel[0])
+	}
+	switch sel[1] {
+	case AuthNone:
+	case AuthPassword:
+		if username == "" {
+			return ErrAuthRejected
+		}
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		msg := []byte{authPasswordVersion, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		var st [2]byte
+		if _, err := io.ReadFull(conn, st[:]); err != nil {
+			return err
+		}
+		if st[1] != 0x00 {
+			return ErrAuthRejected
+		}
+	default:
+		return ErrAuthRejected
+	}
+
+	req := []byte{Version, CmdConnect, 0x00}
+	req, err := AppendAddr(req, target)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != Version {
+		return fmt.Errorf("socks5: unexpected server version %d", hdr[0])
+	}
+	if hdr[1] != ReplySucceeded {
+		return ReplyError(hdr[1])
+	}
+	_, err = ReadAddr(conn) // bound address; unused
+	return err
+}
+
+// AppendAddr appends the SOCKS5 encoding (ATYP, address, port) of hostport.
+func AppendAddr(b []byte, hostport string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() || ip.Is4In6() {
+			a := ip.Unmap().As4()
+			b = append(append(b, AtypIPv4), a[:]...)
+		} else {
+			a := ip.As16()
+			b = append(append(b, AtypIPv6), a[:]...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("socks5: invalid host name %q", host)
+		}
+		b = append(append(b, AtypDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// ReadAddr reads a SOCKS5 address (ATYP, address, port) and returns it as host:port.
+func ReadAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case AtypIPv4, AtypIPv6:
+		n := 4
+		if atyp[0] == AtypIPv6 {
+			n = 16
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		ip, _ := netip.AddrFromSlice(b)
+		host = ip.String()
+	case AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, l[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", ReplyError(ReplyAddrNotSupported)
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(p[:])))), nil
+}
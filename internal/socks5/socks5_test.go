@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeServer answers one CONNECT on conn, checking credentials if user is set,
+// and replies with reply. It returns the requested target.
+func fakeServer(t *testing.T, conn net.Conn, user, pass string, reply byte) <-chan string {
+	t.Helper()
+	got := make(chan string, 1)
+	go func() {
+		defer close(got)
+		var hdr [2]byte
+		io.ReadFull(conn, hdr[:])
+		methods := make([]byte, hdr[1])
+		io.ReadFull(conn, methods)
+		if user == "" {
+			conn.Write([]byte{Version, AuthNone})
+		} else {
+			conn.Write([]byte{Version, AuthPassword})
+			var v [2]byte
+			io.ReadFull(conn, v[:])
+			u := make([]byte, v[1])
+			io.ReadFull(conn, u)
+			var pl [1]byte
+			io.ReadFull(conn, pl[:])
+			p := make([]byte, pl[0])
+			io.ReadFull(conn, p)
+			if string(u) != user || string(p) != pass {
+				conn.Write([]byte{authPasswordVersion, 0x01})
+				return
+			}
+			conn.Write([]byte{authPasswordVersion, 0x00})
+		}
+		var req [3]byte
+		io.ReadFull(conn, req[:])
+		target, err := ReadAddr(conn)
+		if err != nil {
+			return
+		}
+		got <- target
+		conn.Write([]byte{Version, reply, 0x00, AtypIPv4, 10, 0, 0, 1, 0x04, 0x38})
+	}()
+	return got
+}
+
+func TestConnectDomainWithAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	got := fakeServer(t, server, "agent", "s3cret", ReplySucceeded)
+	if err := Connect(client, "api.example.com:443", "agent", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if target := <-got; target != "api.example.com:443" {
+		t.Fatalf("server saw target %q", target)
+	}
+}
+
+func TestConnectBadPassword(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	fakeServer(t, server, "agent", "s3cret", ReplySucceeded)
+	if err := Connect(client, "example.com:80", "agent", "wrong"); !errors.Is(err, ErrAuthRejected) {
+		t.Fatalf("want ErrAuthRejected, got %v", err)
+	}
+}
+
+func TestConnectReplyError(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	fakeServer(t, server, "", "", ReplyNotAllowed)
+	err := Connect(client, "10.0.0.1:22", "", "")
+	var re ReplyError
+	if !errors.As(err, &re) || byte(re) != ReplyNotAllowed {
+		t.Fatalf("want ReplyNotAllowed, got %v", err)
+	}
+}
+
+func TestAddrRoundTrip(t *testing.T) {
+	for _, hp := range []string{"192.0.2.1:80", "[2001:db8::1]:443", "example.com:8080"} {
+		b, err := AppendAddr(nil, hp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadAddr(bytes.NewReader(b))
+		if err != nil || got != hp {
+			t.Fatalf("%s: round trip got %q, %v", hp, got, err)
+		}
+	}
+	if _, err := AppendAddr(nil, "example.com"); err == nil {
+		t.Fatal("missing port should fail")
+	}
+}
@@ -0,0 +1,158 @@
+// Package ssrf keeps the gateway from being used to reach internal networks.
+// A destination is resolved once, every address is checked against deny
+// CIDRs, and the caller dials only the vetted addresses, so a second DNS
+// answer (rebinding) cannot redirect the connection.
+package ssrf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// DefaultDeny covers loopback, RFC 1918/4193 private space, CGNAT, link-local
+// (including the 169.254.169.254 cloud metadata endpoint), the IETF protocol
+// assignments and benchmarking blocks, multicast, the reserved 240.0.0.0/4
+// block and unspecified addresses.
+var DefaultDeny = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// NAT64 and 6to4 addresses reach the IPv4 address embedded in them.
+var (
+	nat64     = netip.MustParsePrefix("64:ff9b::/96") // RFC 6052 well-known prefix
+	sixToFour = netip.MustParsePrefix("2002::/16")    // RFC 3056
+)
+
+// embeddedIPv4 returns the IPv4 address a NAT64 or 6to4 address a carries.
+func embeddedIPv4(a netip.Addr) (netip.Addr, bool) {
+	b := a.As16()
+	switch {
+	case nat64.Contains(a):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(a):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+	return netip.Addr{}, false
+}
+
+// DeniedError reports a destination that resolves into a denied range.
+type DeniedError struct {
+	Host   string
+	Addr   netip.Addr
+	Prefix netip.Prefix
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("ssrf: %s resolves to %s in denied range %s", e.Host, e.Addr, e.Prefix)
+}
+
+// Guard resolves and vets destination hosts. A nil *Guard vets nothing and
+// resolves with the default resolver.
+type Guard struct {
+	deny   []netip.Prefix
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+// New returns a Guard refusing addresses inside any of deny.
+func New(deny []netip.Prefix) *Guard {
+	return &Guard{deny: deny, lookup: defaultLookup}
+}
+
+func defaultLookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// ParsePrefixes parses CIDRs or bare IPs (treated as single-address prefixes).
+// IPv4-mapped entries (::ffff:a.b.c.d) become the IPv4 prefix they map,
+// since Check compares unmapped addresses; a mapped prefix shorter than /96
+// is refused because it spans more than the mapped space.
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			a, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid CIDR or IP %q", s)
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		if p.Addr().Is4In6() {
+			if p.Bits() < 96 {
+				return nil, fmt.Errorf("IPv4-mapped prefix %q must be /96 or longer", s)
+			}
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// Check returns a *DeniedError if addr falls in a denied range. A NAT64 or
+// 6to4 address is also refused if the IPv4 address it embeds is denied, so a
+// dual-stack host cannot be steered to an internal IPv4 target through a
+// translator.
+func (g *Guard) Check(host string, addr netip.Addr) error {
+	if g == nil {
+		return nil
+	}
+	addr = addr.Unmap().WithZone("")
+	v4, embedded := embeddedIPv4(addr)
+	for _, p := range g.deny {
+		if p.Contains(addr) || embedded && p.Contains(v4) {
+			return &DeniedError{Host: host, Addr: addr, Prefix: p}
+		}
+	}
+	return nil
+}
+
+// Resolve returns the addresses of host (a name or IP literal, without port).
+// If any address is denied the whole destination is refused, so a name
+// cannot smuggle an internal address in among public ones.
+func (g *Guard) Resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if a, err := netip.ParseAddr(host); err == nil {
+		a = a.Unmap().WithZone("")
+		return []netip.Addr{a}, g.Check(host, a)
+	}
+	lookup := defaultLookup
+	if g != nil && g.lookup != nil {
+		lookup = g.lookup
+	}
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("ssrf: no addresses for %s", host)
+	}
+	for i, a := range addrs {
+		addrs[i] = a.Unmap()
+		if err := g.Check(host, addrs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,124 @@
+package ssrf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func defaultGuard(t *testing.T) *Guard {
+	t.Helper()
+	deny, err := ParsePrefixes(DefaultDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(deny)
+}
+
+// fakeDNS makes g resolve names from table.
+func fakeDNS(g *Guard, table map[string][]string) {
+	g.lookup = func(_ context.Context, host string) ([]netip.Addr, error) {
+		var out []netip.Addr
+		for _, s := range table[host] {
+			out = append(out, netip.MustParseAddr(s))
+		}
+		if out == nil {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return out, nil
+	}
+}
+
+func TestResolveDeniesInternalAddresses(t *testing.T) {
+	g := defaultGuard(t)
+	fakeDNS(g, map[string][]string{
+		"metadata.example.com": {"169.254.169.254"},
+		"mixed.example.com":    {"93.184.216.34", "10.0.0.5"},
+		"mapped.example.com":   {"::ffff:127.0.0.1"},
+		"public.example.com":   {"93.184.216.34", "2606:2800:220:1::1"},
+		"nat64.example.com":    {"64:ff9b::a9fe:a9fe"}, // 169.254.169.254
+		"6to4.example.com":     {"2002:7f00:1::1"},     // 127.0.0.1
+	})
+
+	for _, host := range []string{"metadata.example.com", "mixed.example.com", "mapped.example.com", "nat64.example.com", "6to4.example.com",
+		"127.0.0.1", "[::1]", "fe80::1%eth0", "64:ff9b::a00:5", "2002:c0a8:101::1", "224.0.0.251", "255.255.255.255", "ff02::1"} {
+		_, err := g.Resolve(context.Background(), host)
+		var de *DeniedError
+		if !errors.As(err, &de) {
+			t.Errorf("%s: want DeniedError, got %v", host, err)
+		}
+	}
+
+	addrs, err := g.Resolve(context.Background(), "public.example.com")
+	if err != nil || len(addrs) != 2 {
+		t.Fatalf("public host: %v %v", addrs, err)
+	}
+	// Translated addresses of public IPv4 hosts stay reachable.
+	for _, host := range []string{"64:ff9b::5db8:d822", "2002:5db8:d822::1"} {
+		if _, err := g.Resolve(context.Background(), host); err != nil {
+			t.Errorf("%s: %v", host, err)
+		}
+	}
+}
+
+func TestDefaultDeny(t *testing.T) {
+	g := defaultGuard(t)
+	for _, tc := range []struct {
+		addr   string
+		denied bool
+	}{
+		{"192.0.0.8", true},   // IETF protocol assignments
+		{"192.0.0.170", true}, // NAT64 discovery
+		{"198.18.0.1", true},  // benchmarking
+		{"198.19.255.254", true},
+		{"::ffff:198.18.0.1", true},
+		{"192.0.1.1", false},
+		{"198.17.255.255", false},
+		{"198.20.0.1", false},
+		{"93.184.216.34", false},
+	} {
+		err := g.Check(tc.addr, netip.MustParseAddr(tc.addr))
+		if denied := err != nil; denied != tc.denied {
+			t.Errorf("%s: denied=%v, want %v (%v)", tc.addr, denied, tc.denied, err)
+		}
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	p, err := ParsePrefixes([]string{"10.1.2.3/8", " 192.0.2.7 ", "2001:db8::/32", "",
+		"::ffff:10.0.0.0/104", "::ffff:169.254.169.254", "::ffff:0:0/96"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.7/32", "2001:db8::/32", "10.0.0.0/8", "169.254.169.254/32", "0.0.0.0/0"}
+	if len(p) != len(want) {
+		t.Fatalf("got %v", p)
+	}
+	for i := range want {
+		if p[i].String() != want[i] {
+			t.Fatalf("prefix %d: want %s, got %s", i, want[i], p[i])
+		}
+	}
+	for _, bad := range []string{"not-a-cidr", "::ffff:0:0/95"} {
+		if _, err := ParsePrefixes([]string{bad}); err == nil {
+			t.Fatalf("%s should fail", bad)
+		}
+	}
+
+	// Mapped entries match the unmapped addresses Check compares.
+	g := New(p[3:5])
+	for _, a := range []string{"10.1.2.3", "::ffff:10.1.2.3", "169.254.169.254"} {
+		if g.Check(a, netip.MustParseAddr(a)) == nil {
+			t.Errorf("%s: want denied by a mapped entry", a)
+		}
+	}
+}
+
+func TestNilGuardAllows(t *testing.T) {
+	var g *Guard
+	if err := g.Check("x", netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+}
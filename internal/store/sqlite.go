@@ -76,6 +76,45 @@ func migrate(db *sql.DB) error {
 			return fmt.Errorf("exec %q: %w", s[:40], err)
 		}
 	}
+	// Columns added after the first release. SQLite has no ADD COLUMN IF
+	// NOT EXISTS, so older databases are upgraded by checking table_info.
+	for _, c := range []struct{ table, column, def string }{
+		{"policies", "cidrs", "TEXT NOT NULL DEFAULT '[]'"},
+		{"policies", "ports", "TEXT NOT NULL DEFAULT '[]'"},
+		{"policies", "ip_literal", "INTEGER NOT NULL DEFAULT 0"},
+		{"quotas", "team_id", "TEXT NOT NULL DEFAULT ''"},
+		{"quotas", "max_concurrent", "INTEGER NOT NULL DEFAULT 0"},
+		{"quotas", "bytes_per_sec", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := addColumn(db, c.table, c.column, c.def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds column to table unless it already exists.
+func addColumn(db *sql.DB, table, column, def string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return fmt.Errorf("table_info %s: %w", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("scan table_info %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("table_info %s: %w", table, err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -131,7 +170,7 @@ func (d *DB) DeleteAgent(agentID string) error {
 
 // LoadPolicies reads all policies from SQLite into the Engine.
 func (d *DB) LoadPolicies(eng *policy.Engine) error {
-	rows, err := d.db.Query("SELECT policy_id, agent_id, domains, action FROM policies ORDER BY priority, rowid")
+	rows, err := d.db.Query("SELECT policy_id, agent_id, domains, cidrs, ports, ip_literal, action FROM policies ORDER BY priority, rowid")
 	if err != nil {
 		return fmt.Errorf("query policies: %w", err)
 	}
@@ -140,14 +179,20 @@ func (d *DB) LoadPolicies(eng *policy.Engine) error {
 	var count int
 	for rows.Next() {
 		var r policy.Rule
-		var domainsJSON string
-		if err := rows.Scan(&r.PolicyID, &r.AgentID, &domainsJSON, &r.Action); err != nil {
+		var domainsJSON, cidrsJSON, portsJSON string
+		if err := rows.Scan(&r.PolicyID, &r.AgentID, &domainsJSON, &cidrsJSON, &portsJSON, &r.IPLiteral, &r.Action); err != nil {
 			return fmt.Errorf("scan policy: %w", err)
 		}
 		// Domains stored as JSON array string.
 		if err := json.Unmarshal([]byte(domainsJSON), &r.Domains); err != nil {
 			r.Domains = []string{}
 		}
+		// A CIDR or port list that fails to decode would widen the rule
+		// to every destination, so skip the rule instead.
+		if json.Unmarshal([]byte(cidrsJSON), &r.CIDRs) != nil || json.Unmarshal([]byte(portsJSON), &r.Ports) != nil {
+			log.Printf("sqlite: skipping policy %s: malformed cidrs or ports", r.PolicyID)
+			continue
+		}
 		eng.Add(r)
 		count++
 	}
@@ -163,16 +208,33 @@ func (d *DB) SavePolicy(r policy.Rule) error {
 	if err != nil {
 		return fmt.Errorf("marshal domains: %w", err)
 	}
+	cidrsJSON, err := json.Marshal(nonNil(r.CIDRs))
+	if err != nil {
+		return fmt.Errorf("marshal cidrs: %w", err)
+	}
+	portsJSON, err := json.Marshal(nonNil(r.Ports))
+	if err != nil {
+		return fmt.Errorf("marshal ports: %w", err)
+	}
 	_, err = d.db.Exec(
-		`INSERT INTO policies (policy_id, agent_id, domains, action)
-		 VALUES (?, ?, ?, ?)
+		`INSERT INTO policies (policy_id, agent_id, domains, cidrs, ports, ip_literal, action)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)
 		 ON CONFLICT(policy_id) DO UPDATE SET
-		   agent_id=excluded.agent_id, domains=excluded.domains, action=excluded.action`,
-		r.PolicyID, r.AgentID, string(domainsJSON), r.Action,
+		   agent_id=excluded.agent_id, domains=excluded.domains, cidrs=excluded.cidrs,
+		   ports=excluded.ports, ip_literal=excluded.ip_literal, action=excluded.action`,
+		r.PolicyID, r.AgentID, string(domainsJSON), string(cidrsJSON), string(portsJSON), r.IPLiteral, r.Action,
 	)
 	return err
 }
 
+// nonNil returns s, or an empty slice if s is nil, so it marshals as [].
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
 // DeletePolicy removes a policy by ID.
 func (d *DB) DeletePolicy(policyID string) error {
 	_, err := d.db.Exec("DELETE FROM policies WHERE policy_id = ?", policyID)
@@ -184,8 +246,11 @@ func (d *DB) DeletePolicy(policyID string) error {
 // ---------------------------------------------------------------------------
 
 // LoadQuotas reads all quotas from SQLite into the Limiter.
+//
+// The agent_id column holds the quota's key (see quota.Limit.Key), so team
+// quotas share the primary key with agent quotas.
 func (d *DB) LoadQuotas(lim *quota.Limiter) error {
-	rows, err := d.db.Query("SELECT agent_id, rps, rpm, mode FROM quotas")
+	rows, err := d.db.Query("SELECT agent_id, team_id, rps, rpm, max_concurrent, bytes_per_sec, mode FROM quotas")
 	if err != nil {
 		return fmt.Errorf("query quotas: %w", err)
 	}
@@ -194,9 +259,12 @@ func (d *DB) LoadQuotas(lim *quota.Limiter) error {
 	var count int
 	for rows.Next() {
 		var q quota.Limit
-		if err := rows.Scan(&q.AgentID, &q.RPS, &q.RPM, &q.Mode); err != nil {
+		if err := rows.Scan(&q.AgentID, &q.TeamID, &q.RPS, &q.RPM, &q.MaxConcurrent, &q.BytesPerSec, &q.Mode); err != nil {
 			return fmt.Errorf("scan quota: %w", err)
 		}
+		if q.TeamID != "" {
+			q.AgentID = ""
+		}
 		lim.Set(q)
 		count++
 	}
@@ -206,20 +274,28 @@ func (d *DB) LoadQuotas(lim *quota.Limiter) error {
 	return rows.Err()
 }
 
-// SaveQuota upserts a single quota.
+// SaveQuota validates and upserts a single quota.
 func (d *DB) SaveQuota(q quota.Limit) error {
+	if err := q.Validate(); err != nil {
+		return fmt.Errorf("quota %s: %w", q.Key(), err)
+	}
+	if q.Mode == "" {
+		q.Mode = "hard_stop"
+	}
 	_, err := d.db.Exec(
-		`INSERT INTO quotas (agent_id, rps, rpm, mode)
-		 VALUES (?, ?, ?, ?)
+		`INSERT INTO quotas (agent_id, team_id, rps, rpm, max_concurrent, bytes_per_sec, mode)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)
 		 ON CONFLICT(agent_id) DO UPDATE SET
-		   rps=excluded.rps, rpm=excluded.rpm, mode=excluded.mode`,
-		q.AgentID, q.RPS, q.RPM, q.Mode,
+		   team_id=excluded.team_id, rps=excluded.rps, rpm=excluded.rpm,
+		   max_concurrent=excluded.max_concurrent, bytes_per_sec=excluded.bytes_per_sec,
+		   mode=excluded.mode`,
+		q.Key(), q.TeamID, q.RPS, q.RPM, q.MaxConcurrent, q.BytesPerSec, q.Mode,
 	)
 	return err
 }
 
-// DeleteQuota removes a quota by agent ID.
-func (d *DB) DeleteQuota(agentID string) error {
-	_, err := d.db.Exec("DELETE FROM quotas WHERE agent_id = ?", agentID)
+// DeleteQuota removes a quota by key: an agent ID or a quota.TeamKey.
+func (d *DB) DeleteQuota(key string) error {
+	_, err := d.db.Exec("DELETE FROM quotas WHERE agent_id = ?", key)
 	return err
 }
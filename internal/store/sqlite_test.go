@@ -1,6 +1,7 @@
 package store
 
 import (
+	"database/sql"
 	"path/filepath"
 	"testing"
 
@@ -90,6 +91,70 @@ func TestPolicyCRUD(t *testing.T) {
 	}
 }
 
+func TestPolicyMatchFields(t *testing.T) {
+	db := openTestDB(t)
+
+	r := policy.Rule{
+		PolicyID: "p1", AgentID: "*", Action: "deny",
+		CIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}, Ports: []string{"443", "8000-8999"}, IPLiteral: true,
+	}
+	if err := db.SavePolicy(r); err != nil {
+		t.Fatal(err)
+	}
+	eng, _ := policy.NewEngine("/nonexistent")
+	if err := db.LoadPolicies(eng); err != nil {
+		t.Fatal(err)
+	}
+	got := eng.LookupByID("p1")
+	if got == nil || len(got.CIDRs) != 2 || len(got.Ports) != 2 || !got.IPLiteral {
+		t.Fatalf("match fields not round-tripped: %+v", got)
+	}
+	if d := eng.Evaluate("a1", "10.1.2.3:443"); d.PolicyID != "p1" {
+		t.Fatalf("loaded rule should match, got %s", d.PolicyID)
+	}
+}
+
+func TestMigrateAddsPolicyColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Schema and data as written by releases before cidrs/ports/ip_literal.
+	for _, s := range []string{
+		`CREATE TABLE policies (
+			policy_id TEXT PRIMARY KEY,
+			agent_id  TEXT NOT NULL DEFAULT '*',
+			domains   TEXT NOT NULL DEFAULT '[]',
+			action    TEXT NOT NULL DEFAULT 'deny',
+			priority  INTEGER NOT NULL DEFAULT 0
+		)`,
+		`INSERT INTO policies (policy_id, agent_id, domains, action) VALUES ('old', '*', '["example.com"]', 'allow')`,
+	} {
+		if _, err := raw.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw.Close()
+
+	// Opening twice checks the migration is idempotent.
+	for range 2 {
+		db, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eng, _ := policy.NewEngine("/nonexistent")
+		if err := db.LoadPolicies(eng); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		got := eng.LookupByID("old")
+		if got == nil || len(got.CIDRs) != 0 || len(got.Ports) != 0 || got.IPLiteral {
+			t.Fatalf("old rule should load with empty match fields: %+v", got)
+		}
+	}
+}
+
 func TestQuotaCRUD(t *testing.T) {
 	db := openTestDB(t)
 
@@ -115,3 +180,75 @@ func TestQuotaCRUD(t *testing.T) {
 		t.Fatal("delete failed")
 	}
 }
+
+func TestQuotaFlowLimits(t *testing.T) {
+	db := openTestDB(t)
+
+	for _, q := range []quota.Limit{
+		{AgentID: "a1", RPS: 10, MaxConcurrent: 4, BytesPerSec: 1000},
+		{TeamID: "ml", MaxConcurrent: 20, Mode: "alert_only"},
+	} {
+		if err := db.SaveQuota(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SaveQuota(quota.Limit{TeamID: "ml", RPS: 5}); err == nil {
+		t.Fatal("expected error for a team request rate")
+	}
+
+	lim, _ := quota.NewLimiter("/nonexistent")
+	if err := db.LoadQuotas(lim); err != nil {
+		t.Fatal(err)
+	}
+	if got := lim.LookupByID("a1"); got == nil || got.MaxConcurrent != 4 || got.BytesPerSec != 1000 || got.Mode != "hard_stop" {
+		t.Fatalf("agent quota not round-tripped: %+v", got)
+	}
+	got := lim.LookupByID(quota.TeamKey("ml"))
+	if got == nil || got.AgentID != "" || got.TeamID != "ml" || got.MaxConcurrent != 20 || got.Mode != "alert_only" {
+		t.Fatalf("team quota not round-tripped: %+v", got)
+	}
+
+	db.DeleteQuota(quota.TeamKey("ml"))
+	lim2, _ := quota.NewLimiter("/nonexistent")
+	db.LoadQuotas(lim2)
+	if lim2.LookupByID(quota.TeamKey("ml")) != nil || lim2.LookupByID("a1") == nil {
+		t.Fatal("delete by team key failed")
+	}
+}
+
+func TestMigrateAddsQuotaColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Schema and data as written by releases before team and flow limits.
+	for _, s := range []string{
+		`CREATE TABLE quotas (
+			agent_id TEXT PRIMARY KEY,
+			rps      REAL NOT NULL DEFAULT 0,
+			rpm      REAL NOT NULL DEFAULT 0,
+			mode     TEXT NOT NULL DEFAULT 'hard_stop'
+		)`,
+		`INSERT INTO quotas (agent_id, rps) VALUES ('old', 3)`,
+	} {
+		if _, err := raw.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw.Close()
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	lim, _ := quota.NewLimiter("/nonexistent")
+	if err := db.LoadQuotas(lim); err != nil {
+		t.Fatal(err)
+	}
+	got := lim.LookupByID("old")
+	if got == nil || got.RPS != 3 || got.TeamID != "" || got.MaxConcurrent != 0 || got.BytesPerSec != 0 {
+		t.Fatalf("old quota should load with no flow limits: %+v", got)
+	}
+}
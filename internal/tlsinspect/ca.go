@@ -0,0 +1,237 @@
+// Package tlsinspect implements TLS interception for CONNECT tunnels.
+//
+// The gateway terminates the agent's TLS session with a leaf certificate
+// minted on demand from a local CA, so that the inner HTTP method and path can
+// be policy-evaluated. Leaf certificates are cached per host name.
+package tlsinspect
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 7 * 24 * time.Hour
+	// leafRenewBefore evicts cached leaves this long before they expire.
+	leafRenewBefore = time.Hour
+	// maxCachedLeaves bounds the leaf cache; the cache is reset when full.
+	maxCachedLeaves = 4096
+)
+
+// CA mints and caches leaf certificates signed by a local certificate authority.
+// All methods are safe for concurrent use.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// LoadOrCreateCA loads the CA certificate and key from the given PEM files.
+// If neither file exists, a new CA is generated and written to both paths
+// so that operators can distribute the certificate to agent trust stores.
+func LoadOrCreateCA(certFile, keyFile string) (*CA, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		if err := generateCA(certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA cert %s: %w", certFile, err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA key %s: %w", keyFile, err)
+	}
+	return ParseCA(certPEM, keyPEM)
+}
+
+// ParseCA builds a CA from PEM-encoded certificate and EC private key.
+func ParseCA(certPEM, keyPEM []byte) (*CA, error) {
+	cb, _ := pem.Decode(certPEM)
+	if cb == nil || cb.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no CERTIFICATE block in CA cert")
+	}
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA cert: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("CA cert is not a CA (basicConstraints)")
+	}
+	kb, _ := pem.Decode(keyPEM)
+	if kb == nil {
+		return nil, fmt.Errorf("no PEM block in CA key")
+	}
+	key, err := x509.ParseECPrivateKey(kb.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA key: %w", err)
+	}
+	return &CA{cert: cert, key: key, leaves: make(map[string]*tls.Certificate)}, nil
+}
+
+// Certificate returns the CA certificate.
+func (c *CA) Certificate() *x509.Certificate {
+	return c.cert
+}
+
+// CertFor returns a leaf certificate for host, minting and caching it if needed.
+// host may be a DNS name or an IP literal; any port is ignored.
+func (c *CA) CertFor(host string) (*tls.Certificate, error) {
+	host = normalizeHost(host)
+	if host == "" {
+		return nil, fmt.Errorf("empty host")
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	if leaf, ok := c.leaves[host]; ok && now.Before(leaf.Leaf.NotAfter.Add(-leafRenewBefore)) {
+		c.mu.Unlock()
+		return leaf, nil
+	}
+	c.mu.Unlock()
+
+	leaf, err := c.mint(host, now)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.leaves) >= maxCachedLeaves {
+		c.leaves = make(map[string]*tls.Certificate)
+	}
+	c.leaves[host] = leaf
+	c.mu.Unlock()
+	return leaf, nil
+}
+
+// ServerConfig returns a TLS server config that presents a leaf for the
+// ClientHello SNI, or for fallbackHost when the client sends no SNI.
+func (c *CA) ServerConfig(fallbackHost string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = fallbackHost
+			}
+			return c.CertFor(name)
+		},
+	}
+}
+
+func (c *CA) mint(host string, now time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate leaf key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		return nil, fmt.Errorf("sign leaf for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse leaf for %s: %w", host, err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, c.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func generateCA(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate CA key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Clawgress Inspection CA", Organization: []string{"Clawgress"}},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("self-sign CA: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal CA key: %w", err)
+	}
+
+	for _, p := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return fmt.Errorf("create CA dir: %w", err)
+		}
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return fmt.Errorf("write CA key: %w", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return fmt.Errorf("write CA cert: %w", err)
+	}
+	return nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial: %w", err)
+	}
+	return serial, nil
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(strings.TrimRight(host, "."))
+}
@@ -0,0 +1,114 @@
+package tlsinspect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func newTestCA(t *testing.T) *CA {
+	t.Helper()
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func TestLoadOrCreateCAPersists(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+
+	first, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Certificate().Equal(second.Certificate()) {
+		t.Fatal("reloaded CA should match the generated one")
+	}
+}
+
+func TestLoadOrCreateCAPartialFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.crt")
+	if _, err := LoadOrCreateCA(certFile, filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	// Cert exists but key path does not: must not silently regenerate.
+	if _, err := LoadOrCreateCA(certFile, filepath.Join(dir, "missing.key")); err == nil {
+		t.Fatal("expected error when only the cert exists")
+	}
+}
+
+func TestCertForVerifiesAgainstCA(t *testing.T) {
+	ca := newTestCA(t)
+	leaf, err := ca.CertFor("API.Example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "api.example.com", Roots: pool}); err != nil {
+		t.Fatalf("leaf should verify: %v", err)
+	}
+}
+
+func TestCertForIPLiteral(t *testing.T) {
+	ca := newTestCA(t)
+	leaf, err := ca.CertFor("[2001:db8::1]:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.Leaf.IPAddresses) != 1 || !leaf.Leaf.IPAddresses[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("want IP SAN 2001:db8::1, got %v", leaf.Leaf.IPAddresses)
+	}
+}
+
+func TestCertForCaches(t *testing.T) {
+	ca := newTestCA(t)
+	a, err := ca.CertFor("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ca.CertFor("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("expected cached leaf for the same host")
+	}
+}
+
+func TestServerConfigHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tls.Server(server, ca.ServerConfig("fallback.example.com")).Handshake()
+	}()
+
+	cc := tls.Client(client, &tls.Config{ServerName: "svc.example.com", RootCAs: pool})
+	if err := cc.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+	if got := cc.ConnectionState().PeerCertificates[0].Subject.CommonName; got != "svc.example.com" {
+		t.Fatalf("want leaf for SNI, got %s", got)
+	}
+}
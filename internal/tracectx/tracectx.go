@@ -0,0 +1,104 @@
+// Package tracectx parses and generates W3C Trace Context traceparent
+// headers, so a request can be followed from the agent through the gateway
+// to the upstream.
+//
+// Spec: https://www.w3.org/TR/trace-context/
+package tracectx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// Header names.
+const (
+	Header      = "Traceparent"
+	StateHeader = "Tracestate"
+)
+
+// FlagSampled is the trace-flags bit set by a caller that may record the
+// trace.
+const FlagSampled = 0x01
+
+// Context is one traceparent: the trace, the span that sent it and the
+// trace flags.
+type Context struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// Parse decodes a traceparent value. Version 00 must be exactly
+// 00-<32 hex>-<16 hex>-<2 hex>; later versions may append fields, which are
+// ignored. All-zero IDs, upper-case hex and version ff are invalid.
+func Parse(s string) (Context, bool) {
+	var c Context
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return c, false
+	}
+	var ver [1]byte
+	if !decodeLower(ver[:], s[0:2]) || ver[0] == 0xff {
+		return c, false
+	}
+	if (ver[0] == 0 && len(s) != 55) || (len(s) > 55 && s[55] != '-') {
+		return c, false
+	}
+	var flags [1]byte
+	if !decodeLower(c.TraceID[:], s[3:35]) || !decodeLower(c.SpanID[:], s[36:52]) || !decodeLower(flags[:], s[53:55]) {
+		return c, false
+	}
+	if c.TraceID == ([16]byte{}) || c.SpanID == ([8]byte{}) {
+		return c, false
+	}
+	c.Flags = flags[0]
+	return c, true
+}
+
+// FromHeader returns the request's trace context. A missing, repeated or
+// invalid traceparent reports false.
+func FromHeader(h http.Header) (Context, bool) {
+	v := h.Values(Header)
+	if len(v) != 1 {
+		return Context{}, false
+	}
+	return Parse(v[0])
+}
+
+// New starts a trace with random IDs and no flags set.
+func New() Context {
+	var c Context
+	rand.Read(c.TraceID[:])
+	rand.Read(c.SpanID[:])
+	return c
+}
+
+// Child returns the context for a new span in the same trace, keeping the
+// caller's flags.
+func (c Context) Child() Context {
+	rand.Read(c.SpanID[:])
+	return c
+}
+
+// String formats c as a version 00 traceparent.
+func (c Context) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", c.TraceID, c.SpanID, c.Flags)
+}
+
+// TraceIDString returns the trace ID in hex.
+func (c Context) TraceIDString() string { return hex.EncodeToString(c.TraceID[:]) }
+
+// SpanIDString returns the span ID in hex.
+func (c Context) SpanIDString() string { return hex.EncodeToString(c.SpanID[:]) }
+
+// decodeLower decodes lower-case hex s into dst, which must be len(s)/2.
+func decodeLower(dst []byte, s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
@@ -0,0 +1,66 @@
+package tracectx
+
+import (
+	"net/http"
+	"testing"
+)
+
+const sample = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParse(t *testing.T) {
+	c, ok := Parse(sample)
+	if !ok {
+		t.Fatal("valid traceparent rejected")
+	}
+	if c.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" || c.SpanIDString() != "00f067aa0ba902b7" || c.Flags != FlagSampled {
+		t.Fatalf("parsed %+v", c)
+	}
+	if c.String() != sample {
+		t.Fatalf("round trip: %s", c.String())
+	}
+
+	cases := map[string]bool{
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": true,  // later version, extra field
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": false, // version 00 is exact
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":       false, // upper case
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":          false,
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01":       false,
+		"": false,
+	}
+	for s, want := range cases {
+		if _, ok := Parse(s); ok != want {
+			t.Errorf("Parse(%q) ok = %v, want %v", s, ok, want)
+		}
+	}
+}
+
+func TestFromHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("traceparent", sample)
+	if _, ok := FromHeader(h); !ok {
+		t.Fatal("single header rejected")
+	}
+	h.Add("traceparent", sample)
+	if _, ok := FromHeader(h); ok {
+		t.Fatal("repeated header accepted")
+	}
+}
+
+func TestNewAndChild(t *testing.T) {
+	c := New()
+	if c.TraceID == ([16]byte{}) || c.SpanID == ([8]byte{}) || c.Flags != 0 {
+		t.Fatalf("new context %+v", c)
+	}
+	if _, ok := Parse(c.String()); !ok {
+		t.Fatalf("generated traceparent %q does not parse", c.String())
+	}
+	parent, _ := Parse(sample)
+	child := parent.Child()
+	if child.TraceID != parent.TraceID || child.Flags != parent.Flags || child.SpanID == parent.SpanID {
+		t.Fatalf("child %+v of %+v", child, parent)
+	}
+}
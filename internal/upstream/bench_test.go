@@ -0,0 +1,68 @@
+package upstream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newBenchServer(b *testing.B) *httptest.Server {
+	b.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	b.Cleanup(srv.Close)
+	return srv
+}
+
+// forward sends one GET through rt and drains the response. It reports
+// failures with Error, so RunParallel goroutines may call it.
+func forward(b *testing.B, rt http.RoundTripper, url string) {
+	b.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// BenchmarkForward compares forwarding a plain request the old way, with a
+// fresh client (and therefore a fresh dial) per request, against the shared
+// pooled transport, serially and under concurrent agents. Run the cases
+// together so their results can be compared directly:
+//
+//	go test -run '^$' -bench Forward ./internal/upstream
+func BenchmarkForward(b *testing.B) {
+	srv := newBenchServer(b)
+
+	b.Run("per-request-client", func(b *testing.B) {
+		for range b.N {
+			t := &http.Transport{}
+			forward(b, t, srv.URL)
+			t.CloseIdleConnections()
+		}
+	})
+
+	b.Run("shared-transport", func(b *testing.B) {
+		t := NewTransport(Config{})
+		defer t.CloseIdleConnections()
+		for range b.N {
+			forward(b, t, srv.URL)
+		}
+	})
+
+	// The per-host idle pool under concurrent agents.
+	b.Run("shared-transport-parallel", func(b *testing.B) {
+		t := NewTransport(Config{})
+		defer t.CloseIdleConnections()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				forward(b, t, srv.URL)
+			}
+		})
+	})
+}
@@ -0,0 +1,342 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/egress"
+	cgmetrics "github.com/bufordtjustice2918/crispy-garbanzo/internal/metrics"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/socks5"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/ssrf"
+)
+
+// direct is the route used when a decision names none.
+var direct = []policy.Route{{Type: policy.RouteDirect}}
+
+// Router dials destinations through the routes a policy decision selects.
+// Routes are tried in fallback order; parent proxies that recently failed a
+// dial or health check are tried only after the healthy ones. Health is kept
+// per route (credentials included) and egress source, since either can make
+// a parent unusable on its own.
+// All methods are safe for concurrent use.
+type Router struct {
+	dialer *net.Dialer
+	guard  *ssrf.Guard
+
+	mu     sync.Mutex
+	health map[healthKey]*routeHealth
+}
+
+type healthKey struct {
+	route policy.Route
+	src   egress.Source
+}
+
+type routeHealth struct {
+	addr string // last destination reached through the route; Check's probe target
+	up   bool
+}
+
+// NewRouter returns a Router whose dials (to parents or destinations) time
+// out after dialTimeout. Direct destinations are vetted by guard (nil = no
+// checks); through a parent proxy, the parent resolves the name.
+func NewRouter(dialTimeout time.Duration, guard *ssrf.Guard) *Router {
+	return &Router{
+		dialer: &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second},
+		guard:  guard,
+		health: make(map[healthKey]*routeHealth),
+	}
+}
+
+// Outcome records how a request or tunnel left the gateway.
+type Outcome struct {
+	Route      policy.Route
+	ResolvedIP string // upstream IP actually dialed on a direct route; empty via a parent
+	EgressIP   string // local address the upstream conn (to destination or parent) left from
+}
+
+// Denied reports whether err is an SSRF guard refusal. Such errors end
+// route fallback: the destination itself is forbidden.
+func Denied(err error) bool {
+	var de *ssrf.DeniedError
+	return errors.As(err, &de)
+}
+
+func newOutcome(r policy.Route, c net.Conn) Outcome {
+	o := Outcome{Route: r}
+	if c == nil {
+		return o
+	}
+	if ta, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		o.EgressIP = ta.IP.String()
+	}
+	if r.Type == policy.RouteDirect || r.Type == "" {
+		if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			o.ResolvedIP = ta.IP.String()
+		}
+	}
+	return o
+}
+
+// Order returns routes with entries healthy from src first, each group
+// keeping its configured order. An empty list yields the direct route.
+func (rt *Router) Order(routes []policy.Route, src egress.Source) []policy.Route {
+	if len(routes) == 0 {
+		return direct
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	var up, down []policy.Route
+	for _, r := range routes {
+		if h, ok := rt.health[healthKey{r, src}]; ok && !h.up {
+			down = append(down, r)
+		} else {
+			up = append(up, r)
+		}
+	}
+	return append(up, down...)
+}
+
+// Report records the outcome of using a parent route from src to reach addr
+// (host:port). Direct routes are not tracked.
+func (rt *Router) Report(r policy.Route, src egress.Source, addr string, err error) {
+	if r.Type == policy.RouteDirect || r.Type == "" {
+		return
+	}
+	rt.mu.Lock()
+	h, ok := rt.health[healthKey{r, src}]
+	if !ok {
+		h = &routeHealth{}
+		rt.health[healthKey{r, src}] = h
+	}
+	h.addr, h.up = addr, err == nil
+	rt.mu.Unlock()
+
+	v := 0.0
+	if err == nil {
+		v = 1
+	}
+	cgmetrics.UpstreamRouteUp.WithLabelValues(r.String()).Set(v)
+}
+
+// Dial connects to addr (host:port) through the first route that works and
+// returns the conn together with how it was reached. Conns to the
+// destination or parent leave from src.
+func (rt *Router) Dial(ctx context.Context, routes []policy.Route, src egress.Source, addr string) (net.Conn, Outcome, error) {
+	var errs []error
+	for _, r := range rt.Order(routes, src) {
+		c, err := rt.dialRoute(ctx, r, src, addr)
+		rt.reportDial(r, src, addr, err)
+		if err == nil {
+			return c, newOutcome(r, c), nil
+		}
+		if Denied(err) {
+			return nil, Outcome{Route: r}, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", r, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, Outcome{}, errors.Join(errs...)
+}
+
+// reportDial records a dial through r. A parent that answered but refused
+// the destination is still up.
+func (rt *Router) reportDial(r policy.Route, src egress.Source, addr string, err error) {
+	if parentAnswered(err) {
+		err = nil
+	}
+	rt.Report(r, src, addr, err)
+}
+
+// RoundTrip sends req over t, the transport dialing from src, through the
+// first route that works and returns how it was sent. Requests with a body
+// are not retried on another route because the body may already be partly
+// consumed.
+func (rt *Router) RoundTrip(t http.RoundTripper, src egress.Source, req *http.Request, routes []policy.Route) (*http.Response, Outcome, error) {
+	var (
+		resp *http.Response
+		err  error
+		out  Outcome
+	)
+	addr := requestAddr(req.URL)
+	for _, r := range rt.Order(routes, src) {
+		var conn net.Conn
+		ctx := httptrace.WithClientTrace(WithRoute(req.Context(), r), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn },
+		})
+		resp, err = t.RoundTrip(Trace(req.WithContext(ctx)))
+		out = newOutcome(r, conn)
+		rt.Report(r, src, addr, err)
+		if err == nil || Denied(err) || (req.Body != nil && req.Body != http.NoBody) || req.Context().Err() != nil {
+			break
+		}
+	}
+	return resp, out, err
+}
+
+func (rt *Router) dialRoute(ctx context.Context, r policy.Route, src egress.Source, addr string) (net.Conn, error) {
+	d := &egress.Dialer{Dialer: *rt.dialer, Source: src}
+	if r.Type == policy.RouteDirect || r.Type == "" {
+		return dialGuarded(ctx, d, rt.guard, "tcp", addr)
+	}
+	raw, err := d.DialContext(ctx, "tcp", r.Address)
+	if err != nil {
+		return nil, err
+	}
+	// Bound the parent handshake by the dial timeout as well.
+	raw.SetDeadline(time.Now().Add(rt.dialer.Timeout))
+	c := raw
+	switch r.Type {
+	case policy.RouteHTTP:
+		c, err = connectHTTP(raw, addr, r)
+	case policy.RouteSOCKS5:
+		err = socks5.Connect(raw, addr, r.Username, r.Password)
+	default:
+		err = fmt.Errorf("unknown route type %q", r.Type)
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// connectHTTP opens a CONNECT tunnel to addr through an HTTP parent proxy.
+func connectHTTP(c net.Conn, addr string, r policy.Route) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if r.Username != "" {
+		req += "Proxy-Authorization: Basic " + basicAuth(r.Username, r.Password) + "\r\n"
+	}
+	if _, err := c.Write([]byte(req + "\r\n")); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return nil, errParentAuth
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, refusedError(resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+// refusedError is a non-200 reply from an HTTP parent proxy.
+type refusedError string
+
+func (e refusedError) Error() string { return "parent proxy refused CONNECT: " + string(e) }
+
+// errParentAuth is an HTTP parent's 407: the route's credentials are wrong
+// for every destination.
+var errParentAuth = errors.New("parent proxy rejected credentials")
+
+// parentAnswered reports whether err came from a parent that is reachable,
+// speaking its protocol and accepting the route's credentials, but refused
+// the destination, as opposed to a dial, transport or auth failure.
+func parentAnswered(err error) bool {
+	var re refusedError
+	var se socks5.ReplyError
+	return errors.As(err, &re) || errors.As(err, &se)
+}
+
+// bufferedConn replays bytes the parent sent right after its CONNECT reply.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func basicAuth(user, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+}
+
+// Check probes every parent route seen so far, from each source it was used
+// with, by opening a tunnel to the last destination reached through it, and
+// updates its health. The probe goes through the parent's handshake and
+// authentication, so a parent that accepts TCP but not the route's
+// credentials stays down. Run calls it periodically.
+func (rt *Router) Check(ctx context.Context) {
+	rt.mu.Lock()
+	probes := make(map[healthKey]string, len(rt.health))
+	for k, h := range rt.health {
+		probes[k] = h.addr
+	}
+	rt.mu.Unlock()
+
+	for k, addr := range probes {
+		c, err := rt.dialRoute(ctx, k.route, k.src, addr)
+		if err == nil {
+			c.Close()
+		}
+		rt.reportDial(k.route, k.src, addr, err)
+	}
+}
+
+// Run health-checks parent routes every interval until ctx is done.
+func (rt *Router) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			rt.Check(ctx)
+		}
+	}
+}
+
+// requestAddr returns the host:port a request for u is sent to.
+func requestAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+type routeKey struct{}
+
+// WithRoute returns a context that makes the shared transport send the
+// request through r.
+func WithRoute(ctx context.Context, r policy.Route) context.Context {
+	return context.WithValue(ctx, routeKey{}, r)
+}
+
+// proxyFromContext is the shared transport's Proxy func. Parent routes are
+// expressed as proxy URLs so the transport pools conns per route.
+func proxyFromContext(req *http.Request) (*url.URL, error) {
+	r, ok := req.Context().Value(routeKey{}).(policy.Route)
+	if !ok || r.Type == policy.RouteDirect || r.Type == "" {
+		return nil, nil
+	}
+	u := &url.URL{Scheme: r.Type, Host: r.Address}
+	if r.Username != "" {
+		u.User = url.UserPassword(r.Username, r.Password)
+	}
+	return u, nil
+}
@@ -0,0 +1,376 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/egress"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/ssrf"
+)
+
+// echoServer echoes every conn it accepts.
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	return ln
+}
+
+// connectParent is a minimal HTTP CONNECT parent proxy requiring auth.
+func connectParent(t *testing.T, auth string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveConnect(t, ln, auth)
+	return ln
+}
+
+// serveConnect runs connectParent's proxy on ln.
+func serveConnect(t *testing.T, ln net.Listener, auth string) {
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != "Basic "+auth {
+					io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				up, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer up.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				go io.Copy(up, c)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+}
+
+func TestRouterDialHTTPParent(t *testing.T) {
+	dest := echoServer(t)
+	parent := connectParent(t, basicAuth("u", "p"))
+	rt := NewRouter(time.Second, nil)
+
+	route := policy.Route{Type: policy.RouteHTTP, Address: parent.Addr().String(), Username: "u", Password: "p"}
+	c, got, err := rt.Dial(context.Background(), []policy.Route{route}, egress.Source{}, dest.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got.Route.String() != route.String() || got.ResolvedIP != "" {
+		t.Fatalf("want route %s, got %s", route, got)
+	}
+	io.WriteString(c, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through parent: %q %v", buf, err)
+	}
+
+	// Wrong credentials: the parent's 407 is an error, not a tunnel.
+	route.Password = "wrong"
+	if _, _, err := rt.Dial(context.Background(), []policy.Route{route}, egress.Source{}, dest.Addr().String()); err == nil {
+		t.Fatal("expected error for rejected CONNECT")
+	}
+}
+
+func TestRouterFallbackAndHealth(t *testing.T) {
+	dest := echoServer(t)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	rt := NewRouter(time.Second, nil)
+	routes := []policy.Route{
+		{Type: policy.RouteHTTP, Address: deadAddr, Username: "u", Password: "p"},
+		{Type: policy.RouteDirect},
+	}
+	c, got, err := rt.Dial(context.Background(), routes, egress.Source{}, dest.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got.Route.Type != policy.RouteDirect || got.ResolvedIP != "127.0.0.1" {
+		t.Fatalf("want fallback to direct via 127.0.0.1, got %+v", got)
+	}
+	if order := rt.Order(routes, egress.Source{}); order[0].Type != policy.RouteDirect {
+		t.Fatalf("down route should be tried last, got %v", order)
+	}
+
+	// A parent that accepts TCP but rejects the route's credentials stays down.
+	revived, err := net.Listen("tcp", deadAddr)
+	if err != nil {
+		t.Skipf("cannot rebind %s: %v", deadAddr, err)
+	}
+	serveConnect(t, revived, basicAuth("u", "other"))
+	rt.Check(context.Background())
+	if order := rt.Order(routes, egress.Source{}); order[0].Type != policy.RouteDirect {
+		t.Fatalf("parent rejecting credentials should stay last, got %v", order)
+	}
+
+	// A successful health check restores the original order.
+	revived.Close()
+	if revived, err = net.Listen("tcp", deadAddr); err != nil {
+		t.Skipf("cannot rebind %s: %v", deadAddr, err)
+	}
+	serveConnect(t, revived, basicAuth("u", "p"))
+	rt.Check(context.Background())
+	if order := rt.Order(routes, egress.Source{}); order[0].Type != policy.RouteHTTP {
+		t.Fatalf("healthy route should be first again, got %v", order)
+	}
+}
+
+func TestRouterHealthPerSource(t *testing.T) {
+	dest := echoServer(t)
+	parent := connectParent(t, basicAuth("u", "p"))
+	var mu sync.Mutex
+	var probed []string
+	// Forward to the parent, refusing conns from 127.0.0.2, as a parent
+	// that allowlists source addresses would.
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { front.Close() })
+	go func() {
+		for {
+			c, err := front.Accept()
+			if err != nil {
+				return
+			}
+			from, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+			mu.Lock()
+			probed = append(probed, from)
+			mu.Unlock()
+			if from == "127.0.0.2" {
+				c.Close()
+				continue
+			}
+			go func() {
+				defer c.Close()
+				up, err := net.Dial("tcp", parent.Addr().String())
+				if err != nil {
+					return
+				}
+				defer up.Close()
+				go io.Copy(up, c)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+
+	src := egress.Source{Address: "127.0.0.2"}
+	if c, err := net.DialTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}, dest.Addr().(*net.TCPAddr)); err != nil {
+		t.Skipf("cannot bind 127.0.0.2 here: %v", err)
+	} else {
+		c.Close()
+	}
+	rt := NewRouter(time.Second, nil)
+	routes := []policy.Route{
+		{Type: policy.RouteHTTP, Address: front.Addr().String(), Username: "u", Password: "p"},
+		{Type: policy.RouteDirect},
+	}
+	for _, s := range []egress.Source{{}, src} {
+		if c, _, err := rt.Dial(context.Background(), routes, s, dest.Addr().String()); err == nil {
+			c.Close()
+		}
+	}
+	if order := rt.Order(routes, egress.Source{}); order[0].Type != policy.RouteHTTP {
+		t.Fatalf("parent works from the default source, got %v", order)
+	}
+	if order := rt.Order(routes, src); order[0].Type != policy.RouteDirect {
+		t.Fatalf("parent refuses 127.0.0.2 and should be last for it, got %v", order)
+	}
+
+	// The health check probes from each source the route was used with.
+	mu.Lock()
+	probed = nil
+	mu.Unlock()
+	rt.Check(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(probed)
+	if !slices.Equal(probed, []string{"127.0.0.1", "127.0.0.2"}) {
+		t.Fatalf("want one probe from each source, got %v", probed)
+	}
+	if order := rt.Order(routes, src); order[0].Type != policy.RouteDirect {
+		t.Fatalf("check should keep the route down for 127.0.0.2, got %v", order)
+	}
+}
+
+func TestTransportUsesContextRoute(t *testing.T) {
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives absolute-form request URIs.
+		if !r.URL.IsAbs() {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "via parent "+r.URL.Host)
+	}))
+	defer parent.Close()
+
+	// Parents are operator-configured and exempt from the SSRF guard.
+	guard := ssrf.New([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	tr := NewTransport(Config{Guard: guard})
+	route := policy.Route{Type: policy.RouteHTTP, Address: parent.Listener.Addr().String()}
+	req, _ := http.NewRequest(http.MethodGet, "http://origin.example/", nil)
+	req = req.WithContext(WithRoute(req.Context(), route))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "via parent origin.example" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestRouterRoundTripFallback(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "direct")
+	}))
+	defer origin.Close()
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	rt := NewRouter(time.Second, nil)
+	tr := NewTransport(Config{})
+	routes := []policy.Route{{Type: policy.RouteHTTP, Address: deadAddr}, {Type: policy.RouteDirect}}
+
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	resp, used, err := rt.RoundTrip(tr, egress.Source{}, req, routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if used.Route.Type != policy.RouteDirect || used.ResolvedIP != "127.0.0.1" {
+		t.Fatalf("want fallback to direct via 127.0.0.1, got %+v", used)
+	}
+
+	// A request with a body must not be replayed on the next route.
+	rt = NewRouter(time.Second, nil)
+	req, _ = http.NewRequest(http.MethodPost, origin.URL, strings.NewReader("payload"))
+	if _, used, err := rt.RoundTrip(tr, egress.Source{}, req, routes); err == nil || used.Route.Type != policy.RouteHTTP {
+		t.Fatalf("body request should fail on the first route, got %+v %v", used, err)
+	}
+}
+
+func TestGuardRefusesDirectButNotParent(t *testing.T) {
+	dest := echoServer(t)
+	parent := connectParent(t, basicAuth("u", "p"))
+	guard := ssrf.New([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	rt := NewRouter(time.Second, guard)
+
+	// Direct to a denied range fails without falling back to other routes.
+	routes := []policy.Route{{Type: policy.RouteDirect}, {Type: policy.RouteHTTP, Address: parent.Addr().String(), Username: "u", Password: "p"}}
+	if _, _, err := rt.Dial(context.Background(), routes, egress.Source{}, dest.Addr().String()); !Denied(err) {
+		t.Fatalf("want SSRF denial, got %v", err)
+	}
+
+	// The same destination through a parent is the parent's to resolve.
+	c, out, err := rt.Dial(context.Background(), routes[1:], egress.Source{}, dest.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if out.Route.Type != policy.RouteHTTP {
+		t.Fatalf("unexpected outcome %+v", out)
+	}
+
+	// The shared transport applies the same guard to direct requests.
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	tr := NewTransport(Config{Guard: guard})
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	if _, _, err := rt.RoundTrip(tr, egress.Source{}, req, nil); !Denied(err) {
+		t.Fatalf("transport should refuse denied destination, got %v", err)
+	}
+}
+
+func TestEgressSource(t *testing.T) {
+	dest := echoServer(t)
+	parent := connectParent(t, basicAuth("u", "p"))
+	rt := NewRouter(time.Second, nil)
+	src := egress.Source{Address: "127.0.0.2"}
+	if c, err := net.DialTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}, dest.Addr().(*net.TCPAddr)); err != nil {
+		t.Skipf("cannot bind 127.0.0.2 here: %v", err)
+	} else {
+		c.Close()
+	}
+
+	parentRoute := policy.Route{Type: policy.RouteHTTP, Address: parent.Addr().String(), Username: "u", Password: "p"}
+	for _, r := range []policy.Route{{Type: policy.RouteDirect}, parentRoute} {
+		c, out, err := rt.Dial(context.Background(), []policy.Route{r}, src, dest.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if out.EgressIP != "127.0.0.2" {
+			t.Fatalf("%s: want egress 127.0.0.2, got %+v", r, out)
+		}
+	}
+
+	// Each source gets its own transport, so pooled conns never cross sources.
+	var peer string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}))
+	defer origin.Close()
+	pool := NewPool(Config{})
+	defer pool.CloseIdleConnections()
+	if pool.Transport(src) != pool.Transport(src) || pool.Transport(src) == pool.Transport(egress.Source{}) {
+		t.Fatal("want one transport per source")
+	}
+	for _, s := range []egress.Source{src, {}} {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		resp, out, err := rt.RoundTrip(pool.Transport(s), s, req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if out.EgressIP != peer {
+			t.Fatalf("source %+v: outcome egress %s, origin saw %s", s, out.EgressIP, peer)
+		}
+		if s == src && peer != "127.0.0.2" {
+			t.Fatalf("want request from 127.0.0.2, origin saw %s", peer)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Package upstream builds the gateway's long-lived outbound HTTP transport.
+//
+// One transport per egress source is shared by every forwarded request so
+// that idle upstream connections are pooled per destination and reused, and
+// HTTPS upstreams can negotiate HTTP/2. Pool activity is exported through internal/metrics.
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/egress"
+	cgmetrics "github.com/bufordtjustice2918/crispy-garbanzo/internal/metrics"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/policy"
+	"github.com/bufordtjustice2918/crispy-garbanzo/internal/ssrf"
+)
+
+// Config tunes the shared transport. Zero values select the defaults.
+type Config struct {
+	MaxIdleConns          int           // total idle conns across all hosts (default 256)
+	MaxIdleConnsPerHost   int           // idle conns kept per destination (default 32)
+	MaxConnsPerHost       int           // dialing+active+idle per destination (0 = unlimited)
+	IdleConnTimeout       time.Duration // idle conn lifetime (default 90s)
+	DialTimeout           time.Duration // TCP connect timeout (default 10s)
+	ResponseHeaderTimeout time.Duration // wait for upstream response headers (default 30s)
+	H2C                   bool          // speak prior-knowledge HTTP/2 to plain http:// upstreams
+	Guard                 *ssrf.Guard   // vets direct destinations; nil = no checks
+	Source                egress.Source // local address upstream conns leave from; zero = kernel's choice
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = 256
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = 32
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = 90 * time.Second
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = 10 * time.Second
+	}
+	if c.ResponseHeaderTimeout == 0 {
+		c.ResponseHeaderTimeout = 30 * time.Second
+	}
+	return c
+}
+
+// NewTransport returns a pooled transport with HTTP/2 enabled for TLS
+// upstreams. It never consults proxy environment variables; a parent proxy
+// is used only when the request context carries one (see WithRoute).
+func NewTransport(cfg Config) *http.Transport {
+	cfg = cfg.withDefaults()
+	dialer := &egress.Dialer{
+		Dialer: net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second},
+		Source: cfg.Source,
+	}
+
+	t := &http.Transport{
+		Proxy:                 proxyFromContext,
+		DialContext:           countingDial(guardedDial(dialer, cfg.Guard)),
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if cfg.H2C {
+		p := new(http.Protocols)
+		p.SetHTTP1(true)
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+		t.Protocols = p
+	}
+	return t
+}
+
+// Trace attaches connection-reuse accounting to an outbound request.
+// The returned request must be used in place of r.
+func Trace(r *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			cgmetrics.UpstreamRequestsTotal.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// guardedDial vets direct destinations with g. Dials to a parent proxy (the
+// request carries a parent route) are not vetted: parents are configured by
+// the operator and commonly live on private addresses.
+func guardedDial(d *egress.Dialer, g *ssrf.Guard) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if r, ok := ctx.Value(routeKey{}).(policy.Route); ok && r.Type != policy.RouteDirect && r.Type != "" {
+			return d.DialContext(ctx, network, addr)
+		}
+		return dialGuarded(ctx, d, g, network, addr)
+	}
+}
+
+// dialGuarded resolves addr (host:port) through g, so every address is
+// vetted, and dials the vetted addresses with d.
+func dialGuarded(ctx context.Context, d *egress.Dialer, g *ssrf.Guard, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := g.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialAddrs(ctx, network, ips, port)
+}
+
+// Pool holds one shared transport per egress source, so a pooled conn is
+// only ever reused by requests that select the source it was dialed from.
+// All methods are safe for concurrent use.
+type Pool struct {
+	cfg Config
+
+	mu sync.Mutex
+	ts map[egress.Source]*http.Transport
+}
+
+// NewPool returns a Pool whose transports are built from cfg; cfg.Source is
+// ignored.
+func NewPool(cfg Config) *Pool {
+	return &Pool{cfg: cfg, ts: make(map[egress.Source]*http.Transport)}
+}
+
+// Transport returns the transport for src, creating it on first use.
+func (p *Pool) Transport(src egress.Source) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.ts[src]
+	if !ok {
+		cfg := p.cfg
+		cfg.Source = src
+		t = NewTransport(cfg)
+		p.ts[src] = t
+	}
+	return t
+}
+
+// CloseIdleConnections closes the idle conns of every transport.
+func (p *Pool) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.ts {
+		t.CloseIdleConnections()
+	}
+}
+
+// countingDial wraps dial so every upstream conn is reflected in the pool gauges.
+func countingDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			cgmetrics.UpstreamDialsTotal.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		cgmetrics.UpstreamDialsTotal.WithLabelValues("ok").Inc()
+		cgmetrics.UpstreamConnsOpen.Inc()
+		return &countedConn{Conn: c}, nil
+	}
+}
+
+// countedConn decrements the open-conns gauge exactly once on Close.
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(cgmetrics.UpstreamConnsOpen.Dec)
+	return c.Conn.Close()
+}
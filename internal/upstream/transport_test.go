@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	cgmetrics "github.com/bufordtjustice2918/crispy-garbanzo/internal/metrics"
+)
+
+// value reads the current value of a counter or gauge.
+func value(m prometheus.Metric) float64 {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		panic(err)
+	}
+	if pb.Counter != nil {
+		return pb.Counter.GetValue()
+	}
+	return pb.Gauge.GetValue()
+}
+
+func TestTransportReusesConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	tr := NewTransport(Config{})
+	dials := value(cgmetrics.UpstreamDialsTotal.WithLabelValues("ok"))
+	reused := value(cgmetrics.UpstreamRequestsTotal.WithLabelValues("true"))
+
+	for range 3 {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		resp, err := tr.RoundTrip(Trace(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if got := value(cgmetrics.UpstreamDialsTotal.WithLabelValues("ok")) - dials; got != 1 {
+		t.Fatalf("want 1 dial for 3 sequential requests, got %v", got)
+	}
+	if got := value(cgmetrics.UpstreamRequestsTotal.WithLabelValues("true")) - reused; got != 2 {
+		t.Fatalf("want 2 reused conns, got %v", got)
+	}
+
+	open := value(cgmetrics.UpstreamConnsOpen)
+	tr.CloseIdleConnections()
+	if got := value(cgmetrics.UpstreamConnsOpen); got != open-1 {
+		t.Fatalf("closing the idle pool should release the conn: %v -> %v", open, got)
+	}
+}
+
+func TestTransportDefaults(t *testing.T) {
+	tr := NewTransport(Config{MaxConnsPerHost: 8})
+	t.Setenv("HTTP_PROXY", "http://env-proxy.invalid:3128")
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if u, err := tr.Proxy(req); u != nil || err != nil {
+		t.Fatalf("upstream transport must not use proxy env, got %v %v", u, err)
+	}
+	if !tr.ForceAttemptHTTP2 || tr.MaxIdleConnsPerHost != 32 || tr.MaxConnsPerHost != 8 {
+		t.Fatalf("unexpected transport settings: h2=%v idle/host=%d conns/host=%d",
+			tr.ForceAttemptHTTP2, tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost)
+	}
+}